@@ -0,0 +1,358 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ##### Constants ############################################################
+
+// AGGREGATOR_SWEEP_INTERVAL is how often (in data time, and in wall clock time
+// when the updates stop) incidents are checked for updates and resolution
+const AGGREGATOR_SWEEP_INTERVAL time.Duration = time.Minute
+
+// ##### Structs ##############################################################
+
+// IncidentState is the stage of an incident that an alert reports
+type IncidentState string
+
+// The incident states
+const (
+	IncidentOpened   IncidentState = "opened"
+	IncidentOngoing  IncidentState = "ongoing"
+	IncidentResolved IncidentState = "resolved"
+)
+
+// Incident groups the alerts with the same reason, prefix and origin AS
+// e.g. the same hijack seen by many peers across many update files
+type Incident struct {
+	Id           string
+	Reason       AlertReason
+	Prefix       string
+	Origin       uint32
+	Priority     AlertPriority
+	Opened       time.Time
+	LastSeen     time.Time
+	LastReported time.Time
+	Updates      int
+	Peers        map[string]struct{}
+	Collectors   map[string]struct{}
+	alert        *Alert
+}
+
+// Aggregator sits between the detector and the alert sinks, deduplicating
+// alerts into incidents. Time is taken from the BGP data rather than the
+// clock, so that replays of old data are aggregated in the same way, and is
+// moved on by the wall clock while no data is seen. The incident alerts are
+// queued in order under the lock, and sent to the sinks without it
+type Aggregator struct {
+	mux            sync.Mutex
+	incidents      map[string]*Incident
+	prefixes       map[string]map[string]*Incident
+	resolveWindow  time.Duration
+	updateInterval time.Duration
+	now            time.Time
+	observed       time.Time
+	lastSweep      time.Time
+	pending        []*Alert
+	notify         chan struct{}
+	stop           chan struct{}
+	done           chan struct{}
+	closed         bool
+}
+
+// ##### Methods ##############################################################
+
+// NewAggregator returns a new Aggregator that passes the incident alerts to emit
+func NewAggregator(resolveWindow time.Duration, updateInterval time.Duration, emit func(*Alert)) *Aggregator {
+
+	a := &Aggregator{
+		incidents:      make(map[string]*Incident),
+		prefixes:       make(map[string]map[string]*Incident),
+		resolveWindow:  resolveWindow,
+		updateInterval: updateInterval,
+		pending:        make([]*Alert, 0),
+		notify:         make(chan struct{}, 1),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	// A single consumer keeps the opened, ongoing and resolved alerts in order
+	go func() {
+		for {
+			alerts, closed := a.next()
+			for _, alert := range alerts {
+				emit(alert)
+			}
+
+			if closed == true {
+				close(a.done)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(AGGREGATOR_SWEEP_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.stop:
+				return
+			case now := <-ticker.C:
+				a.Sweep(now)
+			}
+		}
+	}()
+
+	return a
+}
+
+// Len returns the number of open incidents
+func (a *Aggregator) Len() int {
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return len(a.incidents)
+}
+
+// Close stops accepting alerts and waits for the queued alerts to be sent.
+// Incidents that are still open are not resolved
+func (a *Aggregator) Close() {
+
+	a.mux.Lock()
+	if a.closed == false {
+		a.closed = true
+		close(a.stop)
+		a.signal()
+	}
+	a.mux.Unlock()
+
+	<-a.done
+}
+
+// Add records the alert against the incident for each of its prefixes,
+// emitting an "opened" alert for any incident that is new
+func (a *Aggregator) Add(alert *Alert) {
+
+	prefixes := alert.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	var key string
+	var peer string
+	pending := make([]*Alert, 0)
+
+	for _, prefix := range prefixes {
+		key = fmt.Sprintf("%s|%s|%d", alert.Reason, prefix, alert.Origin)
+		peer = alert.Collector + "|" + alert.PeerIP.String()
+
+		i, ok := a.incidents[key]
+		if ok == false {
+			i = &Incident{
+				Id:           incidentId(key, alert.Timestamp),
+				Reason:       alert.Reason,
+				Prefix:       prefix,
+				Origin:       alert.Origin,
+				Priority:     alert.Priority,
+				Opened:       alert.Timestamp,
+				LastSeen:     alert.Timestamp,
+				LastReported: alert.Timestamp,
+				Peers:        make(map[string]struct{}),
+				Collectors:   make(map[string]struct{}),
+			}
+			a.incidents[key] = i
+
+			if a.prefixes[prefix] == nil {
+				a.prefixes[prefix] = make(map[string]*Incident)
+			}
+			a.prefixes[prefix][key] = i
+		}
+
+		i.Updates++
+		i.Peers[peer] = struct{}{}
+		i.Collectors[alert.Collector] = struct{}{}
+		i.alert = alert
+
+		if alert.Priority < i.Priority {
+			i.Priority = alert.Priority
+		}
+		if alert.Timestamp.After(i.LastSeen) == true {
+			i.LastSeen = alert.Timestamp
+		}
+
+		if ok == false {
+			pending = append(pending, i.newAlert(IncidentOpened, alert.Timestamp))
+		}
+	}
+
+	pending = append(pending, a.advance(alert.Timestamp, time.Now())...)
+
+	a.send(pending)
+}
+
+// Observe moves the aggregator clock on from the detection data, and treats
+// withdrawals of an incident prefix, by a peer that announced it, as activity
+func (a *Aggregator) Observe(dd *DetectData) {
+
+	peer := dd.Name + "|" + dd.PeerIP.String()
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, w := range dd.Withdrawn {
+		for _, i := range a.prefixes[w.String()] {
+			if _, ok := i.Peers[peer]; ok == false {
+				continue
+			}
+			if dd.Timestamp.After(i.LastSeen) == true {
+				i.LastSeen = dd.Timestamp
+			}
+		}
+	}
+
+	a.send(a.advance(dd.Timestamp, time.Now()))
+}
+
+// Sweep moves the clock on by the wall clock time since it last moved, so that
+// incidents are still reported and resolved once the updates stop
+func (a *Aggregator) Sweep(wall time.Time) {
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	if a.now.IsZero() == true {
+		return
+	}
+
+	a.send(a.advance(a.now.Add(wall.Sub(a.observed)), wall))
+}
+
+// advance moves the clock forward, recording the wall clock time that it moved
+// at, and at most once per sweep interval reports ongoing incidents and resolves
+// those that have gone quiet. The lock must be held
+func (a *Aggregator) advance(ts time.Time, wall time.Time) []*Alert {
+
+	if ts.After(a.now) == true {
+		a.now = ts
+		a.observed = wall
+	}
+
+	if a.now.Sub(a.lastSweep) < AGGREGATOR_SWEEP_INTERVAL {
+		return nil
+	}
+	a.lastSweep = a.now
+
+	pending := make([]*Alert, 0)
+
+	for key, i := range a.incidents {
+		if a.now.Sub(i.LastSeen) >= a.resolveWindow {
+			pending = append(pending, i.newAlert(IncidentResolved, a.now))
+
+			delete(a.incidents, key)
+			delete(a.prefixes[i.Prefix], key)
+			if len(a.prefixes[i.Prefix]) == 0 {
+				delete(a.prefixes, i.Prefix)
+			}
+			continue
+		}
+
+		// Only report incidents that have seen activity since they were last reported
+		if a.updateInterval > 0 && a.now.Sub(i.LastReported) >= a.updateInterval && i.LastSeen.After(i.LastReported) == true {
+			i.LastReported = a.now
+			pending = append(pending, i.newAlert(IncidentOngoing, a.now))
+		}
+	}
+
+	// Keep the output in a consistent order
+	sort.Slice(pending, func(x, y int) bool {
+		return pending[x].Metadata["incident"] < pending[y].Metadata["incident"]
+	})
+
+	return pending
+}
+
+// send queues the alerts for the sinks without blocking, the lock must be held so that the order is kept
+func (a *Aggregator) send(alerts []*Alert) {
+
+	if a.closed == true || len(alerts) == 0 {
+		return
+	}
+
+	a.pending = append(a.pending, alerts...)
+	a.signal()
+}
+
+// signal wakes the consumer, if it is not already due to wake. The lock must be held
+func (a *Aggregator) signal() {
+
+	select {
+	case a.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for queued alerts, returning them and whether the aggregator has been closed
+func (a *Aggregator) next() ([]*Alert, bool) {
+
+	<-a.notify
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	alerts := a.pending
+	a.pending = make([]*Alert, 0)
+
+	return alerts, a.closed
+}
+
+// newAlert returns an alert reporting the state of the incident, based on the latest alert
+func (i *Incident) newAlert(state IncidentState, ts time.Time) *Alert {
+
+	alert := *i.alert
+	alert.Timestamp = ts
+	alert.Priority = i.Priority
+	alert.Prefixes = make([]string, 0, 1)
+	if len(i.Prefix) > 0 {
+		alert.Prefixes = append(alert.Prefixes, i.Prefix)
+	}
+
+	alert.Metadata = make(map[string]string)
+	for k, v := range i.alert.Metadata {
+		alert.Metadata[k] = v
+	}
+
+	collectors := make([]string, 0, len(i.Collectors))
+	for c := range i.Collectors {
+		collectors = append(collectors, c)
+	}
+	sort.Strings(collectors)
+
+	alert.Metadata["incident"] = i.Id
+	alert.Metadata["state"] = string(state)
+	alert.Metadata["peers"] = fmt.Sprintf("%d", len(i.Peers))
+	alert.Metadata["collectors"] = strings.Join(collectors, ",")
+	alert.Metadata["updates"] = fmt.Sprintf("%d", i.Updates)
+	alert.Metadata["first_seen"] = i.Opened.UTC().Format(time.RFC3339)
+	alert.Metadata["last_seen"] = i.LastSeen.UTC().Format(time.RFC3339)
+
+	return &alert
+}
+
+// incidentId returns a short identifier for the incident key and opening time
+func incidentId(key string, ts time.Time) string {
+
+	hash := sha1.Sum([]byte(fmt.Sprintf("%s|%d", key, ts.UnixNano())))
+	return hex.EncodeToString(hash[:6])
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestAggregatorSweep checks that an incident is resolved by the wall clock
+// sweep once the updates stop, without any further detection data
+func TestAggregatorSweep(t *testing.T) {
+
+	sink := new(testSink)
+	a := NewAggregator(30*time.Minute, 0, func(alert *Alert) { sink.Send(alert) })
+
+	dd := &DetectData{Name: TEST_COLLECTOR, Timestamp: testTime(0), PeerAs: 3356, PeerIP: net.ParseIP(testPeerIP(0)),
+		PathsString: "3356 64666"}
+	a.Add(NewAlert(dd, PriorityHigh, ReasonInvalidPrefixPeer, []string{"192.104.160.0/23"}, nil))
+
+	// Less than the resolve window of wall clock time
+	a.Sweep(time.Now().Add(10 * time.Minute))
+	if a.Len() != 1 {
+		t.Fatalf("expected the incident to be open, %d incidents", a.Len())
+	}
+
+	a.Sweep(time.Now().Add(31 * time.Minute))
+	if a.Len() != 0 {
+		t.Fatalf("expected the incident to be resolved, %d incidents", a.Len())
+	}
+
+	a.Close()
+
+	alerts := sink.Alerts()
+	if len(alerts) != 2 || alerts[0].Metadata["state"] != string(IncidentOpened) ||
+		alerts[1].Metadata["state"] != string(IncidentResolved) {
+		t.Fatalf("expected opened and resolved alerts, got %d", len(alerts))
+	}
+	if alerts[1].Timestamp.Before(testTime(30)) == true {
+		t.Errorf("expected the incident to be resolved after the window, at %v", alerts[1].Timestamp)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ##### Structs ##############################################################
+
+// AlertReason is the machine readable code for why an alert was raised
+type AlertReason string
+
+// The alert reason codes
+const (
+	ReasonMonitoredCountry  AlertReason = "monitored_country"
+	ReasonFirstAppearance   AlertReason = "first_appearance"
+	ReasonLowFrequency      AlertReason = "low_frequency"
+	ReasonModerateFrequency AlertReason = "moderate_frequency"
+	ReasonInvalidPrefixPeer AlertReason = "invalid_prefix_peer"
+	ReasonSubPrefixHijack   AlertReason = "sub_prefix_hijack"
+	ReasonCoveringPrefix    AlertReason = "covering_prefix"
+	ReasonRogueFirstPeer    AlertReason = "rogue_first_peer"
+	ReasonMassWithdrawal    AlertReason = "mass_withdrawal"
+	ReasonAsSetOrigin       AlertReason = "as_set_origin"
+	ReasonRpkiInvalid       AlertReason = "rpki_invalid"
+	ReasonRouteLeak         AlertReason = "route_leak"
+	ReasonNewAdjacency      AlertReason = "new_adjacency"
+	ReasonSessionUp         AlertReason = "session_established"
+	ReasonSessionDown       AlertReason = "session_down"
+)
+
+// Alert is a single detection, passed to each of the alert sinks
+type Alert struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Priority  AlertPriority     `json:"priority"`
+	Reason    AlertReason       `json:"reason"`
+	Collector string            `json:"collector"`
+	PeerIP    net.IP            `json:"peer_ip"`
+	PeerAs    uint32            `json:"peer_as"`
+	Prefixes  []string          `json:"prefixes"`
+	Path      string            `json:"path"`
+	Origin    uint32            `json:"origin"`
+	Metadata  map[string]string `json:"metadata"`
+	Profiles  []string          `json:"profiles"`
+}
+
+// AlertSink is a destination for alerts e.g. the console, a file or a remote service
+type AlertSink interface {
+	Name() string
+	Send(alert *Alert) error
+	Close() error
+}
+
+// alertSinkFilter wraps a sink with the minimum priority of the alerts that it receives
+type alertSinkFilter struct {
+	sink        AlertSink
+	minPriority AlertPriority
+}
+
+// ##### Methods ##############################################################
+
+// String returns the readable name for the reason, as historically output to the console
+func (ar AlertReason) String() string {
+
+	switch ar {
+	case ReasonMonitoredCountry:
+		return "Monitored Country"
+	case ReasonFirstAppearance:
+		return "First Appearance"
+	case ReasonLowFrequency:
+		return "Low Frequency"
+	case ReasonModerateFrequency:
+		return "Moderate Frequency"
+	case ReasonInvalidPrefixPeer:
+		return "Invalid Prefix Peer"
+	case ReasonSubPrefixHijack:
+		return "Sub-Prefix Hijack"
+	case ReasonCoveringPrefix:
+		return "Covering Prefix"
+	case ReasonRogueFirstPeer:
+		return "Rogue First Peer"
+	case ReasonMassWithdrawal:
+		return "Mass Withdrawal"
+	case ReasonAsSetOrigin:
+		return "AS_SET Origin"
+	case ReasonRpkiInvalid:
+		return "RPKI Invalid"
+	case ReasonRouteLeak:
+		return "Route Leak"
+	case ReasonNewAdjacency:
+		return "New Adjacency"
+	case ReasonSessionUp:
+		return "BGP Session Established"
+	case ReasonSessionDown:
+		return "BGP Session Down"
+	default:
+		return string(ar)
+	}
+}
+
+// NewAlert returns a new alert for the detection data
+func NewAlert(dd *DetectData, priority AlertPriority, reason AlertReason, prefixes []string, metadata map[string]string) *Alert {
+
+	alert := &Alert{
+		Timestamp: dd.Timestamp,
+		Priority:  priority,
+		Reason:    reason,
+		Collector: dd.Name,
+		PeerIP:    dd.PeerIP,
+		PeerAs:    dd.PeerAs,
+		Prefixes:  prefixes,
+		Path:      dd.PathsString,
+		Metadata:  metadata,
+	}
+
+	if dd.AsPath != nil {
+		alert.Origin = dd.AsPath.Origin
+	}
+
+	if alert.Prefixes == nil {
+		alert.Prefixes = make([]string, 0)
+	}
+
+	if alert.Metadata == nil {
+		alert.Metadata = make(map[string]string)
+	}
+
+	alert.Profiles = make([]string, 0)
+
+	return alert
+}
+
+// Data returns the metadata as "key: value" lines, in key order
+func (a *Alert) Data() string {
+
+	keys := make([]string, 0, len(a.Metadata))
+	for k := range a.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("%s: %s", k, a.Metadata[k]))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Summary returns a single line description of the alert
+func (a *Alert) Summary() string {
+
+	return fmt.Sprintf("%s: %s peer AS%d (%s) prefixes [%s] path [%s]",
+		a.Priority, a.Reason, a.PeerAs, a.Collector, strings.Join(a.Prefixes, " "), a.Path)
+}
+
+// NewAlertSink creates the sink described by the configuration
+func NewAlertSink(asc AlertSinkConfig) (AlertSink, error) {
+
+	switch strings.ToLower(asc.Type) {
+	case "console":
+		return NewConsoleSink(), nil
+	case "file":
+		return NewFileSink(asc.Path)
+	case "syslog":
+		return NewSyslogSink(asc.Network, asc.Address)
+	case "webhook":
+		return NewWebhookSink(asc.Url)
+	case "database":
+		return NewDatabaseSink(), nil
+	default:
+		return nil, fmt.Errorf("unknown alert sink type: %s", asc.Type)
+	}
+}
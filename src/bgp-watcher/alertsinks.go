@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ##### Constants ############################################################
+
+// SYSLOG_FACILITY is local0, SYSLOG_SD_ID uses the documentation enterprise number,
+// SINK_TIMEOUT applies to connecting to remote sinks
+const SYSLOG_FACILITY int = 16
+const SYSLOG_SD_ID string = "bgpm@32473"
+const SINK_TIMEOUT time.Duration = 10 * time.Second
+
+// ##### Structs ##############################################################
+
+// ConsoleSink prints coloured alerts to StdOut (the original behaviour)
+type ConsoleSink struct {
+	mux sync.Mutex
+}
+
+// FileSink appends alerts to a file as JSON lines
+type FileSink struct {
+	mux  sync.Mutex
+	path string
+	file *os.File
+}
+
+// SyslogSink sends RFC 5424 formatted alerts over UDP or TCP
+type SyslogSink struct {
+	mux      sync.Mutex
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+// WebhookSink POSTs each alert as JSON to a URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// ##### Methods ##############################################################
+
+// NewConsoleSink returns a new ConsoleSink
+func NewConsoleSink() *ConsoleSink {
+
+	return new(ConsoleSink)
+}
+
+func (s *ConsoleSink) Name() string {
+
+	return "console"
+}
+
+func (s *ConsoleSink) Send(alert *Alert) error {
+
+	// Stops the lines of concurrent alerts being interleaved
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	printAlert(alert)
+	return nil
+}
+
+func (s *ConsoleSink) Close() error {
+
+	return nil
+}
+
+// NewFileSink returns a new FileSink, creating the file (and directory) if required
+func NewFileSink(path string) (*FileSink, error) {
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("file alert sink requires a path")
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0770)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSink{path: path, file: f}, nil
+}
+
+func (s *FileSink) Name() string {
+
+	return "file:" + s.path
+}
+
+func (s *FileSink) Send(alert *Alert) error {
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	_, err = s.file.Write(append(data, '\n'))
+	return err
+}
+
+func (s *FileSink) Close() error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.file.Close()
+}
+
+// NewSyslogSink returns a new SyslogSink, the network is "udp" (default) or "tcp"
+func NewSyslogSink(network string, address string) (*SyslogSink, error) {
+
+	if len(address) == 0 {
+		return nil, fmt.Errorf("syslog alert sink requires an address")
+	}
+
+	network = strings.ToLower(network)
+	if len(network) == 0 {
+		network = "udp"
+	}
+
+	if network != "udp" && network != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog network: %s", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+
+	return &SyslogSink{network: network, address: address, hostname: hostname}, nil
+}
+
+func (s *SyslogSink) Name() string {
+
+	return "syslog:" + s.network + "://" + s.address
+}
+
+// Send writes the alert, (re)connecting if required. TCP messages use octet counting framing (RFC 6587)
+func (s *SyslogSink) Send(alert *Alert) error {
+
+	msg := s.format(alert)
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var err error
+	if s.conn == nil {
+		s.conn, err = net.DialTimeout(s.network, s.address, SINK_TIMEOUT)
+		if err != nil {
+			s.conn = nil
+			return err
+		}
+	}
+
+	_, err = s.conn.Write([]byte(msg))
+	if err != nil {
+		// Drop the connection so that the next alert reconnects
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// format returns the RFC 5424 message e.g. <PRI>1 TIMESTAMP HOST APP PROCID MSGID [SD] MSG
+func (s *SyslogSink) format(alert *Alert) string {
+
+	severity := 5 // Notice
+	switch alert.Priority {
+	case PriorityHigh:
+		severity = 2 // Critical
+	case PriorityMedium:
+		severity = 4 // Warning
+	}
+
+	var sd bytes.Buffer
+	sd.WriteString("[" + SYSLOG_SD_ID)
+	sd.WriteString(fmt.Sprintf(` reason="%s"`, escapeSdValue(string(alert.Reason))))
+	sd.WriteString(fmt.Sprintf(` priority="%s"`, alert.Priority))
+	sd.WriteString(fmt.Sprintf(` collector="%s"`, escapeSdValue(alert.Collector)))
+	sd.WriteString(fmt.Sprintf(` peer_as="%d"`, alert.PeerAs))
+	sd.WriteString(fmt.Sprintf(` peer_ip="%s"`, alert.PeerIP))
+	sd.WriteString(fmt.Sprintf(` origin="%d"`, alert.Origin))
+	sd.WriteString(fmt.Sprintf(` prefixes="%s"`, escapeSdValue(strings.Join(alert.Prefixes, " "))))
+	sd.WriteString(fmt.Sprintf(` path="%s"`, escapeSdValue(alert.Path)))
+	sd.WriteString("]")
+
+	return fmt.Sprintf("<%d>1 %s %s bgpm %d %s %s %s",
+		SYSLOG_FACILITY*8+severity, alert.Timestamp.UTC().Format(time.RFC3339), s.hostname,
+		os.Getpid(), alert.Reason, sd.String(), alert.Summary())
+}
+
+// escapeSdValue escapes the characters that RFC 5424 requires to be escaped in structured data values
+func escapeSdValue(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// NewWebhookSink returns a new WebhookSink
+func NewWebhookSink(url string) (*WebhookSink, error) {
+
+	if len(url) == 0 {
+		return nil, fmt.Errorf("webhook alert sink requires a URL")
+	}
+
+	return &WebhookSink{url: url, client: &http.Client{Timeout: SINK_TIMEOUT}}, nil
+}
+
+func (s *WebhookSink) Name() string {
+
+	return "webhook:" + s.url
+}
+
+func (s *WebhookSink) Send(alert *Alert) error {
+
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+
+	return nil
+}
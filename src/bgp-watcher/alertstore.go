@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// ##### Structs ##############################################################
+
+// AlertRecord is an alert that has been persisted to the database
+type AlertRecord struct {
+	Alert
+	Id           int64 `json:"id"`
+	Acknowledged bool  `json:"acknowledged"`
+}
+
+// AlertQuery filters the persisted alerts, zero values are not filtered on
+type AlertQuery struct {
+	From           time.Time
+	To             time.Time
+	As             uint32
+	Prefix         string
+	Reason         string
+	Profile        string
+	Priority       AlertPriority
+	Unacknowledged bool
+	Limit          int
+}
+
+// DatabaseSink writes alerts to the "alerts" table
+type DatabaseSink struct {
+}
+
+// ##### Methods ##############################################################
+
+// NewDatabaseSink returns a new DatabaseSink, using the global connection pool
+func NewDatabaseSink() *DatabaseSink {
+
+	return new(DatabaseSink)
+}
+
+func (s *DatabaseSink) Name() string {
+
+	return "database"
+}
+
+func (s *DatabaseSink) Send(alert *Alert) error {
+
+	return insertAlert(alert)
+}
+
+func (s *DatabaseSink) Close() error {
+
+	return nil
+}
+
+// insertAlert persists a single alert
+func insertAlert(alert *Alert) error {
+
+	data, err := json.Marshal(alert.Metadata)
+	if err != nil {
+		return err
+	}
+
+	profiles := alert.Profiles
+	if profiles == nil {
+		profiles = make([]string, 0)
+	}
+
+	_, err = pool.Exec(`insert into alerts (timestamp, collector, peer_as, peer_ip, prefixes, path, origin, reason, priority, data, profiles)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::jsonb, $11)`,
+		alert.Timestamp, alert.Collector, alert.PeerAs, alert.PeerIP.String(), alert.Prefixes,
+		alert.Path, alert.Origin, string(alert.Reason), int32(alert.Priority), string(data), profiles)
+
+	return err
+}
+
+// queryAlerts returns the persisted alerts that match the query, newest first
+func queryAlerts(q *AlertQuery) ([]*AlertRecord, error) {
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, strings.Replace(condition, "?", fmt.Sprintf("$%d", len(args)), -1))
+	}
+
+	if q.From.IsZero() == false {
+		addCondition("timestamp >= ?", q.From)
+	}
+	if q.To.IsZero() == false {
+		addCondition("timestamp <= ?", q.To)
+	}
+	if q.As > 0 {
+		addCondition("(peer_as = ? or origin = ?)", q.As)
+	}
+	if len(q.Prefix) > 0 {
+		// Include alerts for more specific prefixes e.g. sub-prefix hijacks
+		addCondition("exists (select 1 from unnest(prefixes) p where p::cidr <<= ?::cidr)", q.Prefix)
+	}
+	if len(q.Reason) > 0 {
+		addCondition("reason = ?", q.Reason)
+	}
+	if len(q.Profile) > 0 {
+		addCondition("? = any(profiles)", q.Profile)
+	}
+	if q.Priority > 0 {
+		addCondition("priority <= ?", int32(q.Priority))
+	}
+	if q.Unacknowledged == true {
+		conditions = append(conditions, "acknowledged = false")
+	}
+
+	sql := `select id, timestamp, collector, peer_as, peer_ip, prefixes, path, origin, reason, priority, data::text, acknowledged, profiles from alerts`
+	if len(conditions) > 0 {
+		sql += " where " + strings.Join(conditions, " and ")
+	}
+	sql += " order by timestamp desc, id desc"
+	if q.Limit > 0 {
+		sql += fmt.Sprintf(" limit %d", q.Limit)
+	}
+
+	rows, err := pool.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make([]*AlertRecord, 0)
+
+	var peerIP string
+	var reason string
+	var priority int32
+	var data string
+
+	for rows.Next() {
+		ar := new(AlertRecord)
+
+		err = rows.Scan(&ar.Id, &ar.Timestamp, &ar.Collector, &ar.PeerAs, &peerIP, &ar.Prefixes, &ar.Path,
+			&ar.Origin, &reason, &priority, &data, &ar.Acknowledged, &ar.Profiles)
+		if err != nil {
+			return alerts, err
+		}
+
+		ar.PeerIP = net.ParseIP(peerIP)
+		ar.Reason = AlertReason(reason)
+		ar.Priority = AlertPriority(priority)
+
+		err = json.Unmarshal([]byte(data), &ar.Metadata)
+		if err != nil {
+			fmt.Printf("Error decoding alert data (%d): %v\n", ar.Id, err)
+		}
+
+		alerts = append(alerts, ar)
+	}
+
+	return alerts, rows.Err()
+}
+
+// acknowledgeAlerts flags the alerts as acknowledged, returning the number updated
+func acknowledgeAlerts(ids []int64) (int64, error) {
+
+	tag, err := pool.Exec("update alerts set acknowledged = true where id = any($1)", ids)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ##### Structs ##############################################################
+
+// ApiServer serves the alerts, history, route state, configuration and
+// status as JSON, for dashboards and scripts
+type ApiServer struct {
+	Address  string
+	detector *Detector
+	monitor  *Monitor
+	server   *http.Server
+}
+
+// apiHistory is the history of a path used by a peer AS
+type apiHistory struct {
+	PeerAs    uint32          `json:"peer_as"`
+	Path      string          `json:"path"`
+	Count     uint64          `json:"count"`
+	Seen      bool            `json:"seen"`
+	FirstSeen *time.Time      `json:"first_seen,omitempty"`
+	LastSeen  *time.Time      `json:"last_seen,omitempty"`
+	Days      json.RawMessage `json:"days,omitempty"`
+}
+
+// apiRoute is the current state of a prefix as seen by a collector peer
+type apiRoute struct {
+	Collector string     `json:"collector"`
+	PeerIP    string     `json:"peer_ip"`
+	PeerAs    uint32     `json:"peer_as"`
+	State     string     `json:"state"`
+	Path      string     `json:"path"`
+	Origin    uint32     `json:"origin"`
+	Announced *time.Time `json:"announced,omitempty"`
+	Withdrawn *time.Time `json:"withdrawn,omitempty"`
+}
+
+// apiRouteCount is an origin or path, and the number of collector peers that
+// have announced it and currently announce it
+type apiRouteCount struct {
+	Origin uint32 `json:"origin,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Peers  int    `json:"peers"`
+	Active int    `json:"active"`
+}
+
+// apiPrefix is what has been seen for a prefix
+type apiPrefix struct {
+	Prefix  string           `json:"prefix"`
+	Origins []*apiRouteCount `json:"origins"`
+	Paths   []*apiRouteCount `json:"paths"`
+	Routes  []apiRoute       `json:"routes"`
+}
+
+// apiConfig is the monitoring configuration
+type apiConfig struct {
+	TargetAs            []uint32          `json:"target_as"`
+	Prefixes            []string          `json:"prefixes"`
+	MonitorCountryCodes []string          `json:"monitor_country_codes"`
+	NeighbourPeers      []uint32          `json:"neighbour_peers"`
+	DataSets            map[string]string `json:"data_sets"`
+	HistoryWindow       int               `json:"history_window"`
+	HistoryStore        string            `json:"history_store"`
+	Rules               []apiRule         `json:"rules"`
+	Profiles            []apiProfile      `json:"profiles"`
+}
+
+// apiProfile is a named monitoring profile, it uses all of the rules if none are listed
+type apiProfile struct {
+	Name                string   `json:"name"`
+	TargetAs            []uint32 `json:"target_as"`
+	Prefixes            []string `json:"prefixes"`
+	NeighbourPeers      []uint32 `json:"neighbour_peers"`
+	MonitorCountryCodes []string `json:"monitor_country_codes"`
+	Rules               []string `json:"rules"`
+}
+
+// apiRule is a detection rule, the priority is empty if the check's own priorities are used
+type apiRule struct {
+	Name       string         `json:"name"`
+	Enabled    bool           `json:"enabled"`
+	Priority   string         `json:"priority"`
+	Thresholds map[string]int `json:"thresholds"`
+	As         []uint32       `json:"as"`
+	Prefixes   []string       `json:"prefixes"`
+}
+
+// apiStatus is the state of the data sources used for detection
+type apiStatus struct {
+	Version    string              `json:"version"`
+	Collectors []CollectorStatus   `json:"collectors"`
+	Queued     int64               `json:"queued"`
+	Rpki       *apiRpkiStatus      `json:"rpki,omitempty"`
+	RisLive    *apiRisLiveStatus   `json:"ris_live,omitempty"`
+	Bmp        []*apiSessionStatus `json:"bmp,omitempty"`
+	Bgp        []*apiSessionStatus `json:"bgp,omitempty"`
+}
+
+type apiRpkiStatus struct {
+	Source       string `json:"source"`
+	Synchronised bool   `json:"synchronised"`
+	Serial       uint32 `json:"serial,omitempty"`
+	Age          int64  `json:"age,omitempty"`
+	Roas         int    `json:"roas"`
+}
+
+type apiRisLiveStatus struct {
+	Url         string     `json:"url"`
+	Connected   bool       `json:"connected"`
+	Messages    uint64     `json:"messages"`
+	LastMessage *time.Time `json:"last_message,omitempty"`
+}
+
+// apiSessionStatus is the state of a BMP router or BGP neighbour
+type apiSessionStatus struct {
+	Name     string    `json:"name"`
+	Address  string    `json:"address,omitempty"`
+	PeerAs   uint32    `json:"peer_as,omitempty"`
+	State    string    `json:"state"`
+	Changed  time.Time `json:"changed"`
+	Messages uint64    `json:"messages"`
+	PeersUp  *int      `json:"peers_up,omitempty"`
+	Peers    *int      `json:"peers,omitempty"`
+}
+
+// ##### Methods ##############################################################
+
+// NewApiServer returns a new ApiServer that will listen on the address (host:port)
+func NewApiServer(address string, detector *Detector, monitor *Monitor) *ApiServer {
+
+	return &ApiServer{
+		Address:  address,
+		detector: detector,
+		monitor:  monitor,
+	}
+}
+
+// Start serves the API in the background
+func (s *ApiServer) Start() error {
+
+	ln, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+
+	s.server = &http.Server{
+		Handler:      s.Handler(),
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	go func() {
+		err := s.server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Error serving API (%s): %v\n", s.Address, err)
+		}
+	}()
+
+	return nil
+}
+
+// Close stops serving the API
+func (s *ApiServer) Close() error {
+
+	if s.server == nil {
+		return nil
+	}
+
+	return s.server.Close()
+}
+
+// Handler returns the handler for the API endpoints
+func (s *ApiServer) Handler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/alerts", apiGet(s.handleAlerts))
+	mux.HandleFunc("/api/history", apiGet(s.handleHistory))
+	mux.HandleFunc("/api/routes", apiGet(s.handleRoutes))
+	mux.HandleFunc("/api/config", apiGet(s.handleConfig))
+	mux.HandleFunc("/api/status", apiGet(s.handleStatus))
+	mux.Handle("/metrics", metrics)
+
+	return mux
+}
+
+// handleAlerts lists the persisted alerts, filtered as with the "alerts" command e.g.
+// /api/alerts?from=2018-11-12&as=15169&priority=high&unacknowledged=true&limit=10
+func (s *ApiServer) handleAlerts(w http.ResponseWriter, r *http.Request) {
+
+	if pool == nil {
+		writeApiError(w, http.StatusServiceUnavailable, fmt.Errorf("alerts are not persisted, no database is configured"))
+		return
+	}
+
+	values := r.URL.Query()
+	q := &AlertQuery{
+		Prefix:  values.Get("prefix"),
+		Reason:  values.Get("reason"),
+		Profile: values.Get("profile"),
+		Limit:   100,
+	}
+
+	var err error
+	if v := values.Get("from"); len(v) > 0 {
+		q.From, err = parseCommandTime(v)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Errorf("invalid from time: %v", err))
+			return
+		}
+	}
+
+	if v := values.Get("to"); len(v) > 0 {
+		q.To, err = parseCommandEndTime(v)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Errorf("invalid to time: %v", err))
+			return
+		}
+	}
+
+	if v := values.Get("as"); len(v) > 0 {
+		q.As, err = parseApiAs(v)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if v := values.Get("priority"); len(v) > 0 {
+		q.Priority, err = parseAlertPriority(v)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Errorf("invalid priority: %v", err))
+			return
+		}
+	}
+
+	if v := values.Get("unacknowledged"); len(v) > 0 {
+		q.Unacknowledged, err = strconv.ParseBool(v)
+		if err != nil {
+			writeApiError(w, http.StatusBadRequest, fmt.Errorf("invalid unacknowledged: %s", v))
+			return
+		}
+	}
+
+	if v := values.Get("limit"); len(v) > 0 {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 0 {
+			writeApiError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", v))
+			return
+		}
+	}
+
+	alerts, err := queryAlerts(q)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeApiResponse(w, alerts)
+}
+
+// handleHistory returns the history of a path used by a peer AS e.g.
+// /api/history?peer_as=3356&path=3356+174+15169
+func (s *ApiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+
+	peerAs, err := parseApiAs(r.URL.Query().Get("peer_as"))
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	path := strings.Join(strings.Fields(r.URL.Query().Get("path")), " ")
+	if len(path) == 0 {
+		writeApiError(w, http.StatusBadRequest, fmt.Errorf("path is required"))
+		return
+	}
+
+	h := &apiHistory{PeerAs: peerAs, Path: path, Count: history.GetRouteCount(peerAs, path)}
+
+	e, ok := history.GetEntry(peerAs, path)
+	if ok == true {
+		h.Seen = true
+		h.FirstSeen = apiTime(e.FirstSeen)
+		h.LastSeen = apiTime(e.LastSeen)
+		h.Days = encodeHistoryDays(e.Days)
+	}
+
+	writeApiResponse(w, h)
+}
+
+// handleRoutes returns the origins, paths and routes seen for a prefix e.g.
+// /api/routes?prefix=192.104.160.0/23, or the prefixes held if none is given
+func (s *ApiServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+
+	value := r.URL.Query().Get("prefix")
+	if len(value) == 0 {
+		writeApiResponse(w, routeState.Prefixes())
+		return
+	}
+
+	prefix, err := parsePrefix(value)
+	if err != nil {
+		writeApiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	p := &apiPrefix{
+		Prefix:  prefix.String(),
+		Origins: make([]*apiRouteCount, 0),
+		Paths:   make([]*apiRouteCount, 0),
+		Routes:  make([]apiRoute, 0),
+	}
+
+	origins := make(map[uint32]*apiRouteCount)
+	paths := make(map[string]*apiRouteCount)
+
+	for _, route := range routeState.Routes(p.Prefix) {
+		p.Routes = append(p.Routes, apiRoute{
+			Collector: route.Collector,
+			PeerIP:    route.PeerIP.String(),
+			PeerAs:    route.PeerAs,
+			State:     route.State(),
+			Path:      route.Path,
+			Origin:    route.Origin,
+			Announced: apiTime(route.Announced),
+			Withdrawn: apiTime(route.Withdrawn),
+		})
+
+		if len(route.Path) == 0 {
+			continue
+		}
+
+		if origins[route.Origin] == nil {
+			origins[route.Origin] = &apiRouteCount{Origin: route.Origin, Name: asNames.Name(route.Origin)}
+			p.Origins = append(p.Origins, origins[route.Origin])
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = &apiRouteCount{Path: route.Path}
+			p.Paths = append(p.Paths, paths[route.Path])
+		}
+
+		for _, c := range []*apiRouteCount{origins[route.Origin], paths[route.Path]} {
+			c.Peers++
+			if route.Active == true {
+				c.Active++
+			}
+		}
+	}
+
+	sortApiRouteCounts(p.Origins)
+	sortApiRouteCounts(p.Paths)
+
+	writeApiResponse(w, p)
+}
+
+// handleConfig returns the monitored AS's, prefixes and country codes and the detection rules
+func (s *ApiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+
+	c := config
+	ac := &apiConfig{
+		TargetAs:            sortedAsList(c.TargetAs),
+		Prefixes:            make([]string, 0, len(c.Prefixes)),
+		MonitorCountryCodes: make([]string, 0, len(c.MonitorCountryCodes)),
+		NeighbourPeers:      sortedAsList(c.NeighbourPeers),
+		DataSets:            c.DataSets,
+		HistoryWindow:       c.HistoryWindow,
+		HistoryStore:        c.HistoryStore,
+		Rules:               make([]apiRule, 0),
+		Profiles:            make([]apiProfile, 0, len(c.Profiles)),
+	}
+
+	for _, prefix := range c.Prefixes {
+		ac.Prefixes = append(ac.Prefixes, prefix.String())
+	}
+	for cc := range c.MonitorCountryCodes {
+		ac.MonitorCountryCodes = append(ac.MonitorCountryCodes, cc)
+	}
+	sort.Strings(ac.MonitorCountryCodes)
+
+	if s.detector != nil {
+		for _, rule := range s.detector.Rules() {
+			ar := apiRule{Name: rule.Name, Enabled: rule.Enabled, Thresholds: rule.Thresholds,
+				As: sortedAsList(rule.As), Prefixes: make([]string, 0, len(rule.Prefixes))}
+			if rule.Priority != 0 {
+				ar.Priority = strings.ToLower(rule.Priority.String())
+			}
+			for _, prefix := range rule.Prefixes {
+				ar.Prefixes = append(ar.Prefixes, prefix.String())
+			}
+			ac.Rules = append(ac.Rules, ar)
+		}
+	}
+
+	for _, pc := range c.Profiles {
+		// As configured, but never null
+		ac.Profiles = append(ac.Profiles, apiProfile{
+			Name:                pc.Name,
+			TargetAs:            append([]uint32{}, pc.TargetAs...),
+			Prefixes:            append([]string{}, pc.Prefixes...),
+			NeighbourPeers:      append([]uint32{}, pc.NeighbourPeers...),
+			MonitorCountryCodes: append([]string{}, pc.MonitorCountryCodes...),
+			Rules:               append([]string{}, pc.Rules...),
+		})
+	}
+
+	writeApiResponse(w, ac)
+}
+
+// handleStatus returns the last file processed for each collector, the number of
+// updates queued for detection and the state of the other data sources
+func (s *ApiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+
+	status := &apiStatus{Version: APP_VERSION, Collectors: make([]CollectorStatus, 0)}
+
+	if s.monitor != nil {
+		status.Collectors = s.monitor.Collectors()
+	}
+	if s.detector != nil {
+		status.Queued = s.detector.Queued()
+	}
+
+	if rtrClient != nil {
+		serial, age, count, ok := rtrClient.Status()
+		status.Rpki = &apiRpkiStatus{Source: rtrClient.Address, Synchronised: ok, Roas: count}
+		if ok == true {
+			status.Rpki.Serial = serial
+			status.Rpki.Age = int64(age.Seconds())
+		}
+	} else if roaTable != nil && roaTable.Len() > 0 {
+		status.Rpki = &apiRpkiStatus{Source: config.RpkiVrpFile, Synchronised: true, Roas: roaTable.Len()}
+	}
+
+	if risLive != nil {
+		connected, messages, last := risLive.Status()
+		status.RisLive = &apiRisLiveStatus{Url: risLive.Url, Connected: connected, Messages: messages, LastMessage: apiTime(last)}
+	}
+
+	if bmpListener != nil {
+		for _, r := range bmpListener.Routers() {
+			up, total := r.PeersUp()
+			state := "connected"
+			if r.Connected == false {
+				state = "disconnected"
+			}
+
+			status.Bmp = append(status.Bmp, &apiSessionStatus{Name: r.Name, Address: r.Address, State: state,
+				Changed: r.Changed.UTC(), Messages: r.Messages, PeersUp: &up, Peers: &total})
+		}
+	}
+
+	if bgpSpeaker != nil {
+		for _, session := range bgpSpeaker.Sessions() {
+			state, changed, updates, peerAs := session.Status()
+			status.Bgp = append(status.Bgp, &apiSessionStatus{Name: session.Neighbour.Name, Address: session.Neighbour.Address,
+				PeerAs: peerAs, State: state.String(), Changed: changed.UTC(), Messages: updates})
+		}
+	}
+
+	writeApiResponse(w, status)
+}
+
+// apiGet only allows GET (and HEAD) requests to the handler
+func apiGet(handler http.HandlerFunc) http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeApiError(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// writeApiResponse writes the value as the JSON response
+func writeApiResponse(w http.ResponseWriter, v interface{}) {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		writeApiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// writeApiError writes the error as a JSON response e.g. {"error": "path is required"}
+func writeApiError(w http.ResponseWriter, status int, err error) {
+
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// parseApiAs parses an AS number, with or without the "AS" prefix
+func parseApiAs(value string) (uint32, error) {
+
+	as, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid AS: %s", value)
+	}
+
+	return uint32(as), nil
+}
+
+// apiTime returns the time in UTC, or nil if it is not set so that it is omitted
+func apiTime(t time.Time) *time.Time {
+
+	if t.IsZero() == true {
+		return nil
+	}
+
+	t = t.UTC()
+	return &t
+}
+
+// sortApiRouteCounts orders by the most peers first
+func sortApiRouteCounts(counts []*apiRouteCount) {
+
+	sort.SliceStable(counts, func(i, j int) bool {
+		if counts[i].Peers != counts[j].Peers {
+			return counts[i].Peers > counts[j].Peers
+		}
+		if counts[i].Origin != counts[j].Origin {
+			return counts[i].Origin < counts[j].Origin
+		}
+		return counts[i].Path < counts[j].Path
+	})
+}
+
+// sortedAsList returns the AS's in order
+func sortedAsList(set map[uint32]struct{}) []uint32 {
+
+	list := make([]uint32, 0, len(set))
+	for as := range set {
+		list = append(list, as)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+
+	return list
+}
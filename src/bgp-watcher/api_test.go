@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getApi requests the path from the API, checking the status and decoding the JSON response
+func getApi(t *testing.T, server *ApiServer, method string, path string, status int, v interface{}) {
+
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+	if w.Code != status {
+		t.Fatalf("%s %s: expected status %d, status %d: %s", method, path, status, w.Code, w.Body.String())
+	}
+
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("%s %s: invalid JSON response: %v", method, path, err)
+	}
+}
+
+func TestApi(t *testing.T) {
+
+	newTestEnvironment(t, testCountries, "CN")
+	history.SetCount(3356, "3356 15169", 20, testTime(0))
+
+	routeState.Announce(TEST_COLLECTOR, net.ParseIP(testPeerIP(0)), 3356, TEST_PREFIX_V4, "3356 15169", 15169, testTime(0))
+	routeState.Announce(TEST_COLLECTOR, net.ParseIP(testPeerIP(1)), 174, TEST_PREFIX_V4, "174 15169", 15169, testTime(0))
+	routeState.Announce(TEST_COLLECTOR, net.ParseIP(testPeerIP(2)), 3356, TEST_PREFIX_V4, "3356 64666", 64666, testTime(1))
+	routeState.Withdraw(TEST_COLLECTOR, net.ParseIP(testPeerIP(2)), 3356, TEST_PREFIX_V4, testTime(2))
+
+	detector := NewDetector(config)
+	server := NewApiServer("", detector, NewMonitor(detector, 1))
+
+	var h apiHistory
+	getApi(t, server, http.MethodGet, "/api/history?peer_as=AS3356&path=3356+15169", http.StatusOK, &h)
+	if h.Count != 20 || h.Seen == false || h.FirstSeen == nil || h.FirstSeen.Equal(testTime(0)) == false {
+		t.Errorf("unexpected history: %+v", h)
+	}
+
+	getApi(t, server, http.MethodGet, "/api/history?peer_as=3356&path=3356+174+15169", http.StatusOK, &h)
+	if h.Count != 0 || h.Seen == true {
+		t.Errorf("expected an unseen path: %+v", h)
+	}
+
+	var p apiPrefix
+	getApi(t, server, http.MethodGet, "/api/routes?prefix=192.104.160.0/23", http.StatusOK, &p)
+	if len(p.Routes) != 3 || len(p.Origins) != 2 || len(p.Paths) != 3 {
+		t.Fatalf("unexpected routes: %+v", p)
+	}
+	if p.Origins[0].Origin != 15169 || p.Origins[0].Peers != 2 || p.Origins[0].Active != 2 ||
+		p.Origins[1].Origin != 64666 || p.Origins[1].Active != 0 {
+		t.Errorf("unexpected origins: %+v %+v", p.Origins[0], p.Origins[1])
+	}
+
+	var prefixes []string
+	getApi(t, server, http.MethodGet, "/api/routes", http.StatusOK, &prefixes)
+	if len(prefixes) != 1 || prefixes[0] != TEST_PREFIX_V4 {
+		t.Errorf("unexpected prefixes: %v", prefixes)
+	}
+
+	var c apiConfig
+	getApi(t, server, http.MethodGet, "/api/config", http.StatusOK, &c)
+	if len(c.TargetAs) != 1 || c.TargetAs[0] != TEST_TARGET_AS || len(c.Prefixes) != 2 || len(c.MonitorCountryCodes) != 1 ||
+		len(c.Rules) != len(defaultRules(config)) {
+		t.Errorf("unexpected config: %+v", c)
+	}
+
+	var s apiStatus
+	getApi(t, server, http.MethodGet, "/api/status", http.StatusOK, &s)
+	if len(s.Collectors) != 1 || s.Collectors[0].Name != TEST_COLLECTOR || s.Queued != 0 {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	var e map[string]string
+	getApi(t, server, http.MethodGet, "/api/history?peer_as=3356", http.StatusBadRequest, &e)
+	getApi(t, server, http.MethodGet, "/api/alerts", http.StatusServiceUnavailable, &e)
+	getApi(t, server, http.MethodPost, "/api/config", http.StatusMethodNotAllowed, &e)
+	if len(e["error"]) == 0 {
+		t.Errorf("expected an error message")
+	}
+}
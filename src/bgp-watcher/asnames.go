@@ -6,8 +6,6 @@ import (
 	"net/http"
 	"regexp"
 	"strings"
-
-	util "github.com/woanware/goutil"
 )
 
 // ##### Structs ##############################################################
@@ -48,6 +46,16 @@ func (a *AsNames) Country(as uint32) string {
 	return ""
 }
 
+// Name returns the name associated with an AS
+func (a *AsNames) Name(as uint32) string {
+
+	if _, ok := a.names[as]; ok {
+		return a.names[as].Name
+	}
+
+	return ""
+}
+
 // Update retrieves the AS data from www.cidr-report.org/as2.0/autnums.html
 func (a *AsNames) Update() error {
 
@@ -99,7 +107,7 @@ func (a *AsNames) Update() error {
 			}
 		}
 
-		as, err = util.ConvertStringToUint32(match[1])
+		as, err = parseAs(match[1])
 		if err != nil {
 			fmt.Printf("Error converting AS data AS number (%v): %v\n", match[1], err)
 			continue
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Structs ##############################################################
+
+// AsPathSegment is a single AS_PATH segment, with 2-byte AS's widened to 4-bytes
+type AsPathSegment struct {
+	Type uint8
+	AS   []uint32
+}
+
+// AsPath is a normalised AS_PATH, built from all of the AS_PATH segments
+// (2 or 4 byte) of an update, merged with the AS4_PATH attribute where an
+// older (2-byte) session was used
+type AsPath struct {
+	Segments []AsPathSegment
+	// Path is the flattened path, excluding any confederation segments. The
+	// members of an AS_SET are not ordered, so checks of the AS's next to each
+	// other on the path use Sequences instead
+	Path []uint32
+	// Origin is the last AS of the path. If the last segment is an AS_SET
+	// then OriginSet is true and the origin is one of the AS_SET members
+	Origin    uint32
+	OriginSet bool
+}
+
+// AsAdjacency is a link between two AS's on a path, the neighbour having
+// received the route directly from the AS e.g. an upstream of the origin
+type AsAdjacency struct {
+	Neighbour uint32
+	As        uint32
+}
+
+// ##### Methods ##############################################################
+
+// NewAsPath builds a normalised AS path from the path attributes of an
+// update. Returns nil if the update does not have an AS_PATH attribute
+func NewAsPath(attrs []bgp.PathAttributeInterface) *AsPath {
+
+	var asPath *bgp.PathAttributeAsPath
+	var as4Path *bgp.PathAttributeAs4Path
+
+	for _, pa := range attrs {
+		switch pa.(type) {
+		case *bgp.PathAttributeAsPath:
+			asPath = pa.(*bgp.PathAttributeAsPath)
+		case *bgp.PathAttributeAs4Path:
+			as4Path = pa.(*bgp.PathAttributeAs4Path)
+		}
+	}
+
+	if asPath == nil {
+		return nil
+	}
+
+	segments := make([]AsPathSegment, 0, len(asPath.Value))
+	as2 := false
+
+	for _, param := range asPath.Value {
+		switch param.(type) {
+		case *bgp.As4PathParam:
+			segments = append(segments, AsPathSegment{
+				Type: param.(*bgp.As4PathParam).Type,
+				AS:   param.(*bgp.As4PathParam).AS,
+			})
+
+		case *bgp.AsPathParam:
+			as2 = true
+			as := make([]uint32, len(param.(*bgp.AsPathParam).AS))
+			for i, a := range param.(*bgp.AsPathParam).AS {
+				as[i] = uint32(a)
+			}
+			segments = append(segments, AsPathSegment{
+				Type: param.(*bgp.AsPathParam).Type,
+				AS:   as,
+			})
+		}
+	}
+
+	// Merge in the AS4_PATH (RFC 6793 section 4.2.3) for 2-byte sessions
+	if as2 == true && as4Path != nil {
+		as4Segments := make([]AsPathSegment, 0, len(as4Path.Value))
+		for _, param := range as4Path.Value {
+			as4Segments = append(as4Segments, AsPathSegment{Type: param.Type, AS: param.AS})
+		}
+
+		segments = mergeAs4Path(segments, as4Segments)
+	}
+
+	return newAsPathFromSegments(segments)
+}
+
+// newAsPathFromSegments flattens the segments and determines the origin
+func newAsPathFromSegments(segments []AsPathSegment) *AsPath {
+
+	p := &AsPath{
+		Segments: segments,
+		Path:     make([]uint32, 0),
+	}
+
+	for _, s := range segments {
+		switch s.Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ, bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			if len(s.AS) == 0 {
+				continue
+			}
+
+			p.Path = append(p.Path, s.AS...)
+			p.Origin = s.AS[len(s.AS)-1]
+			p.OriginSet = s.Type == bgp.BGP_ASPATH_ATTR_TYPE_SET
+		}
+	}
+
+	return p
+}
+
+// Origins returns the possible origins of the path e.g. all of the
+// members of the AS_SET if the path ends in an AS_SET
+func (p *AsPath) Origins() []uint32 {
+
+	if len(p.Path) == 0 {
+		return []uint32{}
+	}
+
+	if p.OriginSet == false {
+		return []uint32{p.Origin}
+	}
+
+	return p.Segments[p.lastSegment()].AS
+}
+
+// Prepend returns a copy of the path with the AS added to the start, as it would
+// be if the path had been sent over eBGP by the AS e.g. for an iBGP neighbour
+func (p *AsPath) Prepend(as uint32) *AsPath {
+
+	segments := make([]AsPathSegment, 0, len(p.Segments)+1)
+
+	if len(p.Segments) > 0 && p.Segments[0].Type == bgp.BGP_ASPATH_ATTR_TYPE_SEQ {
+		segments = append(segments, AsPathSegment{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: append([]uint32{as}, p.Segments[0].AS...)})
+		segments = append(segments, p.Segments[1:]...)
+	} else {
+		segments = append(segments, AsPathSegment{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{as}})
+		segments = append(segments, p.Segments...)
+	}
+
+	return newAsPathFromSegments(segments)
+}
+
+// Sequences returns the runs of AS_SEQUENCE segments, in which each AS received
+// the route from the next (including any prepending). The members of an AS_SET
+// are not ordered, so they end a run and are not included in any
+func (p *AsPath) Sequences() [][]uint32 {
+
+	sequences := make([][]uint32, 0)
+	sequence := make([]uint32, 0)
+
+	for _, s := range p.Segments {
+		switch s.Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ:
+			sequence = append(sequence, s.AS...)
+
+		case bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			if len(sequence) > 0 {
+				sequences = append(sequences, sequence)
+				sequence = make([]uint32, 0)
+			}
+		}
+	}
+
+	if len(sequence) > 0 {
+		sequences = append(sequences, sequence)
+	}
+
+	return sequences
+}
+
+// First returns the first AS of the path, and whether it is known i.e. the path
+// starts with an AS_SEQUENCE rather than an AS_SET
+func (p *AsPath) First() (uint32, bool) {
+
+	for _, s := range p.Segments {
+		switch s.Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ, bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			if len(s.AS) > 0 {
+				return s.AS[0], s.Type == bgp.BGP_ASPATH_ATTR_TYPE_SEQ
+			}
+		}
+	}
+
+	return 0, false
+}
+
+// Adjacencies returns the links between the AS's of the AS_SEQUENCE segments,
+// ignoring any prepending. The members of an AS_SET are not ordered, so links
+// are not inferred into or out of one
+func (p *AsPath) Adjacencies() []AsAdjacency {
+
+	adjacencies := make([]AsAdjacency, 0)
+
+	for _, sequence := range p.Sequences() {
+		for i := 1; i < len(sequence); i++ {
+			if sequence[i] != sequence[i-1] {
+				adjacencies = append(adjacencies, AsAdjacency{Neighbour: sequence[i-1], As: sequence[i]})
+			}
+		}
+	}
+
+	return adjacencies
+}
+
+// String returns the adjacency in the path format e.g. "174 15169"
+func (a AsAdjacency) String() string {
+
+	return fmt.Sprintf("%d %d", a.Neighbour, a.As)
+}
+
+// parseAsAdjacency parses an adjacency in the format returned by String e.g. "174 15169"
+func parseAsAdjacency(data string) (AsAdjacency, error) {
+
+	fields := strings.Fields(data)
+	if len(fields) != 2 {
+		return AsAdjacency{}, fmt.Errorf("invalid adjacency: %s", data)
+	}
+
+	neighbour, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return AsAdjacency{}, fmt.Errorf("invalid adjacency: %s", data)
+	}
+
+	as, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return AsAdjacency{}, fmt.Errorf("invalid adjacency: %s", data)
+	}
+
+	return AsAdjacency{Neighbour: uint32(neighbour), As: uint32(as)}, nil
+}
+
+// String returns the path in the conventional format e.g. "1 2 {3,4}", with
+// AS_SEQUENCE only paths being identical to the historic path format
+func (p *AsPath) String() string {
+
+	parts := make([]string, 0, len(p.Segments))
+
+	for _, s := range p.Segments {
+		if len(s.AS) == 0 {
+			continue
+		}
+
+		switch s.Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ:
+			parts = append(parts, convertAsPath(s.AS))
+		case bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			parts = append(parts, "{"+joinAs(s.AS, ",")+"}")
+		case bgp.BGP_ASPATH_ATTR_TYPE_CONFED_SEQ:
+			parts = append(parts, "("+joinAs(s.AS, " ")+")")
+		case bgp.BGP_ASPATH_ATTR_TYPE_CONFED_SET:
+			parts = append(parts, "["+joinAs(s.AS, ",")+"]")
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// lastSegment returns the index of the last non confederation segment
+func (p *AsPath) lastSegment() int {
+
+	for i := len(p.Segments) - 1; i >= 0; i-- {
+		switch p.Segments[i].Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ, bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			if len(p.Segments[i].AS) > 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// mergeAs4Path reconstructs the 4-byte path from the AS_PATH and AS4_PATH.
+// If the AS4_PATH is longer than the AS_PATH then it is ignored, otherwise
+// the leading AS's of the AS_PATH are prepended to the AS4_PATH
+func mergeAs4Path(asPath []AsPathSegment, as4Path []AsPathSegment) []AsPathSegment {
+
+	asCount := countAsPath(asPath)
+	as4Count := countAsPath(as4Path)
+
+	if as4Count > asCount {
+		return asPath
+	}
+
+	remaining := asCount - as4Count
+	merged := make([]AsPathSegment, 0, len(asPath)+len(as4Path))
+
+	for _, s := range asPath {
+		if remaining == 0 {
+			break
+		}
+
+		switch s.Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ:
+			if len(s.AS) > remaining {
+				merged = append(merged, AsPathSegment{Type: s.Type, AS: s.AS[:remaining]})
+				remaining = 0
+				continue
+			}
+			merged = append(merged, s)
+			remaining -= len(s.AS)
+
+		case bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			merged = append(merged, s)
+			remaining--
+
+		default:
+			merged = append(merged, s)
+		}
+	}
+
+	return append(merged, as4Path...)
+}
+
+// countAsPath returns the path length as defined by RFC 4271 e.g. an AS_SET
+// counts as one and confederation segments are not counted
+func countAsPath(segments []AsPathSegment) int {
+
+	count := 0
+	for _, s := range segments {
+		switch s.Type {
+		case bgp.BGP_ASPATH_ATTR_TYPE_SEQ:
+			count += len(s.AS)
+		case bgp.BGP_ASPATH_ATTR_TYPE_SET:
+			count++
+		}
+	}
+
+	return count
+}
+
+// joinAs returns the AS's as a string using the separator
+func joinAs(as []uint32, separator string) string {
+
+	parts := make([]string, len(as))
+	for i, a := range as {
+		parts[i] = strconv.FormatUint(uint64(a), 10)
+	}
+
+	return strings.Join(parts, separator)
+}
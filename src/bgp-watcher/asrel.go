@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ##### Structs ##############################################################
+
+// AsRelationship is the business relationship of one AS to another
+type AsRelationship int
+
+// The relationships, as seen from the first AS e.g. RelCustomer means that
+// the first AS is a customer of the second
+const (
+	RelUnknown  AsRelationship = 0
+	RelCustomer AsRelationship = 1
+	RelPeer     AsRelationship = 2
+	RelProvider AsRelationship = 3
+)
+
+// AsRelationships holds the relationships between AS's, as inferred by CAIDA
+// (https://www.caida.org/catalog/datasets/as-relationships/)
+type AsRelationships struct {
+	mux   sync.RWMutex
+	rels  map[uint64]AsRelationship
+	count int
+}
+
+// ##### Methods ##############################################################
+
+// String returns the relationship name, as used in alerts
+func (r AsRelationship) String() string {
+
+	switch r {
+	case RelCustomer:
+		return "customer"
+	case RelPeer:
+		return "peer"
+	case RelProvider:
+		return "provider"
+	default:
+		return "unknown"
+	}
+}
+
+// NewAsRelationships returns a new, empty, AsRelationships
+func NewAsRelationships() *AsRelationships {
+
+	return &AsRelationships{rels: make(map[uint64]AsRelationship)}
+}
+
+// Len returns the number of AS links held
+func (ar *AsRelationships) Len() int {
+
+	ar.mux.RLock()
+	defer ar.mux.RUnlock()
+
+	return ar.count
+}
+
+// Load reads a CAIDA AS relationship file, which may be bzip2 or gzip compressed
+// (based on the file extension), and replaces the relationships
+func (ar *AsRelationships) Load(filePath string) error {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".bz2":
+		r = bzip2.NewReader(f)
+	case ".gz":
+		gzipReader, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("couldn't create gzip reader: %v", err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+
+	return ar.Read(r)
+}
+
+// Read parses the relationships and replaces those held. Each line is
+// "<provider-as>|<customer-as>|-1" or "<peer-as>|<peer-as>|0", optionally
+// followed by the inference source (serial-2), comments start with '#'
+func (ar *AsRelationships) Read(r io.Reader) error {
+
+	rels := make(map[uint64]AsRelationship)
+	count := 0
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") == true {
+			continue
+		}
+
+		fields := strings.Split(text, "|")
+		if len(fields) < 3 {
+			return fmt.Errorf("invalid AS relationship (line %d): %s", line, text)
+		}
+
+		as1, err1 := parseAs(fields[0])
+		as2, err2 := parseAs(fields[1])
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid AS relationship AS (line %d): %s", line, text)
+		}
+
+		switch fields[2] {
+		case "-1":
+			rels[asLinkKey(as1, as2)] = RelProvider
+			rels[asLinkKey(as2, as1)] = RelCustomer
+		case "0":
+			rels[asLinkKey(as1, as2)] = RelPeer
+			rels[asLinkKey(as2, as1)] = RelPeer
+		default:
+			return fmt.Errorf("invalid AS relationship type (line %d): %s", line, text)
+		}
+		count++
+	}
+
+	if scanner.Err() != nil {
+		return scanner.Err()
+	}
+
+	ar.mux.Lock()
+	defer ar.mux.Unlock()
+
+	ar.rels = rels
+	ar.count = count
+
+	return nil
+}
+
+// FindLeak checks that the path (as received, the origin last) is valley-free.
+// Walking from the origin, a route may go up to providers, across at most one
+// peer link and then only down to customers. Returns the index of the first AS
+// that passed on a route learned from a provider or peer to another provider or
+// peer, and what the AS's it learned the route from and passed it to are to it
+// (provider or peer), or -1 if there is no leak. Links of unknown relationship
+// restart the check, as nothing can be inferred across them
+func (ar *AsRelationships) FindLeak(path []uint32) (int, AsRelationship, AsRelationship) {
+
+	ar.mux.RLock()
+	defer ar.mux.RUnlock()
+
+	if len(ar.rels) == 0 {
+		return -1, RelUnknown, RelUnknown
+	}
+
+	// Remove any prepending, so that each link is between two different AS's
+	hops := make([]int, 0, len(path))
+	for i := len(path) - 1; i >= 0; i-- {
+		if len(hops) == 0 || path[hops[len(hops)-1]] != path[i] {
+			hops = append(hops, i)
+		}
+	}
+
+	// learned is what the AS that the route was learned from is to the AS passing it on
+	learned := RelUnknown
+	for i := 1; i < len(hops); i++ {
+		sent := ar.rels[asLinkKey(path[hops[i-1]], path[hops[i]])]
+
+		if (learned == RelProvider || learned == RelPeer) && (sent == RelCustomer || sent == RelPeer) {
+			return hops[i-1], learned, invertRelationship(sent)
+		}
+
+		learned = sent
+	}
+
+	return -1, RelUnknown, RelUnknown
+}
+
+// nextPathAs returns the next AS, from the index in the direction of the step,
+// that differs from the AS at the index (skipping any prepending)
+func nextPathAs(path []uint32, index int, step int) uint32 {
+
+	for i := index + step; i >= 0 && i < len(path); i += step {
+		if path[i] != path[index] {
+			return path[i]
+		}
+	}
+
+	return 0
+}
+
+// invertRelationship returns the relationship of the second AS to the first
+func invertRelationship(rel AsRelationship) AsRelationship {
+
+	switch rel {
+	case RelCustomer:
+		return RelProvider
+	case RelProvider:
+		return RelCustomer
+	default:
+		return rel
+	}
+}
+
+// asLinkKey returns the key for the relationship of the first AS to the second
+func asLinkKey(as1 uint32, as2 uint32) uint64 {
+
+	return uint64(as1)<<32 | uint64(as2)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// TestAsRelationshipsLoad checks that a compressed serial-2 file is loaded, and
+// that links of unknown relationship restart the valley-free check
+func TestAsRelationshipsLoad(t *testing.T) {
+
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+	gzipWriter.Write([]byte("# source:topology|BGP\n174|15169|-1|bgp\n174|3356|0|bgp\n4200000000|174|-1|mlp\n"))
+	gzipWriter.Close()
+
+	filePath := filepath.Join(t.TempDir(), "20181101.as-rel2.txt.gz")
+	err := ioutil.WriteFile(filePath, buffer.Bytes(), 0660)
+	if err != nil {
+		t.Fatalf("error writing AS relationship file: %v", err)
+	}
+
+	ar := NewAsRelationships()
+	err = ar.Load(filePath)
+	if err != nil {
+		t.Fatalf("error loading AS relationships: %v", err)
+	}
+	if ar.Len() != 3 {
+		t.Errorf("expected 3 relationships, %d", ar.Len())
+	}
+
+	// 174 learns from its customer and passes the route to a peer, and then a provider
+	if i, _, _ := ar.FindLeak([]uint32{3356, 174, 15169}); i != -1 {
+		t.Errorf("expected a valley-free path, leak at %d", i)
+	}
+	if i, learned, sent := ar.FindLeak([]uint32{4200000000, 3356, 174, 15169}); i != -1 {
+		t.Errorf("expected no leak across an unknown link, leak at %d (%s %s)", i, learned, sent)
+	}
+	if i, learned, sent := ar.FindLeak([]uint32{4200000000, 174, 3356}); i != 1 || learned != RelPeer || sent != RelProvider {
+		t.Errorf("expected a leak by 174, leak at %d (%s %s)", i, learned, sent)
+	}
+
+	err = ar.Read(bytes.NewReader([]byte("174|15169|1\n")))
+	if err == nil {
+		t.Errorf("expected an invalid relationship type to fail")
+	}
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Constants ############################################################
+
+// BMP (RFC 7854) message types
+const (
+	BMP_ROUTE_MONITORING uint8 = 0
+	BMP_STATISTICS       uint8 = 1
+	BMP_PEER_DOWN        uint8 = 2
+	BMP_PEER_UP          uint8 = 3
+	BMP_INITIATION       uint8 = 4
+	BMP_TERMINATION      uint8 = 5
+	BMP_ROUTE_MIRRORING  uint8 = 6
+)
+
+// BMP per-peer header flags (the AS_PATH size is detected by the BGP decoder)
+const (
+	BMP_PEER_FLAG_IPV6 uint8 = 0x80
+	BMP_PEER_FLAG_POST uint8 = 0x40
+)
+
+// BMP initiation information types
+const (
+	BMP_INFO_STRING    uint16 = 0
+	BMP_INFO_SYS_DESCR uint16 = 1
+	BMP_INFO_SYS_NAME  uint16 = 2
+)
+
+const BMP_VERSION uint8 = 3
+const BMP_HEADER_LEN int = 6
+const BMP_PEER_HEADER_LEN int = 42
+const BMP_MAX_MESSAGE_LEN uint32 = 1024 * 1024
+
+// ##### Structs ##############################################################
+
+// BmpPeerHeader is the per-peer header, identifying the router peer that a message relates to
+type BmpPeerHeader struct {
+	PeerType  uint8
+	Flags     uint8
+	PeerRd    uint64
+	Address   net.IP
+	As        uint32
+	BgpId     net.IP
+	Timestamp time.Time
+}
+
+// BmpMessage is a single decoded BMP message. Only the fields relevant to the message type are set
+type BmpMessage struct {
+	Type         uint8
+	Peer         *BmpPeerHeader
+	Update       *bgp.BGPUpdate
+	Stats        map[uint16]uint64
+	DownReason   uint8
+	LocalAddress net.IP
+	LocalPort    uint16
+	RemotePort   uint16
+	Information  map[uint16]string
+}
+
+// BmpPeer is the state of a single peer of a monitored router
+type BmpPeer struct {
+	Address    net.IP
+	As         uint32
+	BgpId      net.IP
+	Up         bool
+	Changed    time.Time
+	DownReason uint8
+	Updates    uint64
+	Stats      map[uint16]uint64
+	PrePolicy  bool
+}
+
+// BmpRouter is a monitored router, the name is its sysName (or address) and is used as the collector name
+type BmpRouter struct {
+	Name      string
+	Address   string
+	Connected bool
+	Changed   time.Time
+	Messages  uint64
+	Peers     map[string]*BmpPeer
+}
+
+// BmpListener accepts BMP sessions from our routers, passing the route
+// monitoring updates to the detector in the same way as the MRT update files
+type BmpListener struct {
+	Address  string
+	detector *Detector
+	mux      sync.Mutex
+	routers  map[string]*BmpRouter
+}
+
+// ##### Methods ##############################################################
+
+// NewBmpListener returns a new BmpListener that will listen on the address (host:port)
+func NewBmpListener(address string, detector *Detector) *BmpListener {
+
+	return &BmpListener{
+		Address:  address,
+		detector: detector,
+		routers:  make(map[string]*BmpRouter),
+	}
+}
+
+// Start listens for routers in the background
+func (l *BmpListener) Start() error {
+
+	ln, err := net.Listen("tcp", l.Address)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				fmt.Printf("Error accepting BMP connection: %v\n", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			go func() {
+				err := l.Run(conn)
+				if err != nil && err != io.EOF {
+					fmt.Printf("BMP session error (%s): %v\n", conn.RemoteAddr(), err)
+				}
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// Run processes the BMP messages from a router until the connection is closed
+func (l *BmpListener) Run(conn net.Conn) error {
+
+	defer conn.Close()
+
+	address := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+
+	router := l.connect(address)
+	defer l.disconnect(router)
+
+	for {
+		msgType, data, err := readBmpFrame(conn)
+		if err != nil {
+			return err
+		}
+
+		// The message has been read in full, so one that cannot be decoded is
+		// skipped rather than ending the session with the router
+		msg, err := decodeBmpMessage(msgType, data)
+		if err != nil {
+			fmt.Printf("Error decoding BMP message (%s): %v\n", address, err)
+			continue
+		}
+
+		err = l.handleMessage(router, msg)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Routers returns a copy of the state of each of the routers, in name order
+func (l *BmpListener) Routers() []BmpRouter {
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	routers := make([]BmpRouter, 0, len(l.routers))
+	for _, r := range l.routers {
+		router := *r
+		router.Peers = make(map[string]*BmpPeer, len(r.Peers))
+		for k, p := range r.Peers {
+			peer := *p
+			router.Peers[k] = &peer
+		}
+		routers = append(routers, router)
+	}
+
+	sort.Slice(routers, func(i, j int) bool {
+		return routers[i].Name < routers[j].Name
+	})
+
+	return routers
+}
+
+// connect registers the router, or marks a known router as connected
+func (l *BmpListener) connect(address string) *BmpRouter {
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	router, ok := l.routers[address]
+	if ok == false {
+		router = &BmpRouter{Name: address, Address: address, Peers: make(map[string]*BmpPeer)}
+		l.routers[address] = router
+	}
+
+	router.Connected = true
+	router.Changed = time.Now().UTC()
+
+	return router
+}
+
+// disconnect marks the router, and therefore all of its peers, as down
+func (l *BmpListener) disconnect(router *BmpRouter) {
+
+	now := time.Now().UTC()
+
+	l.mux.Lock()
+	name := router.Name
+	router.Connected = false
+	router.Changed = now
+
+	peers := make([]*BmpPeer, 0)
+	for _, p := range router.Peers {
+		if p.Up == true {
+			p.Up = false
+			p.Changed = now
+			peers = append(peers, p)
+		}
+	}
+	l.mux.Unlock()
+
+	for _, p := range peers {
+		withdrawPeer(l.detector, name, p.Address, p.As, now)
+	}
+}
+
+// handleMessage applies a single message to the router state
+func (l *BmpListener) handleMessage(router *BmpRouter, msg *BmpMessage) error {
+
+	l.mux.Lock()
+	router.Messages++
+
+	switch msg.Type {
+	case BMP_INITIATION:
+		// Use the sysName so that the collector name is stable across addresses
+		if name := msg.Information[BMP_INFO_SYS_NAME]; len(name) > 0 {
+			router.Name = name
+		}
+		l.mux.Unlock()
+		return nil
+
+	case BMP_TERMINATION:
+		l.mux.Unlock()
+		return io.EOF
+
+	case BMP_ROUTE_MIRRORING:
+		l.mux.Unlock()
+		return nil
+	}
+
+	name := router.Name
+	peer := router.peer(msg.Peer)
+
+	switch msg.Type {
+	case BMP_PEER_UP:
+		peer.Up = true
+		peer.Changed = msg.Peer.Timestamp
+		l.mux.Unlock()
+
+	case BMP_PEER_DOWN:
+		wasUp := peer.Up
+		peer.Up = false
+		peer.Changed = msg.Peer.Timestamp
+		peer.DownReason = msg.DownReason
+		l.mux.Unlock()
+
+		if wasUp == true {
+			withdrawPeer(l.detector, name, msg.Peer.Address, msg.Peer.As, msg.Peer.Timestamp)
+		}
+
+	case BMP_STATISTICS:
+		for k, v := range msg.Stats {
+			peer.Stats[k] = v
+		}
+		l.mux.Unlock()
+
+	case BMP_ROUTE_MONITORING:
+		// Routers may send both the pre and post-policy routes of a peer, so only one
+		// copy is monitored. The pre-policy routes (as announced by the peer) are
+		// preferred, the post-policy routes are used if the router only sends those
+		if msg.Peer.Flags&BMP_PEER_FLAG_POST == 0 {
+			peer.PrePolicy = true
+		} else if peer.PrePolicy == true {
+			l.mux.Unlock()
+			return nil
+		}
+
+		// A route monitoring message marks the peer as up, e.g. when the Peer Up was
+		// sent before the session to the router was established
+		peer.Up = true
+		peer.Updates++
+		l.mux.Unlock()
+
+		nlri, withdrawn := extractPrefixes(msg.Update)
+		detectUpdate(l.detector, name, msg.Peer.Timestamp, msg.Peer.As, msg.Peer.Address,
+			NewAsPath(msg.Update.PathAttributes), nlri, withdrawn)
+
+	default:
+		l.mux.Unlock()
+	}
+
+	return nil
+}
+
+// peer returns the state of the peer in the header, adding it if required. The lock must be held
+func (r *BmpRouter) peer(hdr *BmpPeerHeader) *BmpPeer {
+
+	key := fmt.Sprintf("%d|%s", hdr.PeerRd, hdr.Address)
+
+	p, ok := r.Peers[key]
+	if ok == false {
+		p = &BmpPeer{Address: hdr.Address, Stats: make(map[uint16]uint64)}
+		r.Peers[key] = p
+	}
+
+	p.As = hdr.As
+	p.BgpId = hdr.BgpId
+
+	return p
+}
+
+// PeersUp returns the number of peers that are up, and the total number of peers
+func (r *BmpRouter) PeersUp() (int, int) {
+
+	up := 0
+	for _, p := range r.Peers {
+		if p.Up == true {
+			up++
+		}
+	}
+
+	return up, len(r.Peers)
+}
+
+// ReadBmpMessage reads and decodes a single BMP message
+func ReadBmpMessage(r io.Reader) (*BmpMessage, error) {
+
+	msgType, data, err := readBmpFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBmpMessage(msgType, data)
+}
+
+// readBmpFrame reads a single BMP message, returning its type and undecoded body
+func readBmpFrame(r io.Reader) (uint8, []byte, error) {
+
+	header := make([]byte, BMP_HEADER_LEN)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if header[0] != BMP_VERSION {
+		return 0, nil, fmt.Errorf("unsupported BMP version: %d", header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length < uint32(BMP_HEADER_LEN) || length > BMP_MAX_MESSAGE_LEN {
+		return 0, nil, fmt.Errorf("invalid BMP message length: %d", length)
+	}
+
+	data := make([]byte, length-uint32(BMP_HEADER_LEN))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[5], data, nil
+}
+
+// decodeBmpMessage decodes the body of a BMP message
+func decodeBmpMessage(msgType uint8, data []byte) (*BmpMessage, error) {
+
+	msg := &BmpMessage{Type: msgType}
+
+	switch msgType {
+	case BMP_INITIATION, BMP_TERMINATION:
+		msg.Information = decodeBmpInformation(data)
+		return msg, nil
+
+	case BMP_ROUTE_MONITORING, BMP_STATISTICS, BMP_PEER_DOWN, BMP_PEER_UP, BMP_ROUTE_MIRRORING:
+
+	default:
+		return nil, fmt.Errorf("unknown BMP message type: %d", msgType)
+	}
+
+	if len(data) < BMP_PEER_HEADER_LEN {
+		return nil, fmt.Errorf("BMP message too short for the per-peer header")
+	}
+
+	msg.Peer = decodeBmpPeerHeader(data[:BMP_PEER_HEADER_LEN])
+	data = data[BMP_PEER_HEADER_LEN:]
+
+	switch msgType {
+	case BMP_ROUTE_MONITORING:
+		bgpMsg, err := bgp.ParseBGPMessage(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding BMP route monitoring update: %v", err)
+		}
+
+		update, ok := bgpMsg.Body.(*bgp.BGPUpdate)
+		if ok == false {
+			return nil, fmt.Errorf("BMP route monitoring message is not a BGP update")
+		}
+		msg.Update = update
+
+	case BMP_STATISTICS:
+		if len(data) < 4 {
+			return nil, fmt.Errorf("BMP statistics message too short")
+		}
+
+		msg.Stats = make(map[uint16]uint64)
+		count := binary.BigEndian.Uint32(data[:4])
+		data = data[4:]
+
+		for i := uint32(0); i < count && len(data) >= 4; i++ {
+			statType := binary.BigEndian.Uint16(data[:2])
+			statLen := int(binary.BigEndian.Uint16(data[2:4]))
+			if len(data) < 4+statLen {
+				return nil, fmt.Errorf("BMP statistic exceeds message length")
+			}
+
+			// Counters are 4 bytes and gauges 8 bytes, anything else is ignored
+			switch statLen {
+			case 4:
+				msg.Stats[statType] = uint64(binary.BigEndian.Uint32(data[4:8]))
+			case 8:
+				msg.Stats[statType] = binary.BigEndian.Uint64(data[4:12])
+			}
+			data = data[4+statLen:]
+		}
+
+	case BMP_PEER_DOWN:
+		if len(data) < 1 {
+			return nil, fmt.Errorf("BMP peer down message too short")
+		}
+		msg.DownReason = data[0]
+
+	case BMP_PEER_UP:
+		if len(data) < 20 {
+			return nil, fmt.Errorf("BMP peer up message too short")
+		}
+
+		msg.LocalAddress = decodeBmpAddress(data[:16], msg.Peer.Flags&BMP_PEER_FLAG_IPV6 != 0)
+		msg.LocalPort = binary.BigEndian.Uint16(data[16:18])
+		msg.RemotePort = binary.BigEndian.Uint16(data[18:20])
+	}
+
+	return msg, nil
+}
+
+// decodeBmpPeerHeader decodes the 42 byte per-peer header
+func decodeBmpPeerHeader(data []byte) *BmpPeerHeader {
+
+	hdr := &BmpPeerHeader{
+		PeerType: data[0],
+		Flags:    data[1],
+		PeerRd:   binary.BigEndian.Uint64(data[2:10]),
+		Address:  decodeBmpAddress(data[10:26], data[1]&BMP_PEER_FLAG_IPV6 != 0),
+		As:       binary.BigEndian.Uint32(data[26:30]),
+		BgpId:    net.IP(append([]byte{}, data[30:34]...)),
+	}
+
+	seconds := binary.BigEndian.Uint32(data[34:38])
+	microseconds := binary.BigEndian.Uint32(data[38:42])
+
+	// Routers that do not timestamp messages send zero, so use the time received
+	if seconds == 0 {
+		hdr.Timestamp = time.Now().UTC()
+	} else {
+		hdr.Timestamp = time.Unix(int64(seconds), int64(microseconds)*1000).UTC()
+	}
+
+	return hdr
+}
+
+// decodeBmpAddress decodes a 16 byte address field, IPv4 addresses are in the last 4 bytes
+func decodeBmpAddress(data []byte, ipv6 bool) net.IP {
+
+	if ipv6 == true {
+		return net.IP(append([]byte{}, data...))
+	}
+
+	return net.IPv4(data[12], data[13], data[14], data[15]).To4()
+}
+
+// decodeBmpInformation decodes the information TLV's of an initiation or termination message
+func decodeBmpInformation(data []byte) map[uint16]string {
+
+	info := make(map[uint16]string)
+
+	for len(data) >= 4 {
+		infoType := binary.BigEndian.Uint16(data[:2])
+		infoLen := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+infoLen {
+			break
+		}
+
+		value := string(data[4 : 4+infoLen])
+		if existing, ok := info[infoType]; ok {
+			value = strings.Join([]string{existing, value}, "\n")
+		}
+		info[infoType] = value
+
+		data = data[4+infoLen:]
+	}
+
+	return info
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// TestBmpReplay replays a captured BMP stream from a local client, checking that
+// the pre-policy routes are detected once, that the post-policy copies and a
+// message that cannot be decoded are skipped, and that the peer going down
+// withdraws its routes
+func TestBmpReplay(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+
+	update, err := bgp.NewBGPUpdateMessage(nil, []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(bgp.BGP_ORIGIN_ATTR_TYPE_IGP),
+		bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, []uint32{3356, 64666})}),
+		bgp.NewPathAttributeNextHop("192.0.2.1"),
+	}, []*bgp.IPAddrPrefix{bgp.NewIPAddrPrefix(23, "192.104.160.0")}).Serialize()
+	if err != nil {
+		t.Fatalf("error serialising update: %v", err)
+	}
+
+	peerIP := net.ParseIP("192.0.2.1")
+	stream := new(bytes.Buffer)
+
+	writeBmpMessage(stream, BMP_INITIATION, nil, []byte{0, byte(BMP_INFO_SYS_NAME), 0, 7, 'r', 'o', 'u', 't', 'e', 'r', '1'})
+	writeBmpMessage(stream, BMP_PEER_UP, bmpPeerHeader(peerIP, 3356, 0), make([]byte, 20))
+	writeBmpMessage(stream, BMP_ROUTE_MONITORING, bmpPeerHeader(peerIP, 3356, 0), update)
+	writeBmpMessage(stream, BMP_ROUTE_MONITORING, bmpPeerHeader(peerIP, 3356, BMP_PEER_FLAG_POST), update)
+	writeBmpMessage(stream, BMP_ROUTE_MONITORING, bmpPeerHeader(peerIP, 3356, 0), update[:len(update)-4])
+	writeBmpMessage(stream, BMP_STATISTICS, bmpPeerHeader(peerIP, 3356, 0), []byte{0, 0, 0, 1, 0, 7, 0, 4, 0, 0, 0, 9})
+	writeBmpMessage(stream, BMP_PEER_DOWN, bmpPeerHeader(peerIP, 3356, 0), []byte{2, 0, 0})
+	writeBmpMessage(stream, BMP_TERMINATION, nil, []byte{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+
+	// The router stand in, which replays the stream
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write(stream.Bytes())
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("error accepting: %v", err)
+	}
+
+	sink := new(testSink)
+	detector := NewDetector(config)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.StartInOrder()
+
+	listener := NewBmpListener("", detector)
+	err = listener.Run(conn)
+	if err == nil || err.Error() != "EOF" {
+		t.Errorf("expected the session to end with the termination message: %v", err)
+	}
+
+	detector.Wait()
+	detector.Close()
+
+	assertAlerts(t, sink.Alerts(),
+		"High first_appearance AS3356 [192.104.160.0/23] path [3356 64666]",
+		"High invalid_prefix_peer AS3356 [192.104.160.0/23] path [3356 64666]")
+
+	routers := listener.Routers()
+	if len(routers) != 1 || routers[0].Name != "router1" || routers[0].Connected == true || routers[0].Messages != 7 {
+		t.Fatalf("unexpected routers: %+v", routers)
+	}
+
+	for _, p := range routers[0].Peers {
+		if p.As != 3356 || p.Up == true || p.Updates != 1 || p.DownReason != 2 || p.Stats[7] != 9 {
+			t.Errorf("unexpected peer: %+v", p)
+		}
+	}
+
+	if routes := routeState.Routes(TEST_PREFIX_V4); len(routes) != 1 || routes[0].Active == true {
+		t.Errorf("expected the routes of the peer to be withdrawn: %+v", routes)
+	}
+}
+
+// bmpPeerHeader returns a per-peer header for the IPv4 peer, without a timestamp
+func bmpPeerHeader(peerIP net.IP, peerAs uint32, flags uint8) []byte {
+
+	hdr := make([]byte, BMP_PEER_HEADER_LEN)
+	hdr[1] = flags
+	copy(hdr[22:26], peerIP.To4())
+	binary.BigEndian.PutUint32(hdr[26:30], peerAs)
+	copy(hdr[30:34], peerIP.To4())
+
+	return hdr
+}
+
+// writeBmpMessage writes a BMP message, with the per-peer header if supplied
+func writeBmpMessage(w *bytes.Buffer, msgType uint8, hdr []byte, body []byte) {
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(BMP_HEADER_LEN+len(hdr)+len(body)))
+
+	w.WriteByte(BMP_VERSION)
+	w.Write(length)
+	w.WriteByte(msgType)
+	w.Write(hdr)
+	w.Write(body)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	util "github.com/woanware/goutil"
+)
+
+// ##### Methods ##############################################################
+
+// runAlertsCommand lists the persisted alerts using the filters, or acknowledges alerts
+func runAlertsCommand() {
+
+	opts := options.Alerts
+
+	if len(opts.Acknowledge) > 0 {
+		count, err := acknowledgeAlerts(opts.Acknowledge)
+		if err != nil {
+			fmt.Printf("Error acknowledging alerts: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Acknowledged %d alert(s)\n", count)
+		return
+	}
+
+	var err error
+	q := &AlertQuery{
+		As:             opts.As,
+		Prefix:         opts.Prefix,
+		Reason:         opts.Reason,
+		Profile:        opts.Profile,
+		Unacknowledged: opts.Unacknowledged,
+		Limit:          opts.Limit,
+	}
+
+	if len(opts.From) > 0 {
+		q.From, err = parseCommandTime(opts.From)
+		if err != nil {
+			fmt.Printf("Invalid from time: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(opts.To) > 0 {
+		q.To, err = parseCommandEndTime(opts.To)
+		if err != nil {
+			fmt.Printf("Invalid to time: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if len(opts.Priority) > 0 {
+		q.Priority, err = parseAlertPriority(opts.Priority)
+		if err != nil {
+			fmt.Printf("Invalid priority: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	alerts, err := queryAlerts(q)
+	if err != nil {
+		fmt.Printf("Error retrieving alerts: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, a := range alerts {
+		ack := "No"
+		if a.Acknowledged == true {
+			ack = "Yes"
+		}
+
+		fmt.Printf("ID: %d\nTimestamp: %s\nPriority: %s\nReason: %s\nCollector: %s\nPeer: AS%d (%s)\nOrigin: AS%d\nPrefixes: %s\nPath: %s\nAcknowledged: %s\n",
+			a.Id, a.Timestamp.UTC().Format("2006-01-02T15:04:05"), a.Priority, a.Reason, a.Collector,
+			a.PeerAs, a.PeerIP, a.Origin, strings.Join(a.Prefixes, " "), a.Path, ack)
+
+		if len(a.Profiles) > 0 {
+			fmt.Printf("Profiles: %s\n", strings.Join(a.Profiles, ", "))
+		}
+		if len(a.Metadata) > 0 {
+			fmt.Printf("Data: %s\n", a.Data())
+		}
+		fmt.Println()
+	}
+
+	fmt.Printf("%d alert(s)\n", len(alerts))
+}
+
+// runReplayCommand passes the update files, in time order, through a detector
+// that only writes to the output file. The history is not updated by the
+// replay, and nothing is written to the history store or database
+func runReplayCommand() {
+
+	opts := options.Replay
+
+	files, err := findReplayFiles(opts.Args.Files, opts.Name)
+	if err != nil {
+		fmt.Printf("Error finding update files: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(opts.From) > 0 || len(opts.To) > 0 {
+		from := time.Time{}
+		to := time.Now().UTC()
+
+		if len(opts.From) > 0 {
+			from, err = parseCommandTime(opts.From)
+			if err != nil {
+				fmt.Printf("Invalid from time: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if len(opts.To) > 0 {
+			to, err = parseCommandEndTime(opts.To)
+			if err != nil {
+				fmt.Printf("Invalid to time: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		dataSets := opts.DataSets
+		if len(dataSets) == 0 {
+			for name := range config.DataSets {
+				dataSets = append(dataSets, name)
+			}
+		}
+
+		cached, err := findCachedFiles(dataSets, from, to)
+		if err != nil {
+			fmt.Printf("Error finding cached update files: %v\n", err)
+			os.Exit(1)
+		}
+		files = append(files, cached...)
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No update files to replay, supply file paths/globs or a time range")
+		os.Exit(1)
+	}
+
+	sortReplayFiles(files)
+
+	switch {
+	case isStoreHistory(opts.History) == true:
+		store, err := NewHistoryStore(config)
+		if err != nil {
+			fmt.Printf("Error opening history store: %v\n", err)
+			os.Exit(1)
+		}
+
+		// The store is only read from, the replay never persists the history
+		history = NewHistory(config.HistoryWindow, store)
+		history.Load()
+		store.Close()
+	case opts.History == "none":
+		history = NewHistory(config.HistoryWindow, nil)
+	default:
+		history = NewHistory(config.HistoryWindow, nil)
+		err = history.LoadFile(opts.History)
+		if err != nil {
+			fmt.Printf("Error loading history snapshot (%s): %v\n", opts.History, err)
+			os.Exit(1)
+		}
+	}
+
+	history.SetKnownAdjacencies(neighbourAdjacencies(config))
+
+	if len(opts.SaveHistory) > 0 {
+		err = history.SaveFile(opts.SaveHistory)
+		if err != nil {
+			fmt.Printf("Error saving history snapshot (%s): %v\n", opts.SaveHistory, err)
+			os.Exit(1)
+		}
+	}
+
+	routeState = NewRouteState()
+
+	// Only the output file receives the alerts, not the configured sinks
+	err = os.Remove(opts.Output)
+	if err != nil && os.IsNotExist(err) == false {
+		fmt.Printf("Error removing existing output file (%s): %v\n", opts.Output, err)
+		os.Exit(1)
+	}
+
+	sink, err := NewFileSink(opts.Output)
+	if err != nil {
+		fmt.Printf("Error creating output file (%s): %v\n", opts.Output, err)
+		os.Exit(1)
+	}
+
+	replayConfig := *config
+	replayConfig.AlertSinks = nil
+	replayConfig.Profiles = make([]ProfileConfig, 0, len(config.Profiles))
+	for _, pc := range config.Profiles {
+		pc.AlertSinks = nil
+		replayConfig.Profiles = append(replayConfig.Profiles, pc)
+	}
+
+	detector := NewDetector(&replayConfig)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.StartInOrder()
+
+	mrtParser := new(MrtParser)
+	for _, f := range files {
+		fmt.Printf("Replaying update file (%s): %s\n", f.Name, f.Path)
+
+		err = mrtParser.ParseAndDetect(detector, f.Name, f.Path)
+		if err != nil {
+			fmt.Printf("Error parsing update file (%s): %v\n", f.Path, err)
+		}
+
+		// Finish each file before starting the next so that the alerts stay in order
+		detector.Wait()
+	}
+
+	detector.Close()
+
+	fmt.Printf("Replayed %d update file(s), alerts written to %s\n", len(files), opts.Output)
+}
+
+// parseCommandTime parses a command line time, either a date or a date and time (UTC)
+func parseCommandTime(data string) (time.Time, error) {
+
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		ts := util.ParseTimestampWithFormat(data, layout)
+		if ts.IsZero() == false {
+			return ts.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognised time format: %s", data)
+}
+
+// parseCommandEndTime parses a command line time that ends a range, a date on
+// its own includes the whole day
+func parseCommandEndTime(data string) (time.Time, error) {
+
+	ts, err := parseCommandTime(data)
+	if err != nil {
+		return ts, err
+	}
+
+	if len(data) == len("2006-01-02") {
+		ts = ts.Add(24*time.Hour - time.Nanosecond)
+	}
+
+	return ts, nil
+}
+
+// runMigrateCommand applies or reverts the schema migrations, or lists their status
+func runMigrateCommand() {
+
+	opts := options.Migrate
+
+	switch strings.ToLower(opts.Args.Action) {
+	case "up":
+		target := opts.Version
+		if target < 0 {
+			target = latestMigrationVersion()
+		}
+
+		count, err := migrateUp(target)
+		if err != nil {
+			fmt.Printf("Error applying migrations: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Applied %d migration(s)\n", count)
+
+	case "down":
+		target := opts.Version
+		if target < 0 {
+			version, err := schemaVersion()
+			if err != nil {
+				fmt.Printf("Error retrieving schema version: %v\n", err)
+				os.Exit(1)
+			}
+			target = version - 1
+		}
+
+		count, err := migrateDown(target)
+		if err != nil {
+			fmt.Printf("Error reverting migrations: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Reverted %d migration(s)\n", count)
+
+	case "status":
+		statuses, err := migrationStatus()
+		if err != nil {
+			fmt.Printf("Error retrieving migration status: %v\n", err)
+			os.Exit(1)
+		}
+
+		for _, s := range statuses {
+			applied := "Pending"
+			if s.Applied == true {
+				applied = s.AppliedAt.UTC().Format("2006-01-02T15:04:05")
+			}
+			fmt.Printf("%4d %-30s %s\n", s.Migration.Version, s.Migration.Name, applied)
+		}
+
+	default:
+		fmt.Printf("Invalid migrate action, use up, down or status: %s\n", opts.Args.Action)
+		os.Exit(1)
+	}
+}
+
+// isStoreHistory returns whether the replay history option refers to the configured history store
+func isStoreHistory(value string) bool {
+
+	return value == "store"
+}
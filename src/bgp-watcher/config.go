@@ -2,12 +2,12 @@ package main
 
 import (
 	"log"
+	"net"
 	"strings"
 
 	fsnotify "github.com/fsnotify/fsnotify"
 	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
 	viper "github.com/spf13/viper"
-	util "github.com/woanware/goutil"
 )
 
 // ##### Structs ##############################################################
@@ -21,20 +21,90 @@ type DataSets struct {
 	Data []DataSet `mapstructure:"data_sets"`
 }
 
+// AlertSinkConfig describes a single alert sink, only the fields relevant to the type are used
+type AlertSinkConfig struct {
+	Type        string `mapstructure:"type"`
+	Enabled     bool   `mapstructure:"enabled"`
+	Priority    string `mapstructure:"min_priority"`
+	Path        string `mapstructure:"path"`
+	Network     string `mapstructure:"network"`
+	Address     string `mapstructure:"address"`
+	Url         string `mapstructure:"url"`
+	MinPriority AlertPriority
+}
+
+type AlertSinks struct {
+	Sinks []AlertSinkConfig `mapstructure:"alert_sinks"`
+}
+
+// RisLiveSubscription filters the RIS Live feed, the path supports the RIS Live
+// syntax e.g. "15169$" for paths originated by AS15169
+type RisLiveSubscription struct {
+	Host         string `mapstructure:"host"`
+	Peer         string `mapstructure:"peer"`
+	Prefix       string `mapstructure:"prefix"`
+	MoreSpecific bool   `mapstructure:"more_specific"`
+	LessSpecific bool   `mapstructure:"less_specific"`
+	Path         string `mapstructure:"path"`
+}
+
+// BgpNeighbourConfig is a router that the BGP speaker peers with, the address may
+// include a port. Passive neighbours are not connected to, they must connect to us
+type BgpNeighbourConfig struct {
+	Name    string `mapstructure:"name"`
+	Address string `mapstructure:"address"`
+	PeerAs  uint32 `mapstructure:"peer_as"`
+	Passive bool   `mapstructure:"passive"`
+}
+
+type BgpNeighbours struct {
+	Neighbours []BgpNeighbourConfig `mapstructure:"bgp_neighbours"`
+}
+
+type RisLiveSubscriptions struct {
+	Subscriptions []RisLiveSubscription `mapstructure:"ris_live_subscriptions"`
+}
+
 // Config holds configuration data for the application
 type Config struct {
-	DatabaseServer      string
-	DatabasePort        int
-	DatabaseUsername    string
-	DatabasePassword    string
-	Database            string
-	HistoryMonths       int
-	Processes           int
-	DataSets            map[string]string
-	MonitorCountryCodes map[string]struct{}
-	TargetAs            map[uint32]struct{}
-	NeighbourPeers      map[uint32]struct{}
-	Prefixes            []*bgp.IPAddrPrefix
+	DatabaseServer         string
+	DatabasePort           int
+	DatabaseUsername       string
+	DatabasePassword       string
+	Database               string
+	MigrateOnStartup       bool
+	HistoryMonths          int
+	HistoryWindow          int
+	HistoryStore           string
+	HistoryPath            string
+	RibBootstrap           bool
+	Processes              int
+	DataSets               map[string]string
+	MonitorCountryCodes    map[string]struct{}
+	TargetAs               map[uint32]struct{}
+	NeighbourPeers         map[uint32]struct{}
+	Prefixes               []bgp.AddrPrefixInterface
+	WithdrawalThreshold    int
+	WithdrawalWindow       int
+	WithdrawalMinPeers     int
+	RpkiVrpFile            string
+	AsRelationshipFile     string
+	RtrServer              string
+	IncidentAggregation    bool
+	IncidentResolveWindow  int
+	IncidentUpdateInterval int
+	RisLiveUrl             string
+	RisLiveSubscriptions   []RisLiveSubscription
+	BmpListen              string
+	BgpLocalAs             uint32
+	BgpRouterId            net.IP
+	BgpHoldTime            int
+	BgpListen              string
+	BgpNeighbours          []BgpNeighbourConfig
+	ApiListen              string
+	AlertSinks             []AlertSinkConfig
+	Rules                  []RuleConfig
+	Profiles               []ProfileConfig
 }
 
 // ##### Methods ##############################################################
@@ -49,11 +119,16 @@ func initialiseConfiguration() {
 	if err != nil {
 		log.Fatalf("Error reading config file: %s \n", err)
 	}
+}
 
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		reloadConfig()
-	})
+// watchConfiguration reloads the detection rules when the config file changes,
+// once the detector is running
+func watchConfiguration() {
 
+	configReader.OnConfigChange(func(e fsnotify.Event) {
+		reloadConfig(false)
+	})
+	configReader.WatchConfig()
 }
 
 func parseConfiguration() *Config {
@@ -64,15 +139,74 @@ func parseConfiguration() *Config {
 	config.MonitorCountryCodes = make(map[string]struct{})
 	config.TargetAs = make(map[uint32]struct{})
 	config.NeighbourPeers = make(map[uint32]struct{})
-	config.Prefixes = make([]*bgp.IPAddrPrefix, 0)
+	config.Prefixes = make([]bgp.AddrPrefixInterface, 0)
 
 	config.DatabaseServer = configReader.GetString("database_server")
 	config.DatabasePort = configReader.GetInt("database_port")
 	config.DatabaseUsername = configReader.GetString("database_username")
 	config.DatabasePassword = configReader.GetString("database_password")
 	config.Database = configReader.GetString("database")
+	config.MigrateOnStartup = configReader.GetBool("migrate_on_startup")
 	config.HistoryMonths = configReader.GetInt("history_months")
+	config.HistoryWindow = configReader.GetInt("history_window")
+	config.HistoryStore = strings.ToLower(configReader.GetString("history_store"))
+	config.HistoryPath = configReader.GetString("history_path")
+	config.RibBootstrap = configReader.GetBool("rib_bootstrap")
 	config.Processes = configReader.GetInt("processes")
+	config.WithdrawalThreshold = configReader.GetInt("withdrawal_threshold")
+	config.WithdrawalWindow = configReader.GetInt("withdrawal_window")
+	config.WithdrawalMinPeers = configReader.GetInt("withdrawal_min_peers")
+	config.RpkiVrpFile = configReader.GetString("rpki_vrp_file")
+	config.AsRelationshipFile = configReader.GetString("as_relationship_file")
+	config.RtrServer = configReader.GetString("rtr_server")
+	config.IncidentAggregation = configReader.GetBool("incident_aggregation")
+	config.IncidentResolveWindow = configReader.GetInt("incident_resolve_window")
+	config.IncidentUpdateInterval = configReader.GetInt("incident_update_interval")
+	config.RisLiveUrl = configReader.GetString("ris_live_url")
+	config.BmpListen = configReader.GetString("bmp_listen")
+	config.BgpHoldTime = configReader.GetInt("bgp_hold_time")
+	config.BgpListen = configReader.GetString("bgp_listen")
+	config.ApiListen = configReader.GetString("api_listen")
+
+	// Default to counting the routes seen in the last 90 days (0 counts all days)
+	if config.HistoryWindow < 0 {
+		config.HistoryWindow = 0
+	} else if configReader.IsSet("history_window") == false {
+		config.HistoryWindow = 90
+	}
+
+	// Default to persisting the history to the database, the file store keeps it under ./db/history
+	if len(config.HistoryStore) == 0 {
+		config.HistoryStore = "postgres"
+	}
+	if len(config.HistoryPath) == 0 {
+		config.HistoryPath = "./db/history"
+	}
+
+	// Default to alerting when half of the peers withdraw within five minutes
+	if config.WithdrawalThreshold <= 0 || config.WithdrawalThreshold > 100 {
+		config.WithdrawalThreshold = 50
+	}
+	if config.WithdrawalWindow <= 0 {
+		config.WithdrawalWindow = 5
+	}
+	if config.WithdrawalMinPeers <= 0 {
+		config.WithdrawalMinPeers = 3
+	}
+
+	// Default to resolving incidents after 30 minutes without updates, with hourly ongoing
+	// updates (0 disables them). Aggregation is enabled unless turned off
+	if configReader.IsSet("incident_aggregation") == false {
+		config.IncidentAggregation = true
+	}
+	if config.IncidentResolveWindow <= 0 {
+		config.IncidentResolveWindow = 30
+	}
+	if config.IncidentUpdateInterval < 0 {
+		config.IncidentUpdateInterval = 0
+	} else if configReader.IsSet("incident_update_interval") == false {
+		config.IncidentUpdateInterval = 60
+	}
 
 	var as uint32
 	var err error
@@ -80,9 +214,9 @@ func parseConfiguration() *Config {
 	// Convert string slice values (Target AS's) into uint32
 	temp := configReader.GetStringSlice("target_as")
 	for _, t := range temp {
-		as, err = util.ConvertStringToUint32(t)
+		as, err = parseAs(t)
 		if err != nil {
-			log.Fatalf("Invalid AS: %s\n", as)
+			log.Fatalf("Invalid AS: %s\n", t)
 		}
 
 		config.TargetAs[as] = struct{}{}
@@ -91,35 +225,25 @@ func parseConfiguration() *Config {
 	// Convert string slice values (Neighbour Peers) into uint32
 	temp = configReader.GetStringSlice("neighbour_peers")
 	for _, t := range temp {
-		as, err = util.ConvertStringToUint32(t)
+		as, err = parseAs(t)
 		if err != nil {
-			log.Fatalf("Invalid AS: %s\n", as)
+			log.Fatalf("Invalid AS: %s\n", t)
 		}
 
 		config.NeighbourPeers[as] = struct{}{}
 	}
 
 	temp = configReader.GetStringSlice("prefixes")
-	// Convert string slice values (Prefixes) into IPAddrPrefix (from bgp lib)
-	var parts []string
-	var bit uint8
+	// Convert string slice values (Prefixes) into IPAddrPrefix/IPv6AddrPrefix (from bgp lib)
+	var prefix bgp.AddrPrefixInterface
 	for _, t := range temp {
 
-		parts = strings.Split(t, "/")
-		if len(parts) != 2 {
-			log.Fatalf("Invalid prefix: %s\n", t)
-		}
-
-		bit, err = util.ConvertStringToUint8(parts[1])
+		prefix, err = parsePrefix(t)
 		if err != nil {
-			log.Fatalf("Invalid prefix bit: %s\n", parts[1])
+			log.Fatalf("Invalid prefix: %v\n", err)
 		}
 
-		if bit > 32 {
-			log.Fatalf("Invalid prefix bit: %s\n", parts[1])
-		}
-
-		config.Prefixes = append(config.Prefixes, bgp.NewIPAddrPrefix(bit, parts[0]))
+		config.Prefixes = append(config.Prefixes, prefix)
 	}
 
 	// Convert string slice values (Target AS's) into uint32
@@ -146,5 +270,134 @@ func parseConfiguration() *Config {
 		config.DataSets[ds.Name] = ds.Url
 	}
 
+	// Decode the RIS Live subscriptions, the defaults are based on our prefixes and AS's
+	var risLiveSubscriptions RisLiveSubscriptions
+	err = configReader.Unmarshal(&risLiveSubscriptions)
+	if err != nil {
+		log.Fatalf("Error decoding config RIS Live subscriptions: %v\n", err)
+	}
+	config.RisLiveSubscriptions = risLiveSubscriptions.Subscriptions
+
+	// Decode the BGP neighbours, whose AS's are also neighbour peers
+	var bgpNeighbours BgpNeighbours
+	err = configReader.Unmarshal(&bgpNeighbours)
+	if err != nil {
+		log.Fatalf("Error decoding config BGP neighbours: %v\n", err)
+	}
+
+	for _, n := range bgpNeighbours.Neighbours {
+		if len(n.Address) == 0 {
+			log.Fatalf("BGP neighbour requires an address: %s\n", n.Name)
+		}
+
+		if n.PeerAs != 0 {
+			config.NeighbourPeers[n.PeerAs] = struct{}{}
+		}
+		config.BgpNeighbours = append(config.BgpNeighbours, n)
+	}
+
+	if len(config.BgpNeighbours) > 0 {
+		config.BgpLocalAs, err = parseAs(configReader.GetString("bgp_local_as"))
+		if err != nil || config.BgpLocalAs == 0 {
+			log.Fatalf("Invalid BGP local AS: %s\n", configReader.GetString("bgp_local_as"))
+		}
+
+		config.BgpRouterId = net.ParseIP(configReader.GetString("bgp_router_id")).To4()
+		if config.BgpRouterId == nil {
+			log.Fatalf("Invalid BGP router ID: %s\n", configReader.GetString("bgp_router_id"))
+		}
+	}
+
+	// Default to the RFC 4271 suggested hold time
+	if configReader.IsSet("bgp_hold_time") == false || config.BgpHoldTime < 0 {
+		config.BgpHoldTime = 90
+	} else if config.BgpHoldTime > 0 && config.BgpHoldTime < 3 {
+		config.BgpHoldTime = 3
+	}
+
+	// Decode the alert sinks, defaulting to the console if none are configured
+	var alertSinks AlertSinks
+	err = configReader.Unmarshal(&alertSinks)
+	if err != nil {
+		log.Fatalf("Error decoding config alert sinks: %v\n", err)
+	}
+
+	if configReader.IsSet("alert_sinks") == false {
+		alertSinks.Sinks = append(alertSinks.Sinks, AlertSinkConfig{Type: "console", Enabled: true})
+	}
+
+	for _, as := range alertSinks.Sinks {
+		if as.Enabled == false {
+			continue
+		}
+
+		as.MinPriority, err = parseAlertPriority(as.Priority)
+		if err != nil {
+			log.Fatalf("Invalid alert sink priority (%s): %v\n", as.Type, err)
+		}
+
+		config.AlertSinks = append(config.AlertSinks, as)
+	}
+
+	// Decode the detection rules, the rules not configured keep their defaults
+	config.Rules, err = parseRuleConfigs()
+	if err != nil {
+		log.Fatalf("Error decoding config rules: %v\n", err)
+	}
+
+	_, err = NewRules(config)
+	if err != nil {
+		log.Fatalf("Invalid detection rule: %v\n", err)
+	}
+
+	// Decode the monitoring profiles, each with its own alert sinks
+	var profiles ProfileConfigs
+	err = configReader.Unmarshal(&profiles)
+	if err != nil {
+		log.Fatalf("Error decoding config profiles: %v\n", err)
+	}
+
+	names := make(map[string]struct{})
+	for _, pc := range profiles.Profiles {
+		if len(pc.Name) == 0 {
+			log.Fatalf("Invalid profile, a name is required\n")
+		}
+		if _, ok := names[pc.Name]; ok == true {
+			log.Fatalf("Invalid profile, duplicate name: %s\n", pc.Name)
+		}
+		names[pc.Name] = struct{}{}
+
+		_, err = NewProfile(pc)
+		if err != nil {
+			log.Fatalf("Invalid profile: %v\n", err)
+		}
+
+		sinks := make([]AlertSinkConfig, 0)
+		for _, as := range pc.AlertSinks {
+			if as.Enabled == false {
+				continue
+			}
+
+			as.MinPriority, err = parseAlertPriority(as.Priority)
+			if err != nil {
+				log.Fatalf("Invalid alert sink priority (%s, profile %s): %v\n", as.Type, pc.Name, err)
+			}
+
+			sinks = append(sinks, as)
+		}
+		pc.AlertSinks = sinks
+
+		config.Profiles = append(config.Profiles, pc)
+	}
+
 	return config
 }
+
+// parseRuleConfigs decodes the detection rules
+func parseRuleConfigs() ([]RuleConfig, error) {
+
+	var rules RuleConfigs
+	err := configReader.Unmarshal(&rules)
+
+	return rules.Rules, err
+}
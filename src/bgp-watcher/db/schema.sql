@@ -1,9 +1,10 @@
 --
--- PostgreSQL database dump
+-- PostgreSQL database schema, with all of the migrations applied (version 6)
+--
+-- The migrations built in to bgp-watcher are the source of the schema, create
+-- and upgrade databases with `bgpm migrate up` (or migrate_on_startup). A
+-- database created from this file is adopted by the migrations without changes
 --
-
--- Dumped from database version 10.6 (Ubuntu 10.6-0ubuntu0.18.10.1)
--- Dumped by pg_dump version 10.6 (Ubuntu 10.6-0ubuntu0.18.10.1)
 
 SET statement_timeout = 0;
 SET lock_timeout = 0;
@@ -33,6 +34,66 @@ SET default_tablespace = '';
 
 SET default_with_oids = false;
 
+--
+-- Name: adjacencies; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.adjacencies (
+    neighbour_as bigint NOT NULL,
+    asn bigint NOT NULL,
+    count bigint DEFAULT 0 NOT NULL,
+    first_seen timestamp with time zone DEFAULT now() NOT NULL,
+    last_seen timestamp with time zone DEFAULT now() NOT NULL,
+    days jsonb DEFAULT '{}'::jsonb NOT NULL
+);
+
+
+ALTER TABLE public.adjacencies OWNER TO postgres;
+
+--
+-- Name: alerts; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.alerts (
+    id bigint NOT NULL,
+    "timestamp" timestamp with time zone NOT NULL,
+    collector character varying(100) NOT NULL,
+    peer_as bigint NOT NULL,
+    peer_ip character varying(50) NOT NULL,
+    prefixes text[] DEFAULT '{}'::text[] NOT NULL,
+    path character varying(2000) NOT NULL,
+    origin bigint DEFAULT 0 NOT NULL,
+    reason character varying(50) NOT NULL,
+    priority integer NOT NULL,
+    data jsonb DEFAULT '{}'::jsonb NOT NULL,
+    acknowledged boolean DEFAULT false NOT NULL,
+    profiles text[] DEFAULT '{}'::text[] NOT NULL
+);
+
+
+ALTER TABLE public.alerts OWNER TO postgres;
+
+--
+-- Name: alerts_id_seq; Type: SEQUENCE; Schema: public; Owner: postgres
+--
+
+CREATE SEQUENCE public.alerts_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.alerts_id_seq OWNER TO postgres;
+
+--
+-- Name: alerts_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: postgres
+--
+
+ALTER SEQUENCE public.alerts_id_seq OWNED BY public.alerts.id;
+
+
 --
 -- Name: routes; Type: TABLE; Schema: public; Owner: postgres
 --
@@ -41,7 +102,10 @@ CREATE TABLE public.routes (
     peer_as bigint NOT NULL,
     route character varying(200) NOT NULL,
     id bigint NOT NULL,
-    count bigint DEFAULT 0 NOT NULL
+    count bigint DEFAULT 0 NOT NULL,
+    first_seen timestamp with time zone DEFAULT now() NOT NULL,
+    last_seen timestamp with time zone DEFAULT now() NOT NULL,
+    days jsonb DEFAULT '{}'::jsonb NOT NULL
 );
 
 
@@ -68,6 +132,26 @@ ALTER TABLE public.routes_id_seq OWNER TO postgres;
 ALTER SEQUENCE public.routes_id_seq OWNED BY public.routes.id;
 
 
+--
+-- Name: schema_version; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE public.schema_version (
+    version integer NOT NULL,
+    name character varying(200) NOT NULL,
+    applied timestamp with time zone DEFAULT now() NOT NULL
+);
+
+
+ALTER TABLE public.schema_version OWNER TO postgres;
+
+--
+-- Name: alerts id; Type: DEFAULT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.alerts ALTER COLUMN id SET DEFAULT nextval('public.alerts_id_seq'::regclass);
+
+
 --
 -- Name: routes id; Type: DEFAULT; Schema: public; Owner: postgres
 --
@@ -76,10 +160,32 @@ ALTER TABLE ONLY public.routes ALTER COLUMN id SET DEFAULT nextval('public.route
 
 
 --
--- Name: routes_id_seq; Type: SEQUENCE SET; Schema: public; Owner: postgres
+-- Data for Name: schema_version; Type: TABLE DATA; Schema: public; Owner: postgres
+--
+
+INSERT INTO public.schema_version (version, name) VALUES
+    (1, 'routes'),
+    (2, 'alerts'),
+    (3, 'routes_history_days'),
+    (4, 'routes_peer_as_route_key'),
+    (5, 'adjacencies'),
+    (6, 'alerts_profiles');
+
+
+--
+-- Name: adjacencies adjacencies_pk; Type: CONSTRAINT; Schema: public; Owner: postgres
 --
 
-SELECT pg_catalog.setval('public.routes_id_seq', 4099, true);
+ALTER TABLE ONLY public.adjacencies
+    ADD CONSTRAINT adjacencies_pk PRIMARY KEY (neighbour_as, asn);
+
+
+--
+-- Name: alerts alerts_pk; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.alerts
+    ADD CONSTRAINT alerts_pk PRIMARY KEY (id);
 
 
 --
@@ -90,6 +196,42 @@ ALTER TABLE ONLY public.routes
     ADD CONSTRAINT routes_pk PRIMARY KEY (id);
 
 
+--
+-- Name: schema_version schema_version_pk; Type: CONSTRAINT; Schema: public; Owner: postgres
+--
+
+ALTER TABLE ONLY public.schema_version
+    ADD CONSTRAINT schema_version_pk PRIMARY KEY (version);
+
+
+--
+-- Name: alerts_timestamp_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX alerts_timestamp_idx ON public.alerts USING btree ("timestamp");
+
+
+--
+-- Name: alerts_peer_as_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX alerts_peer_as_idx ON public.alerts USING btree (peer_as, origin);
+
+
+--
+-- Name: alerts_profiles_idx; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE INDEX alerts_profiles_idx ON public.alerts USING gin (profiles);
+
+
+--
+-- Name: routes_peer_as_route_key; Type: INDEX; Schema: public; Owner: postgres
+--
+
+CREATE UNIQUE INDEX routes_peer_as_route_key ON public.routes USING btree (peer_as, route);
+
+
 --
 -- Name: routes_route_idx; Type: INDEX; Schema: public; Owner: postgres
 --
@@ -98,6 +240,6 @@ CREATE INDEX routes_route_idx ON public.routes USING btree (route, peer_as);
 
 
 --
--- PostgreSQL database dump complete
+-- PostgreSQL database schema complete
 --
 
@@ -3,6 +3,9 @@ package main
 import (
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
@@ -17,14 +20,24 @@ type DetectData struct {
 	PeerAs      uint32
 	Paths       []uint32
 	PathsString string
-	NLRI        []*bgp.IPAddrPrefix
+	AsPath      *AsPath
+	NLRI        []bgp.AddrPrefixInterface
+	Withdrawn   []bgp.AddrPrefixInterface
 }
 
 type Detector struct {
 	queue               chan *DetectData
 	targetAs            map[uint32]struct{}
 	monitorCountryCodes map[string]struct{}
-	prefixes            map[*bgp.IPAddrPrefix]struct{}
+	prefixes            *PrefixTree
+	rules               []*Rule
+	rulesMux            sync.RWMutex
+	sinks               []*alertSinkFilter
+	profiles            []*Profile
+	aggregator          *Aggregator
+	collect             bool
+	pending             sync.WaitGroup
+	queued              int64
 }
 
 // ##### Methods ##############################################################
@@ -44,6 +57,48 @@ func NewDetector(config *Config) *Detector {
 		d.AddPrefix(prefix)
 	}
 
+	rules, err := NewRules(config)
+	if err != nil {
+		fmt.Printf("Error creating detection rules, using the defaults: %v\n", err)
+		rules = defaultRules(config)
+	}
+	d.SetRules(rules)
+
+	for _, asc := range config.AlertSinks {
+		sink, err := NewAlertSink(asc)
+		if err != nil {
+			fmt.Printf("Error creating alert sink (%s): %v\n", asc.Type, err)
+			continue
+		}
+		d.AddAlertSink(sink, asc.MinPriority)
+	}
+
+	// The checks use the AS's, prefixes and countries of all of the profiles,
+	// each profile then accepts the alerts that it owns
+	d.profiles = append(d.profiles, newDefaultProfile(config))
+	for _, pc := range config.Profiles {
+		p, err := NewProfile(pc)
+		if err != nil {
+			fmt.Printf("Error creating profile (%s): %v\n", pc.Name, err)
+			continue
+		}
+		d.AddProfile(p)
+
+		for _, asc := range pc.AlertSinks {
+			sink, err := NewAlertSink(asc)
+			if err != nil {
+				fmt.Printf("Error creating alert sink (%s, profile %s): %v\n", asc.Type, p.Name, err)
+				continue
+			}
+			p.sinks = append(p.sinks, &alertSinkFilter{sink: sink, minPriority: asc.MinPriority})
+		}
+	}
+
+	if config.IncidentAggregation == true {
+		d.aggregator = NewAggregator(time.Duration(config.IncidentResolveWindow)*time.Minute,
+			time.Duration(config.IncidentUpdateInterval)*time.Minute, d.dispatch)
+	}
+
 	return d
 }
 
@@ -53,7 +108,7 @@ func (d *Detector) initialise() {
 	d.queue = make(chan *DetectData)
 	d.monitorCountryCodes = make(map[string]struct{})
 	d.targetAs = make(map[uint32]struct{})
-	d.prefixes = make(map[*bgp.IPAddrPrefix]struct{})
+	d.prefixes = NewPrefixTree()
 }
 
 //
@@ -63,9 +118,80 @@ func (d *Detector) AddTargetAs(as uint32) {
 }
 
 //
-func (d *Detector) AddPrefix(prefix *bgp.IPAddrPrefix) {
+func (d *Detector) AddPrefix(prefix bgp.AddrPrefixInterface) {
+
+	d.prefixes.Add(prefix)
+}
+
+// AddProfile adds a named monitoring profile, and monitors its AS's, prefixes and countries
+func (d *Detector) AddProfile(p *Profile) {
+
+	d.profiles = append(d.profiles, p)
+
+	for as := range p.TargetAs {
+		d.AddTargetAs(as)
+	}
+	for _, prefix := range p.Prefixes {
+		d.AddPrefix(prefix)
+	}
+	for cc := range p.MonitorCountryCodes {
+		d.AddMonitorCountryCode(cc)
+	}
+}
+
+// SetCollect sets whether the paths originated by our AS's are added to the
+// history, once they have been detected against, e.g. in live operation but not replays
+func (d *Detector) SetCollect(collect bool) {
+
+	d.collect = collect
+}
+
+// SetRules replaces the detection rules e.g. when the configuration is reloaded
+func (d *Detector) SetRules(rules []*Rule) {
 
-	d.prefixes[prefix] = struct{}{}
+	d.rulesMux.Lock()
+	defer d.rulesMux.Unlock()
+
+	d.rules = rules
+}
+
+// Rules returns the detection rules, in the order that they are evaluated
+func (d *Detector) Rules() []*Rule {
+
+	d.rulesMux.RLock()
+	defer d.rulesMux.RUnlock()
+
+	return d.rules
+}
+
+// AddAlertSink adds a sink that will receive alerts of the minimum priority or higher
+func (d *Detector) AddAlertSink(sink AlertSink, minPriority AlertPriority) {
+
+	d.sinks = append(d.sinks, &alertSinkFilter{sink: sink, minPriority: minPriority})
+}
+
+// Close sends any queued incident alerts and closes all of the alert sinks
+func (d *Detector) Close() {
+
+	if d.aggregator != nil {
+		d.aggregator.Close()
+	}
+
+	for _, s := range d.sinks {
+		err := s.sink.Close()
+		if err != nil {
+			fmt.Printf("Error closing alert sink (%s): %v\n", s.sink.Name(), err)
+		}
+	}
+
+	for _, p := range d.profiles {
+		for _, s := range p.sinks {
+			err := s.sink.Close()
+			if err != nil {
+				fmt.Printf("Error closing alert sink (%s, profile %s): %v\n", s.sink.Name(), p.Name, err)
+			}
+		}
+	}
 }
 
 //
@@ -84,16 +210,34 @@ func (d *Detector) CheckTargetAs(as uint32) bool {
 	return false
 }
 
-//
-func (d *Detector) CheckPrefix(prefix *bgp.IPAddrPrefix) bool {
+// CheckOrigin returns true if the origin (or any AS_SET origin) of the path is one of ours
+func (d *Detector) CheckOrigin(asPath *AsPath) bool {
 
-	if _, ok := d.prefixes[prefix]; ok {
+	for _, as := range asPath.Origins() {
+		if d.CheckTargetAs(as) == true {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CheckPrefix returns true if the prefix is, covers or is covered by one of our prefixes
+func (d *Detector) CheckPrefix(prefix bgp.AddrPrefixInterface) bool {
+
+	if len(d.prefixes.Match(prefix)) > 0 {
 		return true
 	}
 
 	return false
 }
 
+// MatchPrefix returns the monitored prefixes that are, cover or are covered by the prefix
+func (d *Detector) MatchPrefix(prefix bgp.AddrPrefixInterface) []*PrefixMatch {
+
+	return d.prefixes.Match(prefix)
+}
+
 //
 func (d *Detector) CheckMonitorCountryCode(cc string) bool {
 
@@ -112,183 +256,431 @@ func (d *Detector) Start() {
 
 		for {
 			dd = <-d.queue
-			go d.detect(dd)
+			go func(dd *DetectData) {
+				d.detect(dd)
+				d.done()
+			}(dd)
 			dd = nil
 		}
 	}()
 }
 
+// StartInOrder processes the queued data one at a time, in the order that it
+// was queued, rather than concurrently e.g. so that replays are repeatable
+func (d *Detector) StartInOrder() {
+
+	go func() {
+		for dd := range d.queue {
+			d.detect(dd)
+			d.done()
+		}
+	}()
+}
+
+// Wait blocks until all of the queued data has been processed
+func (d *Detector) Wait() {
+
+	d.pending.Wait()
+}
+
+// Queued returns the number of updates queued, or being processed, for detection
+func (d *Detector) Queued() int64 {
+
+	return atomic.LoadInt64(&d.queued)
+}
+
+// enqueue records that data has been queued
+func (d *Detector) enqueue() {
+
+	d.pending.Add(1)
+	atomic.AddInt64(&d.queued, 1)
+	metricUpdatesQueued.Inc()
+	metricQueueDepth.Add(1)
+}
+
+// done records that queued data has been processed
+func (d *Detector) done() {
+
+	atomic.AddInt64(&d.queued, -1)
+	metricQueueDepth.Add(-1)
+	d.pending.Done()
+}
+
 //
 func (d *Detector) Add(name string, timestamp time.Time, peerAs uint32,
-	peerIP net.IP, pathsString string, paths []uint32, nlri []*bgp.IPAddrPrefix) {
+	peerIP net.IP, asPath *AsPath, nlri []bgp.AddrPrefixInterface) {
 
-	d.queue <- &DetectData{Name: name, Timestamp: timestamp, PeerAs: peerAs, PeerIP: peerIP, PathsString: pathsString, Paths: paths, NLRI: nlri}
+	d.enqueue()
+	d.queue <- &DetectData{Name: name, Timestamp: timestamp, PeerAs: peerAs, PeerIP: peerIP,
+		PathsString: asPath.String(), Paths: asPath.Path, AsPath: asPath, NLRI: nlri}
 }
 
-//
+// AddWithdrawal queues the withdrawal of our prefixes by a peer for detection
+func (d *Detector) AddWithdrawal(name string, timestamp time.Time, peerAs uint32,
+	peerIP net.IP, withdrawn []bgp.AddrPrefixInterface) {
+
+	d.enqueue()
+	d.queue <- &DetectData{Name: name, Timestamp: timestamp, PeerAs: peerAs, PeerIP: peerIP, Withdrawn: withdrawn}
+}
+
+// detect evaluates each of the rules that apply to the data, independently of
+// each other, and raises all of their findings
 func (d *Detector) detect(dd *DetectData) {
 
-	ret := d.isAnomlousCountry(dd)
-	if ret == true {
-		// We raised an alert so don't process further
-		return
+	// The path is only added after detection, so that it is detected against the history before it
+	defer d.collectPath(dd)
+
+	if d.aggregator != nil {
+		d.aggregator.Observe(dd)
 	}
 
-	ret = d.isAnomlousPrefix(dd)
-	if ret == true {
-		// We raised an alert so don't process further
+	// Withdrawals have no path, so only the withdrawal rules apply to them
+	if len(dd.Withdrawn) == 0 && len(dd.Paths) == 0 {
 		return
 	}
 
-	ret = d.isLowFrequency(dd)
-	if ret == true {
-		// We raised an alert so don't process further
-		return
+	for _, r := range d.Rules() {
+		if r.Applies(dd) == false {
+			continue
+		}
+
+		for _, alert := range r.Run(d, dd) {
+			if d.accept(r, dd, alert) == true {
+				d.raise(alert)
+			}
+		}
+	}
+}
+
+// collectPath adds the path, and its adjacencies, to the history, if the detector collects the paths
+// and it is originated by one of our AS's
+func (d *Detector) collectPath(dd *DetectData) {
+
+	if d.collect == true && len(dd.Withdrawn) == 0 && d.CheckOrigin(dd.AsPath) == true {
+		history.Set(dd.PeerAs, dd.PathsString, dd.Timestamp)
+		history.SetAdjacencies(dd.AsPath, dd.Timestamp)
 	}
+}
 
-	ret = d.isAnomlousPeer(dd)
-	if ret == true {
-		// We raised an alert so don't process further
+// accept tags the alert with the named profiles that accept it, returns false
+// if no profile (including the default profile) accepts it
+func (d *Detector) accept(r *Rule, dd *DetectData, alert *Alert) bool {
+
+	accepted := false
+	for _, p := range d.profiles {
+		if p.Accepts(r, dd, alert) == false {
+			continue
+		}
+
+		accepted = true
+		if len(p.Name) > 0 {
+			alert.Profiles = append(alert.Profiles, p.Name)
+		}
+	}
+
+	return accepted
+}
+
+// raise passes the alert to the incident aggregator, or directly to the alert sinks if aggregation is disabled
+func (d *Detector) raise(alert *Alert) {
+
+	if d.aggregator != nil {
+		d.aggregator.Add(alert)
 		return
 	}
+
+	d.dispatch(alert)
+}
+
+// dispatch sends the alert to each of the alert sinks that accept its priority. Alerts
+// that are not about routes (e.g. BGP session state) are dispatched without aggregation
+func (d *Detector) dispatch(alert *Alert) {
+
+	metricAlerts.Inc(string(alert.Reason), strings.ToLower(alert.Priority.String()))
+
+	for _, s := range d.sinks {
+		if alert.Priority > s.minPriority {
+			continue
+		}
+
+		err := s.sink.Send(alert)
+		if err != nil {
+			fmt.Printf("Error sending alert to sink (%s): %v\n", s.sink.Name(), err)
+		}
+	}
+
+	// The alert sinks of the profiles only receive the alerts of their profile
+	for _, name := range alert.Profiles {
+		for _, p := range d.profiles {
+			if p.Name == name {
+				p.Send(alert)
+			}
+		}
+	}
+}
+
+// isRpkiInvalid performs RPKI origin validation of announcements of our
+// prefixes, or from our AS's, alerting on any that are invalid
+func (d *Detector) isRpkiInvalid(r *Rule, dd *DetectData) []*Alert {
+
+	// An AS_SET origin cannot be validated, so it can never match a ROA
+	origin := dd.AsPath.Origin
+	if dd.AsPath.OriginSet == true {
+		origin = 0
+	}
+
+	ourOrigin := d.CheckOrigin(dd.AsPath)
+
+	var state RpkiState
+	var roas []*Roa
+	alerts := make([]*Alert, 0)
+
+	for _, n := range dd.NLRI {
+
+		if ourOrigin == false && d.CheckPrefix(n) == false {
+			continue
+		}
+
+		state, roas = roaTable.Validate(n, origin)
+		if state != RpkiInvalid {
+			continue
+		}
+
+		matching := make([]string, len(roas))
+		for i, roa := range roas {
+			matching[i] = roa.String()
+		}
+
+		alerts = append(alerts, NewAlert(dd, PriorityHigh, ReasonRpkiInvalid, []string{n.String()},
+			map[string]string{"roas": strings.Join(matching, ", ")}))
+	}
+
+	return alerts
+}
+
+// isAsSetOrigin checks for paths that end in an AS_SET e.g. an aggregate,
+// since the true origin of the prefix cannot be determined
+func (d *Detector) isAsSetOrigin(r *Rule, dd *DetectData) []*Alert {
+
+	if dd.AsPath.OriginSet == false {
+		return nil
+	}
+
+	return []*Alert{NewAlert(dd, PriorityMedium, ReasonAsSetOrigin, prefixStrings(dd.NLRI),
+		map[string]string{"origins": joinAs(dd.AsPath.Origins(), ",")})}
 }
 
-// detectAnomlousCountry performs analysis on the countries
-// the path goes through. Returns True if nothing suspicious
-// identified
-func (d *Detector) isAnomlousCountry(dd *DetectData) bool {
+// isRouteLeak checks that the path is valley-free, using the AS relationships. A
+// leak is an AS passing on a route learned from a provider or peer to another
+// provider or peer e.g. AS37282 passing Google's routes to AS4809 in November 2018.
+// Each AS_SEQUENCE run is checked on its own, as the links into and out of an AS_SET are not known
+func (d *Detector) isRouteLeak(r *Rule, dd *DetectData) []*Alert {
+
+	if asRelationships == nil || dd.AsPath == nil {
+		return nil
+	}
+
+	for _, path := range dd.AsPath.Sequences() {
+		i, learned, sent := asRelationships.FindLeak(path)
+		if i < 0 {
+			continue
+		}
+
+		// The path is ordered from the peer to the origin, so the route was learned from the next AS
+		return []*Alert{NewAlert(dd, PriorityHigh, ReasonRouteLeak, prefixStrings(dd.NLRI),
+			map[string]string{"leaking_as": fmt.Sprintf("%d", path[i]),
+				"learned_from": fmt.Sprintf("%d", nextPathAs(path, i, 1)), "learned_from_relationship": learned.String(),
+				"sent_to": fmt.Sprintf("%d", nextPathAs(path, i, -1)), "sent_to_relationship": sent.String()})}
+	}
+
+	return nil
+}
+
+// isAnomlousCountry performs analysis on the countries the path goes through,
+// alerting on paths within a country that pass through a monitored country.
+// How often the path has been seen is checked by the path frequency rule. The
+// members of an AS_SET may not be on the path, so only the AS_SEQUENCE AS's are checked
+func (d *Detector) isAnomlousCountry(r *Rule, dd *DetectData) []*Alert {
+
+	// The country of a path that starts or ends in an AS_SET is not known
+	firstAs, ok := dd.AsPath.First()
+	if ok == false || dd.AsPath.OriginSet == true {
+		return nil
+	}
+
+	path := make([]uint32, 0, len(dd.Paths))
+	for _, sequence := range dd.AsPath.Sequences() {
+		path = append(path, sequence...)
+	}
 
 	// If the path length equals two then no middle AS
-	if len(dd.Paths) == 2 {
-		return false
+	if len(path) == 2 {
+		return nil
 	}
 
-	firstAs := dd.Paths[0]
 	firstCountry := asNames.Country(uint32(firstAs))
 
 	// Get last AS Country
-	lastAs := dd.Paths[len(dd.Paths)-1]
+	lastAs := dd.AsPath.Origin
 	lastCountry := asNames.Country(lastAs)
 
 	// If the AS countries are the same then we cannot really check the middle routes
 	if firstCountry != lastCountry {
-		return false
+		return nil
 	}
 
 	var country string
-	var count uint64
-	ret := false
+	alerts := make([]*Alert, 0)
 
 	// Check the country of the intermediary routes
-	for i := 1; i < len(dd.Paths); i++ {
-		country = asNames.Country(dd.Paths[i])
+	for i := 1; i < len(path); i++ {
+		country = asNames.Country(path[i])
 
-		if len(country) == 0 {
+		if len(country) == 0 || country == firstCountry {
 			continue
 		}
 
-		if country != firstCountry {
+		// If country is in monitor list then alert
+		if d.CheckMonitorCountryCode(country) == true {
+			alerts = append(alerts, NewAlert(dd, PriorityHigh, ReasonMonitoredCountry, prefixStrings(dd.NLRI),
+				map[string]string{"internal_route": firstCountry, "external_country": country,
+					"external_as": fmt.Sprintf("%d", path[i])}))
+		}
+	}
 
-			// If country is in monitor list then alert
-			if d.CheckMonitorCountryCode(country) == true {
+	return alerts
+}
 
-				printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, convertAsPath(dd.Paths), "Monitored Country",
-					fmt.Sprintf("Internal Route: %s\nExternal Country: %s (%d)", firstCountry, country, dd.Paths[i]))
-				ret = true
-				continue
-			}
+// isAnomlousPrefix checks for our prefixes, or more/less specific prefixes of
+// them, being announced. Announcements by the AS's of the profile that owns the
+// prefix are excluded by the profile, so one profile's AS cannot announce another's
+func (d *Detector) isAnomlousPrefix(r *Rule, dd *DetectData) []*Alert {
 
-			// err = pool.QueryRow("get_route_count", firstAs, dd.PathsString).Scan(&count)
-			// if err != nil {
-			// 	if strings.Contains(err.Error(), "no rows in result set") == false {
-			// 		fmt.Printf("Error retrieving 'get_route_count' count: %v", err)
-			// 		continue
-			// 	}
+	alerts := make([]*Alert, 0)
 
-			// 	count = 0
-			// 	ret = true
-			// }
+	// Is one of the prefixes one of ours, or more/less specific than one of ours, if so then alert
+	for _, n := range dd.NLRI {
 
-			count = history.GetRouteCount(firstAs, dd.PathsString)
+		for _, m := range d.MatchPrefix(n) {
 
-			if count == 0 {
-				printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "First Appearance", "")
-				ret = true
-				continue
+			switch m.Type {
+			case PrefixMatchExact:
+				alerts = append(alerts, NewAlert(dd, PriorityHigh, ReasonInvalidPrefixPeer, []string{n.String()}, nil))
 
-			} else if count > 0 && count < 5 {
-				printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "Low Frequency", "")
-				ret = true
-				continue
+			case PrefixMatchMoreSpecific:
+				alerts = append(alerts, NewAlert(dd, PriorityHigh, ReasonSubPrefixHijack, []string{n.String()},
+					map[string]string{"monitored_prefix": m.Monitored.String()}))
 
-			} else if count > 5 && count < 10 {
-				printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "Moderate Frequency", "")
-				ret = true
-				continue
+			case PrefixMatchLessSpecific:
+				alerts = append(alerts, NewAlert(dd, PriorityMedium, ReasonCoveringPrefix, []string{n.String()},
+					map[string]string{"monitored_prefix": m.Monitored.String()}))
 			}
 		}
 	}
 
-	return ret
+	return alerts
 }
 
-//
-func (d *Detector) isAnomlousPrefix(dd *DetectData) bool {
+// isNewAdjacency checks that the AS's that our AS's received the route from
+// have been seen as their neighbours before, or are configured neighbour peers.
+// A new upstream, next to an origin that is ours, is the signature of a path
+// forgery (type-1) hijack. The known upstreams (neighbour peers) of each
+// profile are also excluded by the profile
+func (d *Detector) isNewAdjacency(r *Rule, dd *DetectData) []*Alert {
 
-	// Get the last AS and check if it is one of ours, if so exit, else continue checking our prefixes
-	lastAs := dd.Paths[len(dd.Paths)-1]
-	if d.CheckTargetAs(lastAs) == true {
-		return false
+	if dd.AsPath == nil {
+		return nil
 	}
 
-	ret := false
+	alerts := make([]*Alert, 0)
 
-	// Is one of the prefixes one of ours, if so then alert
-	for _, n := range dd.NLRI {
-
-		if d.CheckPrefix(n) == true {
-			printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "Invalid Prefix Peer",
-				fmt.Sprintf("Prefix: %s", n))
+	for _, a := range dd.AsPath.Adjacencies() {
+		if _, ok := d.targetAs[a.As]; ok == false {
+			continue
+		}
+		if _, ok := d.targetAs[a.Neighbour]; ok == true {
+			continue
+		}
 
-			ret = true
+		if history.IsKnownAdjacency(a) == false {
+			alerts = append(alerts, NewAlert(dd, PriorityHigh, ReasonNewAdjacency, prefixStrings(dd.NLRI),
+				map[string]string{"target_as": fmt.Sprintf("%d", a.As), "neighbour_as": fmt.Sprintf("%d", a.Neighbour),
+					"neighbour_country": asNames.Country(a.Neighbour)}))
 		}
 	}
 
-	return ret
+	return alerts
 }
 
-//
-func (d *Detector) isLowFrequency(dd *DetectData) bool {
+// isLowFrequency checks how often the peer has used the path within the history
+// window, alerting on paths seen fewer times than the low_frequency and
+// moderate_frequency thresholds, or never seen before
+func (d *Detector) isLowFrequency(r *Rule, dd *DetectData) []*Alert {
 
 	count := history.GetRouteCount(dd.PeerAs, dd.PathsString)
 
 	if count == 0 {
-		printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "First Appearance", "")
-		return true
+		return []*Alert{NewAlert(dd, PriorityHigh, ReasonFirstAppearance, prefixStrings(dd.NLRI), nil)}
 
-	} else if count > 0 && count < 5 {
-		printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "Low Frequency", "")
-		return true
+	} else if count < uint64(r.Threshold("low_frequency")) {
+		return []*Alert{NewAlert(dd, PriorityHigh, ReasonLowFrequency, prefixStrings(dd.NLRI), nil)}
 
-	} else if count > 5 && count < 10 {
-		printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, dd.PathsString, "Moderate Frequency", "")
-		return true
+	} else if count < uint64(r.Threshold("moderate_frequency")) {
+		return []*Alert{NewAlert(dd, PriorityHigh, ReasonModerateFrequency, prefixStrings(dd.NLRI), nil)}
 	}
 
-	return false
+	return nil
 }
 
 // isAnomlousPeer checks that the sending peer is the
 // first peer on the path. Not sure if this is even possible :-)
-func (d *Detector) isAnomlousPeer(dd *DetectData) bool {
+// A path that starts with an AS_SET has no first peer, as its members are not ordered
+func (d *Detector) isAnomlousPeer(r *Rule, dd *DetectData) []*Alert {
 
-	if dd.Paths[0] != dd.PeerAs {
-		country := asNames.Country(uint32(dd.Paths[0]))
+	firstAs, ok := dd.AsPath.First()
+	if ok == true && firstAs != dd.PeerAs {
+		country := asNames.Country(uint32(firstAs))
 
-		printAlert(PriorityHigh, dd.Timestamp.String(), dd.PeerAs, convertAsPath(dd.Paths), "Rogue First Peer",
-			fmt.Sprintf("First Peer: %d (%s)", dd.Paths[0], country))
-		return true
+		return []*Alert{NewAlert(dd, PriorityHigh, ReasonRogueFirstPeer, prefixStrings(dd.NLRI),
+			map[string]string{"first_peer": fmt.Sprintf("%d", firstAs), "first_peer_country": country})}
 	}
 
-	return false
+	return nil
+}
+
+// isMassWithdrawal checks whether a large share (threshold percent) of the peers
+// (at least min_peers) that have seen one of our prefixes have withdrawn it within
+// the window (minutes), which indicates an outage (or the clean up of a route leak)
+func (d *Detector) isMassWithdrawal(r *Rule, dd *DetectData) []*Alert {
+
+	var prefix string
+	var withdrawn int
+	var total int
+	alerts := make([]*Alert, 0)
+
+	window := time.Duration(r.Threshold("window")) * time.Minute
+
+	for _, w := range dd.Withdrawn {
+		prefix = w.String()
+
+		withdrawn, total = routeState.Withdrawals(prefix, dd.Timestamp.Add(-window))
+		if total < r.Threshold("min_peers") {
+			continue
+		}
+
+		if withdrawn*100 < total*r.Threshold("threshold") {
+			routeState.ClearWithdrawalAlert(prefix)
+			continue
+		}
+
+		// Only alert once per withdrawal event
+		if routeState.SetWithdrawalAlert(prefix) == false {
+			continue
+		}
+
+		alerts = append(alerts, NewAlert(dd, PriorityHigh, ReasonMassWithdrawal, []string{prefix},
+			map[string]string{"withdrawn_peers": fmt.Sprintf("%d/%d", withdrawn, total)}))
+	}
+
+	return alerts
 }
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Structs ##############################################################
+
+// detectorFixture is a set of updates, the history, AS relationships (CAIDA
+// format), VRP's (CSV format), known neighbours, rule changes and monitoring
+// profiles they are detected against and the exact alerts that they should raise
+type detectorFixture struct {
+	Name          string
+	History       map[uint32]map[string]uint64
+	Relationships string
+	Vrps          string
+	Neighbours    []uint32
+	Rules         []RuleConfig
+	Profiles      []ProfileConfig
+	Updates       []testUpdate
+	Expected      []string
+}
+
+// ##### Methods ##############################################################
+
+// testCountries are the AS countries used by all of the fixtures
+var testCountries = map[uint32]string{
+	174:   "US",
+	3356:  "US",
+	15169: "US",
+	1299:  "SE",
+	4134:  "CN",
+	4809:  "CN",
+	37282: "NG",
+	64496: "US",
+	64666: "RU",
+}
+
+// customerProfile is a profile for a customer's AS and prefix, that monitors a
+// different country and has a known upstream
+var customerProfile = ProfileConfig{
+	Name:                "customer",
+	TargetAs:            []uint32{64496},
+	Prefixes:            []string{"198.51.100.0/24"},
+	NeighbourPeers:      []uint32{174},
+	MonitorCountryCodes: []string{"SE"},
+}
+
+// knownPath is a history in which the peer has frequently used the path
+func knownPath(peerAs uint32, path string) map[uint32]map[string]uint64 {
+
+	return map[uint32]map[string]uint64{peerAs: {path: 20}}
+}
+
+func TestDetector(t *testing.T) {
+
+	fixtures := []detectorFixture{
+		{
+			Name:    "prefix hijack",
+			History: knownPath(3356, "3356 64666"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"192.104.160.0/23"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"2001:4860::/32"}},
+			},
+			Expected: []string{
+				"High invalid_prefix_peer AS3356 [192.104.160.0/23] path [3356 64666]",
+				"High invalid_prefix_peer AS3356 [2001:4860::/32] path [3356 64666]",
+			},
+		},
+		{
+			Name:    "sub-prefix hijack",
+			History: knownPath(3356, "3356 64666"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"192.104.160.0/24", "192.104.161.0/24"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"2001:4860:4860::/48"}},
+			},
+			Expected: []string{
+				"High sub_prefix_hijack AS3356 [192.104.160.0/24] path [3356 64666] monitored_prefix=192.104.160.0/23",
+				"High sub_prefix_hijack AS3356 [192.104.161.0/24] path [3356 64666] monitored_prefix=192.104.160.0/23",
+				"High sub_prefix_hijack AS3356 [2001:4860:4860::/48] path [3356 64666] monitored_prefix=2001:4860::/32",
+			},
+		},
+		{
+			Name:    "covering prefix",
+			History: knownPath(3356, "3356 64666"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"192.104.0.0/16"}},
+			},
+			Expected: []string{
+				"Medium covering_prefix AS3356 [192.104.0.0/16] path [3356 64666] monitored_prefix=192.104.160.0/23",
+			},
+		},
+		{
+			Name:    "route leak through a monitored country",
+			History: knownPath(3356, "3356 4134 15169"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 4134, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High monitored_country AS3356 [192.104.160.0/23] path [3356 4134 15169] external_as=4134 external_country=CN internal_route=US",
+			},
+		},
+		{
+			Name:       "route through an unmonitored country",
+			Neighbours: []uint32{1299},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 1299, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 1299 15169]",
+			},
+		},
+		{
+			Name:       "first appearance",
+			Neighbours: []uint32{174},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 174 15169]",
+			},
+		},
+		{
+			Name:       "2-byte path",
+			Neighbours: []uint32{174},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, TwoByte: true, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 174 15169]",
+			},
+		},
+		{
+			Name:       "2-byte path with an AS4_PATH",
+			Neighbours: []uint32{174},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 23456, 15169}, TwoByte: true,
+					As4Path: []uint32{174, 4200000001, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 174 4200000001 15169]",
+				"High new_adjacency AS3356 [192.104.160.0/23] path [3356 174 4200000001 15169] neighbour_as=4200000001 neighbour_country= target_as=15169",
+			},
+		},
+		{
+			Name:    "new adjacency",
+			History: knownPath(3356, "3356 174 15169"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64500, 15169, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 64500 15169 15169]",
+				"High new_adjacency AS3356 [192.104.160.0/23] path [3356 64500 15169 15169] neighbour_as=64500 neighbour_country= target_as=15169",
+			},
+		},
+		{
+			Name:       "known neighbour",
+			Neighbours: []uint32{64500},
+			History:    knownPath(3356, "3356 174 15169"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64500, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 64500 15169]",
+			},
+		},
+		{
+			Name:    "new path through a known upstream",
+			History: knownPath(3356, "3356 174 15169"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 1299, PeerIP: testPeerIP(0), Path: []uint32{1299, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS1299 [192.104.160.0/23] path [1299 174 15169]",
+			},
+		},
+		{
+			Name:    "low frequency",
+			History: map[uint32]map[string]uint64{3356: {"3356 174 15169": 3}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High low_frequency AS3356 [192.104.160.0/23] path [3356 174 15169]",
+			},
+		},
+		{
+			Name:    "moderate frequency at the low frequency threshold",
+			History: map[uint32]map[string]uint64{3356: {"3356 174 15169": 5}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High moderate_frequency AS3356 [192.104.160.0/23] path [3356 174 15169]",
+			},
+		},
+		{
+			Name:    "configured frequency thresholds",
+			History: knownPath(3356, "3356 174 15169"),
+			Rules:   []RuleConfig{{Name: "path_frequency", Thresholds: map[string]int{"low_frequency": 30}}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High low_frequency AS3356 [192.104.160.0/23] path [3356 174 15169]",
+			},
+		},
+		{
+			Name:       "disabled rule",
+			Neighbours: []uint32{174},
+			Rules:      []RuleConfig{{Name: "path_frequency", Enabled: &disabled}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+		},
+		{
+			Name:    "rule priority",
+			History: knownPath(3356, "3356 64666"),
+			Rules:   []RuleConfig{{Name: "prefix_hijack", Priority: "low"}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"192.104.0.0/16"}},
+			},
+			Expected: []string{
+				"Low covering_prefix AS3356 [192.104.0.0/16] path [3356 64666] monitored_prefix=192.104.160.0/23",
+			},
+		},
+		{
+			Name:       "rule outside of its scope",
+			Neighbours: []uint32{174},
+			Rules:      []RuleConfig{{Name: "path_frequency", As: []uint32{64496}, Prefixes: []string{"198.51.100.0/24"}}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+		},
+		{
+			Name:       "rule within its prefix scope",
+			Neighbours: []uint32{174},
+			Rules:      []RuleConfig{{Name: "path_frequency", As: []uint32{64496}, Prefixes: []string{"192.104.160.0/24"}}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 174 15169]",
+			},
+		},
+		{
+			Name:    "known path",
+			History: knownPath(3356, "3356 174 15169"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+		},
+		{
+			Name:    "rogue first peer",
+			History: knownPath(3356, "174 15169"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High rogue_first_peer AS3356 [192.104.160.0/23] path [174 15169] first_peer=174 first_peer_country=US",
+			},
+		},
+		{
+			Name:          "route leak between peers",
+			History:       knownPath(3356, "3356 4809 37282 15169"),
+			Relationships: "15169|37282|0\n37282|4809|0\n3356|4809|0",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 4809, 37282, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High monitored_country AS3356 [192.104.160.0/23] path [3356 4809 37282 15169] external_as=4809 external_country=CN internal_route=US",
+				"High route_leak AS3356 [192.104.160.0/23] path [3356 4809 37282 15169] leaking_as=37282 learned_from=15169 learned_from_relationship=peer sent_to=4809 sent_to_relationship=peer",
+			},
+		},
+		{
+			Name:          "route leak from a provider to a provider",
+			History:       knownPath(3356, "3356 64500 174 15169"),
+			Relationships: "174|15169|-1\n174|64500|-1\n3356|64500|-1",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64500, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High route_leak AS3356 [192.104.160.0/23] path [3356 64500 174 15169] leaking_as=64500 learned_from=174 learned_from_relationship=provider sent_to=3356 sent_to_relationship=provider",
+			},
+		},
+		{
+			Name:          "AS_SET members are not adjacent",
+			Relationships: "15169|37282|0\n37282|4809|0\n3356|4809|0",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Segments: []AsPathSegment{
+					{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{3356}},
+					{Type: bgp.BGP_ASPATH_ATTR_TYPE_SET, AS: []uint32{4809, 37282}},
+					{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{15169}},
+				}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 {4809,37282} 15169]",
+			},
+		},
+		{
+			Name: "path starting with an AS_SET",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Segments: []AsPathSegment{
+					{Type: bgp.BGP_ASPATH_ATTR_TYPE_SET, AS: []uint32{174, 3356}},
+					{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{15169}},
+				}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [192.104.160.0/23] path [{174,3356} 15169]",
+			},
+		},
+		{
+			Name:          "valley-free path",
+			History:       knownPath(3356, "3356 174 174 15169"),
+			Relationships: "174|15169|-1\n3356|174|0",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 174, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+		},
+		{
+			Name:     "profile prefix hijack",
+			Profiles: []ProfileConfig{customerProfile},
+			History:  knownPath(3356, "3356 64666"),
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"198.51.100.0/24"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64496}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High invalid_prefix_peer AS3356 [198.51.100.0/24] path [3356 64666] profiles=customer",
+				"High invalid_prefix_peer AS3356 [192.104.160.0/23] path [3356 64496]",
+				"High first_appearance AS3356 [192.104.160.0/23] path [3356 64496] profiles=customer",
+				"High new_adjacency AS3356 [192.104.160.0/23] path [3356 64496] neighbour_as=3356 neighbour_country=US target_as=64496 profiles=customer",
+			},
+		},
+		{
+			Name:     "profile monitored country",
+			Profiles: []ProfileConfig{customerProfile},
+			History:  map[uint32]map[string]uint64{3356: {"3356 1299 64496": 20, "3356 1299 15169": 20}},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 1299, 64496}, Announced: []string{"198.51.100.0/24"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 1299, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{
+				"High monitored_country AS3356 [198.51.100.0/24] path [3356 1299 64496] external_as=1299 external_country=SE internal_route=US profiles=customer",
+			},
+		},
+		{
+			Name:     "profile expected upstream",
+			Profiles: []ProfileConfig{customerProfile},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 64496}, Announced: []string{"198.51.100.0/24"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64500, 64496}, Announced: []string{"198.51.100.0/24"}},
+			},
+			Expected: []string{
+				"High first_appearance AS3356 [198.51.100.0/24] path [3356 174 64496] profiles=customer",
+				"High first_appearance AS3356 [198.51.100.0/24] path [3356 64500 64496] profiles=customer",
+				"High new_adjacency AS3356 [198.51.100.0/24] path [3356 64500 64496] neighbour_as=64500 neighbour_country= target_as=64496 profiles=customer",
+			},
+		},
+		{
+			Name: "profile rules",
+			Profiles: []ProfileConfig{
+				{Name: "customer", TargetAs: []uint32{64496}, Prefixes: []string{"198.51.100.0/24"}, Rules: []string{"prefix_hijack"}},
+			},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 174, 64496}, Announced: []string{"198.51.100.0/24"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"198.51.100.0/25"}},
+			},
+			Expected: []string{
+				"High sub_prefix_hijack AS3356 [198.51.100.0/25] path [3356 64666] monitored_prefix=198.51.100.0/24 profiles=customer",
+			},
+		},
+		{
+			Name: "alert owned by more than one profile",
+			Profiles: []ProfileConfig{
+				customerProfile,
+				{Name: "noc", Prefixes: []string{"198.51.100.0/22"}, Rules: []string{"prefix_hijack"}},
+			},
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"198.51.100.0/24"}},
+			},
+			Expected: []string{
+				"High invalid_prefix_peer AS3356 [198.51.100.0/24] path [3356 64666] profiles=customer,noc",
+				"High sub_prefix_hijack AS3356 [198.51.100.0/24] path [3356 64666] monitored_prefix=198.51.100.0/22 profiles=customer,noc",
+				"High first_appearance AS3356 [198.51.100.0/24] path [3356 64666] profiles=customer",
+			},
+		},
+		{
+			Name:    "rpki invalid origin",
+			History: knownPath(3356, "3356 15169"),
+			Vrps:    "ASN,IP Prefix,Max Length,Trust Anchor\nAS64666,192.104.160.0/23,24,arin\n",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+			Expected: []string{"High rpki_invalid AS3356 [192.104.160.0/23] path [3356 15169] roas=192.104.160.0/23-24 AS64666"},
+		},
+		{
+			Name:    "rpki valid origin",
+			History: knownPath(3356, "3356 15169"),
+			Vrps:    "ASN,IP Prefix,Max Length,Trust Anchor\nAS15169,192.104.160.0/23,24,arin\n",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 15169}, Announced: []string{"192.104.160.0/23"}},
+			},
+		},
+		{
+			Name: "unrelated prefix and origin",
+			Updates: []testUpdate{
+				{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"198.51.100.0/24"}},
+				{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Withdrawn: []string{"198.51.100.0/24"}},
+			},
+		},
+	}
+
+	for _, f := range fixtures {
+		t.Run(f.Name, func(t *testing.T) {
+
+			newTestEnvironment(t, testCountries, "CN", "RU")
+			err := asRelationships.Read(strings.NewReader(f.Relationships))
+			if err != nil {
+				t.Fatalf("invalid AS relationships: %v", err)
+			}
+			if f.Vrps != "" {
+				filePath := filepath.Join(t.TempDir(), "vrps.csv")
+				err = ioutil.WriteFile(filePath, []byte(f.Vrps), 0660)
+				if err != nil {
+					t.Fatalf("error writing VRP file: %v", err)
+				}
+				err = roaTable.Load(filePath)
+				if err != nil {
+					t.Fatalf("invalid VRPs: %v", err)
+				}
+			}
+			for as, routes := range f.History {
+				for route, count := range routes {
+					setTestRoute(t, as, route, count)
+				}
+			}
+			for _, as := range f.Neighbours {
+				config.NeighbourPeers[as] = struct{}{}
+			}
+			config.Rules = f.Rules
+			config.Profiles = f.Profiles
+			history.SetKnownAdjacencies(neighbourAdjacencies(config))
+
+			assertAlerts(t, detectUpdates(t, f.Updates), f.Expected...)
+		})
+	}
+}
+
+// TestDetectorMassWithdrawal checks that the withdrawal of one of our prefixes
+// by half of the peers that announced it raises a single alert. The route state
+// is updated as the file is parsed, so only the threshold number of peers withdraw
+// to keep the peer counts the same however far the parser is ahead of detection
+func TestDetectorMassWithdrawal(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+	setTestRoute(t, 3356, "3356 15169", 20)
+
+	updates := make([]testUpdate, 0)
+	for i := 0; i < 4; i++ {
+		updates = append(updates, testUpdate{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(i),
+			Path: []uint32{3356, 15169}, Announced: []string{"192.104.160.0/23"}})
+	}
+	for i := 0; i < 2; i++ {
+		updates = append(updates, testUpdate{Timestamp: testTime(1 + i), PeerAs: 3356, PeerIP: testPeerIP(i),
+			Withdrawn: []string{"192.104.160.0/23"}})
+	}
+
+	assertAlerts(t, detectUpdates(t, updates),
+		"High mass_withdrawal AS3356 [192.104.160.0/23] path [] withdrawn_peers=2/4")
+}
+
+// TestDetectorProfileSinks checks that the alert sinks of a profile only receive
+// the alerts tagged with the profile, while the global sinks receive them all
+func TestDetectorProfileSinks(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+	config.Profiles = []ProfileConfig{customerProfile}
+
+	detector := NewDetector(config)
+	sink := new(testSink)
+	detector.AddAlertSink(sink, PriorityLow)
+
+	profileSink := new(testSink)
+	for _, p := range detector.profiles {
+		if p.Name == "customer" {
+			p.sinks = append(p.sinks, &alertSinkFilter{sink: profileSink, minPriority: PriorityHigh})
+		}
+	}
+
+	dd := &DetectData{PeerAs: 3356, PathsString: "3356 64666"}
+	tagged := NewAlert(dd, PriorityHigh, ReasonInvalidPrefixPeer, []string{"198.51.100.0/24"}, nil)
+	tagged.Profiles = append(tagged.Profiles, "customer")
+	low := NewAlert(dd, PriorityLow, ReasonInvalidPrefixPeer, []string{"198.51.100.0/24"}, nil)
+	low.Profiles = append(low.Profiles, "customer")
+	untagged := NewAlert(dd, PriorityHigh, ReasonInvalidPrefixPeer, []string{"192.104.160.0/23"}, nil)
+
+	for _, a := range []*Alert{tagged, low, untagged} {
+		detector.dispatch(a)
+	}
+	detector.Close()
+
+	if len(sink.Alerts()) != 3 {
+		t.Errorf("expected 3 alerts in the global sink, got %d", len(sink.Alerts()))
+	}
+	assertAlerts(t, profileSink.Alerts(),
+		"High invalid_prefix_peer AS3356 [198.51.100.0/24] path [3356 64666] profiles=customer")
+}
+
+// TestDetectorCollect checks that a detector that collects the paths adds them
+// to the history once they have been detected against, so a repeated path is
+// no longer a first appearance
+func TestDetectorCollect(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+
+	filePath := filepath.Join(t.TempDir(), "updates.20181112.0805.gz")
+	writeMrtFile(t, filePath, []testUpdate{
+		{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 15169}, Announced: []string{"192.104.160.0/23"}},
+		{Timestamp: testTime(1), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 15169}, Announced: []string{"192.104.160.0/23"}},
+	})
+
+	sink := new(testSink)
+	detector := NewDetector(config)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.SetCollect(true)
+	detector.StartInOrder()
+
+	err := new(MrtParser).ParseAndDetect(detector, TEST_COLLECTOR, filePath)
+	if err != nil {
+		t.Fatalf("error parsing MRT file: %v", err)
+	}
+	detector.Wait()
+	detector.Close()
+
+	assertAlerts(t, sink.Alerts(),
+		"High first_appearance AS3356 [192.104.160.0/23] path [3356 15169]",
+		"High new_adjacency AS3356 [192.104.160.0/23] path [3356 15169] neighbour_as=3356 neighbour_country=US target_as=15169",
+		"High low_frequency AS3356 [192.104.160.0/23] path [3356 15169]")
+
+	if count := history.GetRouteCount(3356, "3356 15169"); count != 2 {
+		t.Errorf("expected both updates to be added to the history, count %d", count)
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 //
 type AlertPriority int
 
@@ -24,3 +29,24 @@ func (ap AlertPriority) String() string {
 		return "Unknown"
 	}
 }
+
+// MarshalJSON outputs the priority as its name e.g. "High"
+func (ap AlertPriority) MarshalJSON() ([]byte, error) {
+
+	return []byte(`"` + ap.String() + `"`), nil
+}
+
+// parseAlertPriority converts a priority name e.g. "medium" into an AlertPriority
+func parseAlertPriority(data string) (AlertPriority, error) {
+
+	switch strings.ToLower(strings.TrimSpace(data)) {
+	case "high":
+		return PriorityHigh, nil
+	case "medium":
+		return PriorityMedium, nil
+	case "low", "":
+		return PriorityLow, nil
+	default:
+		return PriorityLow, fmt.Errorf("invalid priority: %s", data)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+	mrt "github.com/osrg/gobgp/pkg/packet/mrt"
+)
+
+// ##### Constants ############################################################
+
+// The AS, prefixes and collector used by the test environment
+const TEST_TARGET_AS uint32 = 15169
+const TEST_PREFIX_V4 string = "192.104.160.0/23"
+const TEST_PREFIX_V6 string = "2001:4860::/32"
+const TEST_COLLECTOR string = "TEST"
+
+// ##### Structs ##############################################################
+
+// testUpdate is a single BGP update, as seen by a collector peer, to be written to an MRT file
+type testUpdate struct {
+	Timestamp time.Time
+	PeerAs    uint32
+	PeerIP    string
+	Path      []uint32
+	Segments  []AsPathSegment
+	Announced []string
+	Withdrawn []string
+	// TwoByte sends the path as a 2-byte AS_PATH, as a speaker without 4-byte AS
+	// support would, with As4Path (if any) as the AS4_PATH. The AS's of the path
+	// that do not fit in 2-bytes should be AS_TRANS
+	TwoByte bool
+	As4Path []uint32
+}
+
+// testRib is a prefix of a RIB snapshot and its routes
+type testRib struct {
+	Prefix  string
+	Entries []testRibEntry
+}
+
+// testRibEntry is a route of a RIB snapshot, from the peer at the index of the peer index table
+type testRibEntry struct {
+	PeerIndex uint16
+	Path      []uint32
+}
+
+// testSink keeps the alerts that it receives in memory
+type testSink struct {
+	mux    sync.Mutex
+	alerts []*Alert
+}
+
+// ##### Methods ##############################################################
+
+func (s *testSink) Name() string {
+
+	return "test"
+}
+
+func (s *testSink) Send(alert *Alert) error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.alerts = append(s.alerts, alert)
+	return nil
+}
+
+func (s *testSink) Close() error {
+
+	return nil
+}
+
+// Alerts returns the alerts received so far
+func (s *testSink) Alerts() []*Alert {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return append([]*Alert{}, s.alerts...)
+}
+
+// newTestEnvironment resets the globals used by detection: our AS and
+// prefixes, an empty history and route state, no ROAs and the AS countries
+func newTestEnvironment(t *testing.T, countries map[uint32]string, monitorCountryCodes ...string) {
+
+	t.Helper()
+
+	config = &Config{
+		DataSets:            map[string]string{TEST_COLLECTOR: "http://localhost/"},
+		MonitorCountryCodes: make(map[string]struct{}),
+		TargetAs:            map[uint32]struct{}{TEST_TARGET_AS: {}},
+		NeighbourPeers:      make(map[uint32]struct{}),
+		WithdrawalThreshold: 50,
+		WithdrawalWindow:    5,
+		WithdrawalMinPeers:  3,
+	}
+
+	for _, p := range []string{TEST_PREFIX_V4, TEST_PREFIX_V6} {
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			t.Fatalf("invalid test prefix: %v", err)
+		}
+		config.Prefixes = append(config.Prefixes, prefix)
+	}
+
+	for _, cc := range monitorCountryCodes {
+		config.MonitorCountryCodes[cc] = struct{}{}
+	}
+
+	asNames = NewAsNames()
+	for as, cc := range countries {
+		asNames.names[as] = &AsName{Name: fmt.Sprintf("AS%d", as), Country: cc}
+	}
+
+	history = NewHistory(90, nil)
+	routeState = NewRouteState()
+	roaTable = NewRoaTable()
+	asRelationships = NewAsRelationships()
+}
+
+// writeMrtFile writes the updates to a gzipped MRT (BGP4MP) file, IPv6
+// prefixes are carried in the MP_REACH_NLRI/MP_UNREACH_NLRI attributes
+func writeMrtFile(t *testing.T, filePath string, updates []testUpdate) {
+
+	t.Helper()
+
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+
+	for _, u := range updates {
+		nlri := make([]*bgp.IPAddrPrefix, 0)
+		withdrawn := make([]*bgp.IPAddrPrefix, 0)
+		nlri6 := make([]bgp.AddrPrefixInterface, 0)
+		withdrawn6 := make([]bgp.AddrPrefixInterface, 0)
+
+		for _, p := range u.Announced {
+			prefix := mustParsePrefix(t, p)
+			if v4, ok := prefix.(*bgp.IPAddrPrefix); ok == true {
+				nlri = append(nlri, v4)
+			} else {
+				nlri6 = append(nlri6, prefix)
+			}
+		}
+
+		for _, p := range u.Withdrawn {
+			prefix := mustParsePrefix(t, p)
+			if v4, ok := prefix.(*bgp.IPAddrPrefix); ok == true {
+				withdrawn = append(withdrawn, v4)
+			} else {
+				withdrawn6 = append(withdrawn6, prefix)
+			}
+		}
+
+		// The path is a single AS_SEQUENCE, unless the segments are supplied
+		params := []bgp.AsPathParamInterface{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, u.Path)}
+		if len(u.Segments) > 0 {
+			params = make([]bgp.AsPathParamInterface, 0, len(u.Segments))
+			for _, s := range u.Segments {
+				params = append(params, bgp.NewAs4PathParam(s.Type, s.AS))
+			}
+		}
+
+		if u.TwoByte == true {
+			as := make([]uint16, len(u.Path))
+			for i, a := range u.Path {
+				as[i] = uint16(a)
+			}
+			params = []bgp.AsPathParamInterface{bgp.NewAsPathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, as)}
+		}
+
+		attrs := make([]bgp.PathAttributeInterface, 0)
+		if len(u.Announced) > 0 {
+			attrs = append(attrs, bgp.NewPathAttributeOrigin(bgp.BGP_ORIGIN_ATTR_TYPE_IGP),
+				bgp.NewPathAttributeAsPath(params))
+			if len(u.As4Path) > 0 {
+				attrs = append(attrs, bgp.NewPathAttributeAs4Path(
+					[]*bgp.As4PathParam{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, u.As4Path)}))
+			}
+			if len(nlri) > 0 {
+				attrs = append(attrs, bgp.NewPathAttributeNextHop(u.PeerIP))
+			}
+			if len(nlri6) > 0 {
+				attrs = append(attrs, bgp.NewPathAttributeMpReachNLRI("2001:db8::1", nlri6))
+			}
+		}
+		if len(withdrawn6) > 0 {
+			attrs = append(attrs, bgp.NewPathAttributeMpUnreachNLRI(withdrawn6))
+		}
+
+		msg := bgp.NewBGPUpdateMessage(withdrawn, attrs, nlri)
+		subtype := mrt.MESSAGE_AS4
+		if u.TwoByte == true {
+			subtype = mrt.MESSAGE
+		}
+		body := mrt.NewBGP4MPMessage(u.PeerAs, 64512, 0, u.PeerIP, "192.0.2.254", subtype == mrt.MESSAGE_AS4, msg)
+
+		mrtMsg, err := mrt.NewMRTMessage(uint32(u.Timestamp.Unix()), mrt.BGP4MP, subtype, body)
+		if err != nil {
+			t.Fatalf("error creating MRT message: %v", err)
+		}
+
+		data, err := mrtMsg.Serialize()
+		if err != nil {
+			t.Fatalf("error serialising MRT message: %v", err)
+		}
+
+		gzipWriter.Write(data)
+	}
+
+	err := gzipWriter.Close()
+	if err == nil {
+		err = ioutil.WriteFile(filePath, buffer.Bytes(), 0660)
+	}
+	if err != nil {
+		t.Fatalf("error writing MRT file: %v", err)
+	}
+}
+
+// writeRibFile writes the RIB to a gzipped MRT (TABLE_DUMP_V2) file, with a peer
+// index table of the peer AS's, the peer at each index using testPeerIP(index)
+func writeRibFile(t *testing.T, filePath string, peerAs []uint32, ribs []testRib) {
+
+	t.Helper()
+
+	var buffer bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buffer)
+
+	write := func(subtype mrt.MRTSubTypeTableDumpv2, body mrt.Body) {
+		mrtMsg, err := mrt.NewMRTMessage(uint32(testTime(0).Unix()), mrt.TABLE_DUMPv2, subtype, body)
+		if err != nil {
+			t.Fatalf("error creating MRT message: %v", err)
+		}
+
+		data, err := mrtMsg.Serialize()
+		if err != nil {
+			t.Fatalf("error serialising MRT message: %v", err)
+		}
+
+		gzipWriter.Write(data)
+	}
+
+	peers := make([]*mrt.Peer, len(peerAs))
+	for i, as := range peerAs {
+		peers[i] = mrt.NewPeer("192.0.2.1", testPeerIP(i), as, true)
+	}
+	write(mrt.PEER_INDEX_TABLE, mrt.NewPeerIndexTable("192.0.2.254", "", peers))
+
+	for i, r := range ribs {
+		entries := make([]*mrt.RibEntry, len(r.Entries))
+		for j, e := range r.Entries {
+			entries[j] = mrt.NewRibEntry(e.PeerIndex, uint32(testTime(0).Unix()), 0, []bgp.PathAttributeInterface{
+				bgp.NewPathAttributeOrigin(bgp.BGP_ORIGIN_ATTR_TYPE_IGP),
+				bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, e.Path)}),
+			}, false)
+		}
+
+		prefix := mustParsePrefix(t, r.Prefix)
+		if _, ok := prefix.(*bgp.IPv6AddrPrefix); ok == true {
+			write(mrt.RIB_IPV6_UNICAST, mrt.NewRib(uint32(i), prefix, entries))
+		} else {
+			write(mrt.RIB_IPV4_UNICAST, mrt.NewRib(uint32(i), prefix, entries))
+		}
+	}
+
+	err := gzipWriter.Close()
+	if err == nil {
+		err = ioutil.WriteFile(filePath, buffer.Bytes(), 0660)
+	}
+	if err != nil {
+		t.Fatalf("error writing MRT file: %v", err)
+	}
+}
+
+// detectUpdates writes the updates to an MRT file, parses it through a detector
+// (without incident aggregation) and returns the alerts that were raised
+func detectUpdates(t *testing.T, updates []testUpdate) []*Alert {
+
+	t.Helper()
+
+	filePath := filepath.Join(t.TempDir(), "updates.20181112.0805.gz")
+	writeMrtFile(t, filePath, updates)
+
+	sink := new(testSink)
+	detector := NewDetector(config)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.StartInOrder()
+
+	err := new(MrtParser).ParseAndDetect(detector, TEST_COLLECTOR, filePath)
+	if err != nil {
+		t.Fatalf("error parsing MRT file: %v", err)
+	}
+
+	detector.Wait()
+	detector.Close()
+
+	return sink.Alerts()
+}
+
+// assertAlerts checks that the alerts are exactly those expected, in any order.
+// Each alert is compared in the form returned by alertKey
+func assertAlerts(t *testing.T, alerts []*Alert, expected ...string) {
+
+	t.Helper()
+
+	actual := make([]string, len(alerts))
+	for i, a := range alerts {
+		actual[i] = alertKey(a)
+	}
+	sort.Strings(actual)
+	sort.Strings(expected)
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected alerts\nexpected:\n  %s\nactual:\n  %s",
+			strings.Join(expected, "\n  "), strings.Join(actual, "\n  "))
+	}
+}
+
+// alertKey returns the alert, and the profiles it is tagged with, as a single comparable line e.g.
+// "High sub_prefix_hijack AS3356 [192.104.160.0/24] path [3356 64666] monitored_prefix=192.104.160.0/23"
+func alertKey(a *Alert) string {
+
+	keys := make([]string, 0, len(a.Metadata))
+	for k := range a.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	metadata := make([]string, 0, len(keys))
+	for _, k := range keys {
+		metadata = append(metadata, k+"="+a.Metadata[k])
+	}
+
+	if len(a.Profiles) > 0 {
+		metadata = append(metadata, "profiles="+strings.Join(a.Profiles, ","))
+	}
+
+	return strings.TrimSpace(fmt.Sprintf("%s %s AS%d [%s] path [%s] %s",
+		a.Priority, string(a.Reason), a.PeerAs, strings.Join(a.Prefixes, " "), a.Path, strings.Join(metadata, " ")))
+}
+
+// mustParsePrefix parses the prefix, failing the test if it is invalid
+func mustParsePrefix(t *testing.T, data string) bgp.AddrPrefixInterface {
+
+	t.Helper()
+
+	prefix, err := parsePrefix(data)
+	if err != nil {
+		t.Fatalf("invalid prefix: %v", err)
+	}
+
+	return prefix
+}
+
+// setTestRoute sets the number of uses of the route (AS_SEQUENCE only) by the
+// peer in the history, and of its adjacencies, as if collected from update files
+func setTestRoute(t *testing.T, peerAs uint32, route string, count uint64) {
+
+	t.Helper()
+
+	path := make([]uint32, 0)
+	for _, f := range strings.Fields(route) {
+		as, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			t.Fatalf("invalid test route: %s", route)
+		}
+		path = append(path, uint32(as))
+	}
+
+	history.SetCount(peerAs, route, count, testTime(0))
+
+	asPath := newAsPathFromSegments([]AsPathSegment{{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: path}})
+	for _, a := range asPath.Adjacencies() {
+		history.SetAdjacencyCount(a, history.GetAdjacencyCount(a)+count, testTime(0))
+	}
+}
+
+// testTime returns a fixed time, offset by the number of minutes
+func testTime(minutes int) time.Time {
+
+	return time.Date(2018, 11, 12, 8, 5, 0, 0, time.UTC).Add(time.Duration(minutes) * time.Minute)
+}
+
+// testPeerIP returns a distinct collector peer address for the index
+func testPeerIP(index int) string {
+
+	return net.IPv4(192, 0, 2, byte(index+1)).String()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"compress/gzip"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -10,6 +11,7 @@ import (
 	"github.com/PuerkitoBio/goquery"
 	color "github.com/labstack/gommon/color"
 	"github.com/matryer/try"
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
 	util "github.com/woanware/goutil"
 )
 
@@ -118,6 +120,72 @@ func downloadUpdateFile(name string, url string, year int, month int, href strin
 	return err
 }
 
+// getBviewFile returns the name of the most recent RIB dump (bview) file listed
+// on the year/month page, or an empty string if there are none
+func getBviewFile(url string, year int, month int) (string, error) {
+
+	latest := ""
+
+	fmt.Println(fmt.Sprintf("Downloading bview page: %s%v.%02d", url, year, month))
+	doc, err := goquery.NewDocument(fmt.Sprintf("%s%v.%02d", url, year, month))
+	if err != nil {
+		return latest, fmt.Errorf("Error downloading bview page (%s): %v\n", fmt.Sprintf("%s%v.%v", url, year, month), err)
+	}
+
+	// The file names contain the dump time e.g. bview.20181201.0800.gz, so the last is the latest
+	doc.Find("a[href]").Each(func(index int, item *goquery.Selection) {
+
+		href, _ := item.Attr("href")
+
+		if strings.HasPrefix(href, "bview.") == false {
+			return
+		}
+
+		if href > latest {
+			latest = href
+		}
+	})
+
+	return latest, nil
+}
+
+// Performs the actual RIB dump (bview) file downloading, the files are stored
+// in a "bview" directory for the data set rather than the year/month directories
+func downloadBviewFile(name string, url string, year int, month int, href string) error {
+
+	for _, dir := range []string{"./cache", "./temp"} {
+		if util.DoesDirExist(fmt.Sprintf("%s/%s/bview", dir, name)) == false {
+			err := os.MkdirAll(fmt.Sprintf("%s/%s/bview", dir, name), 0770)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := try.Do(func(attempt int) (bool, error) {
+		var err error
+
+		err = util.DownloadToFile(fmt.Sprintf("%s/%d.%02d/%s", url, year, month, href), fmt.Sprintf("./temp/%s/bview/%s", name, href))
+
+		if err == nil {
+			err = validateGzipFile(fmt.Sprintf("./temp/%s/bview/%s", name, href))
+			if err == nil {
+				err = os.Rename(fmt.Sprintf("./temp/%s/bview/%s", name, href), fmt.Sprintf("./cache/%s/bview/%s", name, href))
+				if err != nil {
+					fmt.Printf("Error moving temp bview file to cache (%s): %v\n", href, err)
+				}
+				return false, err
+			}
+
+			os.Remove(fmt.Sprintf("./temp/%s/bview/%s", name, href))
+		}
+
+		return attempt < 3, err // try 3 times
+	})
+
+	return err
+}
+
 // convertAsPath returns the integer value path route as a string
 func convertAsPath(path []uint32) string {
 
@@ -131,17 +199,79 @@ func convertAsPath(path []uint32) string {
 	return string(temp)
 }
 
+// parsePrefix converts a CIDR string (IPv4 or IPv6) into an IPAddrPrefix/IPv6AddrPrefix (from bgp lib)
+func parsePrefix(data string) (bgp.AddrPrefixInterface, error) {
+
+	parts := strings.Split(strings.TrimSpace(data), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid prefix: %s", data)
+	}
+
+	ip := net.ParseIP(parts[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid prefix address: %s", parts[0])
+	}
+
+	bit, err := util.ConvertStringToUint8(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix bit: %s", parts[1])
+	}
+
+	if ip.To4() != nil {
+		if bit > 32 {
+			return nil, fmt.Errorf("invalid prefix bit: %s", parts[1])
+		}
+
+		return bgp.NewIPAddrPrefix(bit, parts[0]), nil
+	}
+
+	if bit > 128 {
+		return nil, fmt.Errorf("invalid prefix bit: %s", parts[1])
+	}
+
+	return bgp.NewIPv6AddrPrefix(bit, parts[0]), nil
+}
+
+// parseAs converts an AS number, optionally prefixed with "AS", into a uint32.
+// 4-byte AS's can exceed the signed range used by util.ConvertStringToUint32
+func parseAs(data string) (uint32, error) {
+
+	as, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(data)), "AS"), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid AS: %s", data)
+	}
+
+	return uint32(as), nil
+}
+
+// prefixStrings returns the prefixes in their string form
+func prefixStrings(prefixes []bgp.AddrPrefixInterface) []string {
+
+	ret := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		ret[i] = p.String()
+	}
+
+	return ret
+}
+
 // printAlert prints a formatted, coloured message to StdOut
-func printAlert(ap AlertPriority, timestamp string, peerAs uint32, path string, reason string, data string) {
+func printAlert(alert *Alert) {
+
+	message := fmt.Sprintf("Timestamp: %s\nReason: %s\nPeer AS: %d\nPath: %s\nData: %s\n",
+		alert.Timestamp.String(), alert.Reason, alert.PeerAs, alert.Path, alert.Data())
+	if len(alert.Profiles) > 0 {
+		message += fmt.Sprintf("Profiles: %s\n", strings.Join(alert.Profiles, ", "))
+	}
 
-	switch ap {
+	switch alert.Priority {
 	case PriorityHigh:
-		color.Println(color.Red(fmt.Sprintf("Timestamp: %s\nReason: %s\nPeer AS: %d\nPath: %s\nData: %s\n", timestamp, reason, peerAs, path, data)))
+		color.Println(color.Red(message))
 
 	case PriorityMedium:
-		color.Println(color.Yellow(fmt.Sprintf("Timestamp: %s\nReason: %s\nPeer AS: %d\nPath: %s\nData: %s\n", timestamp, reason, peerAs, path, data)))
+		color.Println(color.Yellow(message))
 
 	case PriorityLow:
-		color.Println(color.Green(fmt.Sprintf("Timestamp: %s\nReason: %s\nPeer AS: %d\nPath: %s\nData: %s\n", timestamp, reason, peerAs, path, data)))
+		color.Println(color.Green(message))
 	}
 }
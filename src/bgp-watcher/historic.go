@@ -8,16 +8,19 @@ import (
 	"strings"
 	"sync"
 	"time"
+
+	util "github.com/woanware/goutil"
 )
 
 // ##### Structs ##############################################################
 
 //
 type Historic struct {
-	DataSets  map[string]string
-	Months    int
-	Processes int
-	detector  *Detector
+	DataSets     map[string]string
+	Months       int
+	Processes    int
+	RibBootstrap bool
+	detector     *Detector
 }
 
 // ##### Methods ##############################################################
@@ -26,10 +29,11 @@ type Historic struct {
 func NewHistoric(d *Detector, config *Config) *Historic {
 
 	return &Historic{
-		detector:  d,
-		DataSets:  config.DataSets,
-		Months:    config.HistoryMonths,
-		Processes: config.Processes,
+		detector:     d,
+		DataSets:     config.DataSets,
+		Months:       config.HistoryMonths,
+		Processes:    config.Processes,
+		RibBootstrap: config.RibBootstrap,
 	}
 }
 
@@ -59,9 +63,64 @@ func (h *Historic) Update() {
 	h.checkDirectories(ts)
 	h.checkFiles(ts)
 	h.download(ts)
+
+	// Seed the history and route state with the current routes, before the churn
+	if h.RibBootstrap == true {
+		h.Bootstrap(ts, true)
+	}
+
 	h.parse(ts)
 }
 
+// Bootstrap downloads the latest RIB dump (bview) for each data set, if it has
+// not already been cached, and loads the routes for our prefixes into the
+// route state. If collect is set then the paths are also added to the history
+func (h *Historic) Bootstrap(ts time.Time, collect bool) {
+
+	fmt.Println("Loading RIB snapshots")
+
+	mrtParser := new(MrtParser)
+	for name, url := range h.DataSets {
+
+		// The first dump of the month may not have been published yet
+		var href string
+		var year int
+		var month int
+		var err error
+		for i := 0; i <= 1 && len(href) == 0; i++ {
+			year = int(ts.AddDate(0, -i, 0).Year())
+			month = int(ts.AddDate(0, -i, 0).Month())
+
+			href, err = getBviewFile(url, year, month)
+			if err != nil {
+				fmt.Printf("Error retrieving bview file list (%s): %v\n", fmt.Sprintf("%s%v.%v", url, year, month), err)
+			}
+		}
+
+		if len(href) == 0 {
+			fmt.Printf("No bview file available (%s)\n", name)
+			continue
+		}
+
+		if util.DoesFileExist(fmt.Sprintf("./cache/%s/bview/%s", name, href)) == false {
+			fmt.Printf("Uncached bview file (%s): %s\n", name, href)
+			err = downloadBviewFile(name, url, year, month, href)
+			if err != nil {
+				fmt.Printf("Error downloading bview file (%s): %v\n", href, err)
+				continue
+			}
+		}
+
+		routes, err := mrtParser.ParseRib(h.detector, name, fmt.Sprintf("./cache/%s/bview/%s", name, href), collect)
+		if err != nil {
+			fmt.Printf("Error parsing bview file (%s): %v\n", href, err)
+			continue
+		}
+
+		fmt.Printf("Loaded %d routes from bview file (%s): %s\n", routes, name, href)
+	}
+}
+
 // checkDirectories ensures that the required directory structure has been created
 func (h *Historic) checkDirectories(ts time.Time) {
 
@@ -206,7 +265,7 @@ func (h *Historic) parse(ts time.Time) {
 						<-semaphore // Unlock
 					}()
 
-					err = mrtParser.ParseAndCollect(h.detector, fmt.Sprintf("./cache/%s/%v/%v/%s", name, year, month, filePath))
+					err = mrtParser.ParseAndCollect(h.detector, name, fmt.Sprintf("./cache/%s/%v/%v/%s", name, year, month, filePath))
 					if err != nil {
 						if strings.Contains(err.Error(), "gzip: invalid header") == true {
 							err = os.Remove(fmt.Sprintf("./cache/%s/%v/%v/%s", name, year, month, filePath))
@@ -223,7 +282,7 @@ func (h *Historic) parse(ts time.Time) {
 		}
 	}
 
-	history.Persist()
+	history.PersistAll()
 
 	fmt.Println("FINISH")
 	fmt.Println(time.Now())
@@ -2,162 +2,669 @@ package main
 
 import (
 	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
-	pgx "github.com/jackc/pgx"
 	util "github.com/woanware/goutil"
 )
 
+// ##### Constants ############################################################
+
+// HISTORY_DAY_FORMAT is the format of the day buckets when persisted
+const HISTORY_DAY_FORMAT string = "2006-01-02"
+
+// HISTORY_FILE_ADJACENCY is the first field of the adjacencies in a snapshot file, instead of the peer AS
+const HISTORY_FILE_ADJACENCY string = "adjacency"
+
 // ##### Structs ##############################################################
 
-//
+// HistoryEntry is the record of a route (path) used by a peer, with the
+// number of times it was seen on each day (days since the epoch, UTC)
+type HistoryEntry struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Days      map[int64]uint64
+}
+
+// History holds the routes seen for each peer AS, and the AS adjacencies seen
+// on those routes. Counts only include the days within the window (0 includes
+// all days), which ends at the latest time seen in the data, so that replays of
+// old data are counted in the same way, or at the current time once it has been
+// moved on by ExpireNow (live operation). The routes and adjacencies changed or
+// expired since they were last persisted are tracked, and persists are
+// serialised so that an older snapshot cannot overwrite a newer one
 type History struct {
-	mux  sync.Mutex
-	data map[uint32]map[string]uint64
+	mux                sync.Mutex
+	pmux               sync.Mutex
+	data               map[uint32]map[string]*HistoryEntry
+	adjacencies        map[AsAdjacency]*HistoryEntry
+	known              map[AsAdjacency]struct{}
+	window             int
+	now                time.Time
+	dirty              map[HistoryKey]struct{}
+	removed            map[HistoryKey]struct{}
+	dirtyAdjacencies   map[AsAdjacency]struct{}
+	removedAdjacencies map[AsAdjacency]struct{}
+	store              HistoryStore
+}
+
+// HistoryKey identifies a route used by a peer AS
+type HistoryKey struct {
+	As    uint32
+	Route string
 }
 
 // ##### Methods ##############################################################
 
-//
-func NewHistory() *History {
+// NewHistory returns a new, empty, History with a window of the number of days.
+// The store is optional, histories without one are not persisted
+func NewHistory(window int, store HistoryStore) *History {
 
 	return &History{
-		data: make(map[uint32]map[string]uint64),
+		data:               make(map[uint32]map[string]*HistoryEntry),
+		adjacencies:        make(map[AsAdjacency]*HistoryEntry),
+		known:              make(map[AsAdjacency]struct{}),
+		window:             window,
+		store:              store,
+		dirty:              make(map[HistoryKey]struct{}),
+		removed:            make(map[HistoryKey]struct{}),
+		dirtyAdjacencies:   make(map[AsAdjacency]struct{}),
+		removedAdjacencies: make(map[AsAdjacency]struct{}),
 	}
 }
 
-//
+// GetRouteCount returns the number of times the peer has used the route within the window
 func (h *History) GetRouteCount(as uint32, route string) uint64 {
 
 	h.mux.Lock()
 	defer h.mux.Unlock()
 
-	if h.data[as] == nil {
+	if h.data[as] == nil || h.data[as][route] == nil {
 		return 0
 	}
 
-	return h.data[as][route]
+	return h.count(h.data[as][route])
 }
 
-//
-func (h *History) Set(as uint32, route string) {
+// Len returns the number of routes (peer AS and path) held
+func (h *History) Len() int {
 
 	h.mux.Lock()
-	if h.data[as] == nil {
-		h.data[as] = make(map[string]uint64)
+	defer h.mux.Unlock()
+
+	count := 0
+	for _, routes := range h.data {
+		count += len(routes)
 	}
-	h.data[as][route]++
+
+	return count
+}
+
+// LenAdjacencies returns the number of adjacencies held, excluding the known adjacencies
+func (h *History) LenAdjacencies() int {
+
+	h.mux.Lock()
 	defer h.mux.Unlock()
+
+	return len(h.adjacencies)
 }
 
-//
-func (h *History) SetCount(as uint32, route string, count uint64) {
+// GetEntry returns a copy of the record of the route used by the peer
+func (h *History) GetEntry(as uint32, route string) (HistoryEntry, bool) {
 
 	h.mux.Lock()
 	defer h.mux.Unlock()
-	if h.data[as] == nil {
-		h.data[as] = make(map[string]uint64)
+
+	if h.data[as] == nil || h.data[as][route] == nil {
+		return HistoryEntry{}, false
+	}
+
+	e := h.data[as][route]
+	entry := HistoryEntry{FirstSeen: e.FirstSeen, LastSeen: e.LastSeen, Days: make(map[int64]uint64, len(e.Days))}
+	for day, count := range e.Days {
+		entry.Days[day] = count
 	}
-	h.data[as][route] = count
 
+	return entry, true
 }
 
-//
-func (h *History) SetAdd(as uint32, route string, count uint64) {
+// Set records a single use of the route by the peer at the time
+func (h *History) Set(as uint32, route string, ts time.Time) {
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.get(as, route, ts).Days[historyDay(ts)]++
+	h.markDirty(as, route)
+}
+
+// SetAdjacencies records a single use of each of the adjacencies of the path at the time
+func (h *History) SetAdjacencies(asPath *AsPath, ts time.Time) {
+
+	adjacencies := asPath.Adjacencies()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for _, a := range adjacencies {
+		h.getAdjacency(a, ts).Days[historyDay(ts)]++
+		h.markAdjacencyDirty(a)
+	}
+}
+
+// SetAdjacencyCount sets the number of times the adjacency was seen on the day of the time
+func (h *History) SetAdjacencyCount(a AsAdjacency, count uint64, ts time.Time) {
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.getAdjacency(a, ts).Days[historyDay(ts)] = count
+	h.markAdjacencyDirty(a)
+}
+
+// GetAdjacencyCount returns the number of times the adjacency has been seen within the window
+func (h *History) GetAdjacencyCount(a AsAdjacency) uint64 {
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if h.adjacencies[a] == nil {
+		return 0
+	}
+
+	return h.count(h.adjacencies[a])
+}
+
+// SetKnownAdjacencies replaces the adjacencies that are known from the
+// configuration e.g. our neighbour peers. They are never windowed or persisted
+func (h *History) SetKnownAdjacencies(adjacencies []AsAdjacency) {
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.known = make(map[AsAdjacency]struct{}, len(adjacencies))
+	for _, a := range adjacencies {
+		h.known[a] = struct{}{}
+	}
+}
+
+// IsKnownAdjacency returns whether the adjacency is known from the configuration,
+// or has been seen within the window
+func (h *History) IsKnownAdjacency(a AsAdjacency) bool {
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if _, ok := h.known[a]; ok == true {
+		return true
+	}
+
+	return h.adjacencies[a] != nil && h.count(h.adjacencies[a]) > 0
+}
+
+// SetCount sets the number of uses of the route by the peer on the day of the time
+func (h *History) SetCount(as uint32, route string, count uint64, ts time.Time) {
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	h.get(as, route, ts).Days[historyDay(ts)] = count
+	h.markDirty(as, route)
+}
+
+// Expire removes the day buckets that are outside of the window, and the routes
+// and adjacencies that have not been seen within it, so that they alert once again
+func (h *History) Expire() {
+
+	if h.window <= 0 {
+		return
+	}
 
 	h.mux.Lock()
 	defer h.mux.Unlock()
+
+	oldest := historyDay(h.now) - int64(h.window) + 1
+	expired := 0
+
+	for as, routes := range h.data {
+		for route, e := range routes {
+			changed := expireHistoryDays(e, oldest)
+
+			if len(e.Days) == 0 {
+				delete(routes, route)
+				key := HistoryKey{As: as, Route: route}
+				delete(h.dirty, key)
+				h.removed[key] = struct{}{}
+				expired++
+			} else if changed == true {
+				h.markDirty(as, route)
+			}
+		}
+
+		if len(routes) == 0 {
+			delete(h.data, as)
+		}
+	}
+
+	if expired > 0 {
+		fmt.Printf("Expired %d historic routes not seen in %d days\n", expired, h.window)
+	}
+
+	expired = 0
+	for a, e := range h.adjacencies {
+		changed := expireHistoryDays(e, oldest)
+
+		if len(e.Days) == 0 {
+			delete(h.adjacencies, a)
+			delete(h.dirtyAdjacencies, a)
+			h.removedAdjacencies[a] = struct{}{}
+			expired++
+		} else if changed == true {
+			h.markAdjacencyDirty(a)
+		}
+	}
+
+	if expired > 0 {
+		fmt.Printf("Expired %d historic adjacencies not seen in %d days\n", expired, h.window)
+	}
+}
+
+// ExpireNow moves the end of the window on to the current time, since the data
+// seen may be older e.g. when none of our paths have been updated, and expires
+func (h *History) ExpireNow() {
+
+	h.mux.Lock()
+	now := time.Now()
+	if now.After(h.now) == true {
+		h.now = now
+	}
+	h.mux.Unlock()
+
+	h.Expire()
+}
+
+// get returns the entry for the route, creating it if required, and records
+// that it has been seen at the time. The lock must be held
+func (h *History) get(as uint32, route string, ts time.Time) *HistoryEntry {
+
 	if h.data[as] == nil {
-		h.data[as] = make(map[string]uint64)
+		h.data[as] = make(map[string]*HistoryEntry)
+	}
+
+	e := h.data[as][route]
+	if e == nil {
+		e = &HistoryEntry{FirstSeen: ts, LastSeen: ts, Days: make(map[int64]uint64)}
+		h.data[as][route] = e
+	}
+
+	h.seen(e, ts)
+	return e
+}
+
+// getAdjacency returns the entry for the adjacency, creating it if required, and
+// records that it has been seen at the time. The lock must be held
+func (h *History) getAdjacency(a AsAdjacency, ts time.Time) *HistoryEntry {
+
+	e := h.adjacencies[a]
+	if e == nil {
+		e = &HistoryEntry{FirstSeen: ts, LastSeen: ts, Days: make(map[int64]uint64)}
+		h.adjacencies[a] = e
 	}
-	h.data[as][route] += count
+
+	h.seen(e, ts)
+	return e
 }
 
-//
+// seen updates the first/last seen times of the entry, and the latest time seen
+// in the data. The lock must be held
+func (h *History) seen(e *HistoryEntry, ts time.Time) {
+
+	if ts.Before(e.FirstSeen) == true {
+		e.FirstSeen = ts
+	}
+	if ts.After(e.LastSeen) == true {
+		e.LastSeen = ts
+	}
+	if ts.After(h.now) == true {
+		h.now = ts
+	}
+}
+
+// markDirty records that the route needs persisting. The lock must be held
+func (h *History) markDirty(as uint32, route string) {
+
+	key := HistoryKey{As: as, Route: route}
+	h.dirty[key] = struct{}{}
+	delete(h.removed, key)
+}
+
+// markAdjacencyDirty records that the adjacency needs persisting. The lock must be held
+func (h *History) markAdjacencyDirty(a AsAdjacency) {
+
+	h.dirtyAdjacencies[a] = struct{}{}
+	delete(h.removedAdjacencies, a)
+}
+
+// record returns a copy of the route as persisted. The lock must be held
+func (h *History) record(as uint32, route string, e *HistoryEntry) *HistoryRecord {
+
+	days := make(map[int64]uint64, len(e.Days))
+	for day, count := range e.Days {
+		days[day] = count
+	}
+
+	return &HistoryRecord{PeerAs: as, Route: route, Count: h.count(e), FirstSeen: e.FirstSeen, LastSeen: e.LastSeen, Days: days}
+}
+
+// adjacencyRecord returns a copy of the adjacency as persisted. The lock must be held
+func (h *History) adjacencyRecord(a AsAdjacency, e *HistoryEntry) *AdjacencyRecord {
+
+	days := make(map[int64]uint64, len(e.Days))
+	for day, count := range e.Days {
+		days[day] = count
+	}
+
+	return &AdjacencyRecord{Adjacency: a, Count: h.count(e), FirstSeen: e.FirstSeen, LastSeen: e.LastSeen, Days: days}
+}
+
+// merge adds the first/last seen times and day counts of the entry. The lock must be held
+func (h *History) merge(as uint32, route string, entry *HistoryEntry) {
+
+	e := h.get(as, route, entry.FirstSeen)
+	h.get(as, route, entry.LastSeen)
+
+	for day, count := range entry.Days {
+		e.Days[day] += count
+	}
+}
+
+// mergeAdjacency adds the first/last seen times and day counts of the entry. The lock must be held
+func (h *History) mergeAdjacency(a AsAdjacency, entry *HistoryEntry) {
+
+	e := h.getAdjacency(a, entry.FirstSeen)
+	h.getAdjacency(a, entry.LastSeen)
+
+	for day, count := range entry.Days {
+		e.Days[day] += count
+	}
+}
+
+// count returns the total of the day buckets within the window. The lock must be held
+func (h *History) count(e *HistoryEntry) uint64 {
+
+	oldest := historyDay(h.now) - int64(h.window) + 1
+
+	var total uint64
+	for day, count := range e.Days {
+		if h.window > 0 && day < oldest {
+			continue
+		}
+		total += count
+	}
+
+	return total
+}
+
+// Persist saves the routes and adjacencies that have changed, and deletes those
+// that have expired, since the last persist. The changes are read under the lock
+// and saved in a single transaction/write, if that fails they are retried next time
 func (h *History) Persist() {
 
-	// Truncate table
-	_, err := pool.Exec("truncate table routes")
-	if err != nil {
-		fmt.Printf("Error truncating historic data: %v\n", err)
+	if h.store == nil {
+		return
 	}
 
-	// Massage the data into a format that can be used with
-	// the postgres COPY functionality e.g. fastest inserts
-	var rows [][]interface{}
-	for peer, a := range h.data {
-		for route, count := range a {
-			rows = append(rows, []interface{}{peer, route, count})
+	h.pmux.Lock()
+	defer h.pmux.Unlock()
+
+	h.Expire()
+
+	h.mux.Lock()
+	dirty := h.dirty
+	removed := h.removed
+	dirtyAdjacencies := h.dirtyAdjacencies
+	removedAdjacencies := h.removedAdjacencies
+	h.dirty = make(map[HistoryKey]struct{})
+	h.removed = make(map[HistoryKey]struct{})
+	h.dirtyAdjacencies = make(map[AsAdjacency]struct{})
+	h.removedAdjacencies = make(map[AsAdjacency]struct{})
+
+	records := make([]*HistoryRecord, 0, len(dirty))
+	for key := range dirty {
+		if e := h.data[key.As][key.Route]; e != nil {
+			records = append(records, h.record(key.As, key.Route, e))
 		}
 	}
 
-	_, err = pool.CopyFrom(
-		pgx.Identifier{"routes"},
-		[]string{"peer_as", "route", "count"},
-		pgx.CopyFromRows(rows))
+	keys := make([]HistoryKey, 0, len(removed))
+	for key := range removed {
+		keys = append(keys, key)
+	}
 
-	if err != nil {
-		fmt.Printf("Error inserting historic data: %v\n", err)
+	adjacencyRecords := make([]*AdjacencyRecord, 0, len(dirtyAdjacencies))
+	for a := range dirtyAdjacencies {
+		if e := h.adjacencies[a]; e != nil {
+			adjacencyRecords = append(adjacencyRecords, h.adjacencyRecord(a, e))
+		}
+	}
+
+	adjacencies := make([]AsAdjacency, 0, len(removedAdjacencies))
+	for a := range removedAdjacencies {
+		adjacencies = append(adjacencies, a)
+	}
+	h.mux.Unlock()
+
+	if len(records) == 0 && len(keys) == 0 && len(adjacencyRecords) == 0 && len(adjacencies) == 0 {
+		return
+	}
+
+	start := time.Now()
+	err := h.store.Save(records, keys, adjacencyRecords, adjacencies)
+	metricPersistDuration.Observe(time.Since(start).Seconds(), "persist")
+	if err == nil {
 		return
 	}
 
-	// // FILE PERSISTANCE
-	// h.mux.Lock()
-	// defer h.mux.Unlock()
+	metricPersistFailures.Inc("persist")
+	fmt.Printf("Error persisting historic data (%s): %v\n", h.store.Name(), err)
+
+	// Keep the changes for the next persist, unless they have since been superseded
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for key := range dirty {
+		if _, ok := h.removed[key]; ok == false && h.data[key.As][key.Route] != nil {
+			h.dirty[key] = struct{}{}
+		}
+	}
+	for key := range removed {
+		if _, ok := h.dirty[key]; ok == false && h.data[key.As][key.Route] == nil {
+			h.removed[key] = struct{}{}
+		}
+	}
+	for a := range dirtyAdjacencies {
+		if _, ok := h.removedAdjacencies[a]; ok == false && h.adjacencies[a] != nil {
+			h.dirtyAdjacencies[a] = struct{}{}
+		}
+	}
+	for a := range removedAdjacencies {
+		if _, ok := h.dirtyAdjacencies[a]; ok == false && h.adjacencies[a] == nil {
+			h.removedAdjacencies[a] = struct{}{}
+		}
+	}
+}
+
+// PersistAll replaces all of the persisted routes and adjacencies e.g. after the
+// history has been rebuilt from the update files
+func (h *History) PersistAll() {
+
+	if h.store == nil {
+		return
+	}
 
-	// buffer := new(bytes.Buffer)
-	// encoder := gob.NewEncoder(buffer)
+	h.pmux.Lock()
+	defer h.pmux.Unlock()
 
-	// err := encoder.Encode(h.data)
-	// if err != nil {
-	// 	fmt.Printf("Error encoding historic data: %v\n", err)
-	// }
+	h.Expire()
 
-	// err = ioutil.WriteFile("./db/history.db", buffer.Bytes(), 0770)
-	// if err != nil {
-	// 	fmt.Printf("Error persisting historic data: %v\n", err)
-	// }
+	h.mux.Lock()
+	records := make([]*HistoryRecord, 0)
+	for as, routes := range h.data {
+		for route, e := range routes {
+			records = append(records, h.record(as, route, e))
+		}
+	}
+	adjacencyRecords := make([]*AdjacencyRecord, 0, len(h.adjacencies))
+	for a, e := range h.adjacencies {
+		adjacencyRecords = append(adjacencyRecords, h.adjacencyRecord(a, e))
+	}
+	h.dirty = make(map[HistoryKey]struct{})
+	h.removed = make(map[HistoryKey]struct{})
+	h.dirtyAdjacencies = make(map[AsAdjacency]struct{})
+	h.removedAdjacencies = make(map[AsAdjacency]struct{})
+	h.mux.Unlock()
+
+	start := time.Now()
+	err := h.store.Replace(records, adjacencyRecords)
+	metricPersistDuration.Observe(time.Since(start).Seconds(), "persist_all")
+	if err != nil {
+		metricPersistFailures.Inc("persist_all")
+		fmt.Printf("Error persisting historic data (%s): %v\n", h.store.Name(), err)
+	}
 }
 
-//
+// Load adds the persisted routes and adjacencies
 func (h *History) Load() {
 
-	rows, _ := pool.Query("select peer_as, route, count from routes")
+	if h.store == nil {
+		return
+	}
 
-	var peerAs uint32
-	var route string
-	var count uint64
-	var err error
+	records, adjacencies, err := h.store.Load()
+	if err != nil {
+		fmt.Printf("Error loading historic data (%s): %v\n", h.store.Name(), err)
+	}
 
-	for rows.Next() {
-		err = rows.Scan(&peerAs, &route, &count)
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for _, r := range records {
+		h.merge(r.PeerAs, r.Route, &HistoryEntry{FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Days: r.Days})
+	}
+	for _, r := range adjacencies {
+		h.mergeAdjacency(r.Adjacency, &HistoryEntry{FirstSeen: r.FirstSeen, LastSeen: r.LastSeen, Days: r.Days})
+	}
+}
+
+// SaveFile writes the history to a CSV snapshot file (peer AS, route, first
+// seen, last seen, day counts), which can be used as the history for replays.
+// The adjacencies are written with HISTORY_FILE_ADJACENCY as the peer AS
+func (h *History) SaveFile(filePath string) error {
+
+	err := os.MkdirAll(filepath.Dir(filePath), 0770)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	writer := csv.NewWriter(f)
+	for peer, a := range h.data {
+		for route, e := range a {
+			err = writer.Write([]string{util.ConvertUInt32ToString(peer), route, e.FirstSeen.UTC().Format(time.RFC3339),
+				e.LastSeen.UTC().Format(time.RFC3339), string(encodeHistoryDays(e.Days))})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for a, e := range h.adjacencies {
+		err = writer.Write([]string{HISTORY_FILE_ADJACENCY, a.String(), e.FirstSeen.UTC().Format(time.RFC3339),
+			e.LastSeen.UTC().Format(time.RFC3339), string(encodeHistoryDays(e.Days))})
 		if err != nil {
-			fmt.Printf("Error loading historic data: %v\n", err)
-			continue
+			return err
 		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
 
-		h.SetAdd(peerAs, route, count)
+// LoadFile adds the routes and adjacencies from a CSV snapshot file written by SaveFile
+func (h *History) LoadFile(filePath string) error {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
 
-	// // FILE PERSISTANCE
-	// h.mux.Lock()
-	// defer h.mux.Unlock()
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 5
 
-	// data, err := ioutil.ReadFile("./db/history.db")
-	// reader := bytes.NewReader(data)
-	// if err != nil {
-	// 	fmt.Printf("Error reading historic data: %v\n", err)
-	// }
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	var peerAs uint64
+	var a AsAdjacency
+	for i, r := range records {
+		if r[0] == HISTORY_FILE_ADJACENCY {
+			a, err = parseAsAdjacency(r[1])
+			if err != nil {
+				return fmt.Errorf("invalid adjacency on line %d: %v", i+1, err)
+			}
+		} else {
+			peerAs, err = strconv.ParseUint(r[0], 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid peer AS on line %d: %s", i+1, r[0])
+			}
+		}
+
+		e := new(HistoryEntry)
+		e.FirstSeen, err = time.Parse(time.RFC3339, r[2])
+		if err != nil {
+			return fmt.Errorf("invalid first seen on line %d: %s", i+1, r[2])
+		}
+
+		e.LastSeen, err = time.Parse(time.RFC3339, r[3])
+		if err != nil {
+			return fmt.Errorf("invalid last seen on line %d: %s", i+1, r[3])
+		}
+
+		e.Days, err = decodeHistoryDays([]byte(r[4]))
+		if err != nil {
+			return fmt.Errorf("invalid days on line %d: %v", i+1, err)
+		}
+
+		if r[0] == HISTORY_FILE_ADJACENCY {
+			h.mergeAdjacency(a, e)
+		} else {
+			h.merge(uint32(peerAs), r[1], e)
+		}
+	}
 
-	// decoder := gob.NewDecoder(reader)
-	// err = decoder.Decode(&h.data)
-	// if err != nil {
-	// 	fmt.Printf("Error loading historic data: %v\n", err)
-	// }
+	return nil
 }
 
 //
@@ -176,37 +683,43 @@ func (h *History) Summary() {
 	var peerAs uint32
 	var b bytes.Buffer
 	var route string
-	var temp string
-	var count uint64
+	var e *HistoryEntry
 
-	b.WriteString("SRC-DST, PEER_AS, COUNT, PATH1, PATH2, PATH3, PATH4, PATH5, PATH6, PATH6, PATH7, PATH8, PATH9, PATH10\n")
+	b.WriteString("SRC-DST, PEER_AS, COUNT, FIRST_SEEN, LAST_SEEN, PATH1, PATH2, PATH3, PATH4, PATH5, PATH6, PATH6, PATH7, PATH8, PATH9, PATH10\n")
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
 
 	for peer, a := range h.data {
-		for route, count = range a {
+		for route, e = range a {
 			parts = strings.Split(route, " ")
 
 			// Get originating peer details
-			temp = parts[0]
-			peerAs, _ = util.ConvertStringToUint32(temp)
+			temp := parts[0]
+			peerAs, _ = parseAs(temp)
 			firstCountry := asNames.Country(uint32(peerAs))
 			b.WriteString(firstCountry)
 			b.WriteString("->")
 
 			// Get destination peer details
 			temp = parts[len(parts)-1]
-			peerAs, _ = util.ConvertStringToUint32(temp)
+			peerAs, _ = parseAs(temp)
 			lastCountry := asNames.Country(peerAs)
 			b.WriteString(lastCountry)
 			b.WriteString(", ")
 			b.WriteString(util.ConvertUInt32ToString(peer))
 			b.WriteString(", ")
-			b.WriteString(util.ConvertUint64ToString(count))
+			b.WriteString(util.ConvertUint64ToString(h.count(e)))
+			b.WriteString(", ")
+			b.WriteString(e.FirstSeen.UTC().Format(time.RFC3339))
+			b.WriteString(", ")
+			b.WriteString(e.LastSeen.UTC().Format(time.RFC3339))
 			b.WriteString(", ")
 
 			for _, part = range parts {
 				b.WriteString(part)
 				b.WriteString(" (")
-				peerAs, _ = util.ConvertStringToUint32(part)
+				peerAs, _ = parseAs(part)
 				b.WriteString(asNames.Country(peerAs))
 				b.WriteString("), ")
 			}
@@ -219,13 +732,72 @@ func (h *History) Summary() {
 	if err != nil {
 		fmt.Printf("Error writing summary data: %v\n", err)
 	}
-	// _, err = pool.CopyFrom(
-	// 	pgx.Identifier{"routes"},
-	// 	[]string{"peer_as", "route", "count"},
-	// 	pgx.CopyFromRows(rows))
+}
+
+// expireHistoryDays removes the day buckets of the entry before the oldest day,
+// returning whether any were removed
+func expireHistoryDays(e *HistoryEntry, oldest int64) bool {
+
+	changed := false
+	for day := range e.Days {
+		if day < oldest {
+			delete(e.Days, day)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// historyDay returns the day bucket for the time (days since the epoch, UTC)
+func historyDay(ts time.Time) int64 {
+
+	return ts.Unix() / 86400
+}
+
+// encodeHistoryDays returns the day counts as a JSON object keyed by date e.g. {"2018-11-12": 5}
+func encodeHistoryDays(days map[int64]uint64) []byte {
+
+	keys := make([]int64, 0, len(days))
+	for day := range days {
+		keys = append(keys, day)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, day := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `"%s":%d`, time.Unix(day*86400, 0).UTC().Format(HISTORY_DAY_FORMAT), days[day])
+	}
+	b.WriteString("}")
+
+	return b.Bytes()
+}
+
+// decodeHistoryDays parses the day counts written by encodeHistoryDays
+func decodeHistoryDays(data []byte) (map[int64]uint64, error) {
+
+	days := make(map[int64]uint64)
+	if len(data) == 0 {
+		return days, nil
+	}
+
+	var raw map[string]uint64
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return days, err
+	}
+
+	for date, count := range raw {
+		ts, err := time.Parse(HISTORY_DAY_FORMAT, date)
+		if err != nil {
+			return days, err
+		}
+		days[historyDay(ts)] += count
+	}
 
-	// if err != nil {
-	// 	fmt.Printf("Error inserting historic data: %v\n", err)
-	// 	return
-	// }
+	return days, nil
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// TestHistoryWindow checks that only the days within the window are counted,
+// and that routes not seen within the window are expired
+func TestHistoryWindow(t *testing.T) {
+
+	h := NewHistory(90, nil)
+
+	h.SetCount(3356, "3356 15169", 50, testTime(0))
+	h.Set(3356, "3356 174 15169", testTime(0))
+	h.Set(3356, "3356 174 15169", testTime(60*24*100))
+
+	if count := h.GetRouteCount(3356, "3356 15169"); count != 0 {
+		t.Errorf("expected the route seen 100 days ago to be outside of the window, count %d", count)
+	}
+
+	if count := h.GetRouteCount(3356, "3356 174 15169"); count != 1 {
+		t.Errorf("expected a count of 1 within the window, count %d", count)
+	}
+
+	h.Expire()
+
+	if _, ok := h.GetEntry(3356, "3356 15169"); ok == true {
+		t.Errorf("expected the route seen 100 days ago to be expired")
+	}
+
+	e, ok := h.GetEntry(3356, "3356 174 15169")
+	if ok == false {
+		t.Fatalf("expected the route seen within the window to be kept")
+	}
+	if e.FirstSeen.Equal(testTime(0)) == false || e.LastSeen.Equal(testTime(60*24*100)) == false || len(e.Days) != 1 {
+		t.Errorf("unexpected entry after expiry: %+v", e)
+	}
+}
+
+// TestHistoryExpireNow checks that the window is moved on to the current time,
+// expiring the routes that have not been seen within it, even with no new data
+func TestHistoryExpireNow(t *testing.T) {
+
+	h := NewHistory(90, nil)
+
+	h.Set(3356, "3356 15169", time.Now().AddDate(0, 0, -100))
+
+	if count := h.GetRouteCount(3356, "3356 15169"); count != 1 {
+		t.Errorf("expected the newest data to end the window before it is moved on, count %d", count)
+	}
+
+	h.ExpireNow()
+
+	if _, ok := h.GetEntry(3356, "3356 15169"); ok == true {
+		t.Errorf("expected the route seen 100 days ago to be expired")
+	}
+}
+
+// TestHistoryFile checks that a snapshot file is loaded as it was saved
+func TestHistoryFile(t *testing.T) {
+
+	h := NewHistory(0, nil)
+	h.Set(3356, "3356 15169", testTime(0))
+	h.Set(3356, "3356 15169", testTime(60*24))
+	h.SetCount(4200000000, "4200000000 15169", 7, testTime(0))
+	h.SetAdjacencyCount(AsAdjacency{Neighbour: 174, As: 15169}, 3, testTime(0))
+
+	filePath := filepath.Join(t.TempDir(), "history.csv")
+	err := h.SaveFile(filePath)
+	if err != nil {
+		t.Fatalf("error saving history: %v", err)
+	}
+
+	loaded := NewHistory(0, nil)
+	err = loaded.LoadFile(filePath)
+	if err != nil {
+		t.Fatalf("error loading history: %v", err)
+	}
+
+	if count := loaded.GetRouteCount(3356, "3356 15169"); count != 2 {
+		t.Errorf("expected a count of 2, count %d", count)
+	}
+	if count := loaded.GetRouteCount(4200000000, "4200000000 15169"); count != 7 {
+		t.Errorf("expected a count of 7, count %d", count)
+	}
+	if count := loaded.GetAdjacencyCount(AsAdjacency{Neighbour: 174, As: 15169}); count != 3 || loaded.Len() != 2 {
+		t.Errorf("expected the adjacency to be loaded separately to the routes, count %d, %d routes", count, loaded.Len())
+	}
+
+	e, _ := loaded.GetEntry(3356, "3356 15169")
+	if e.FirstSeen.Equal(testTime(0)) == false || e.LastSeen.Equal(testTime(60*24)) == false {
+		t.Errorf("unexpected first/last seen: %v %v", e.FirstSeen, e.LastSeen)
+	}
+}
+
+// TestHistoryDirty checks that changed routes are marked for persisting, and
+// that expired routes are marked for deletion instead
+func TestHistoryDirty(t *testing.T) {
+
+	h := NewHistory(90, nil)
+	h.Set(3356, "3356 15169", testTime(0))
+	h.Set(174, "174 15169", testTime(0))
+
+	h.mux.Lock()
+	h.dirty = make(map[HistoryKey]struct{})
+	h.mux.Unlock()
+
+	h.Set(3356, "3356 15169", testTime(60*24*100))
+	h.Expire()
+
+	key := HistoryKey{As: 3356, Route: "3356 15169"}
+	if _, ok := h.dirty[key]; ok == false || len(h.dirty) != 1 {
+		t.Errorf("expected only the updated route to be dirty: %v", h.dirty)
+	}
+
+	key = HistoryKey{As: 174, Route: "174 15169"}
+	if _, ok := h.removed[key]; ok == false || len(h.removed) != 1 {
+		t.Errorf("expected only the expired route to be removed: %v", h.removed)
+	}
+}
+
+// TestHistoryAdjacencies checks that the adjacencies of a path are recorded
+// without the prepending, and that none are inferred into or out of an AS_SET
+func TestHistoryAdjacencies(t *testing.T) {
+
+	h := NewHistory(90, nil)
+
+	asPath := newAsPathFromSegments([]AsPathSegment{
+		{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{3356, 174, 174, 64500}},
+		{Type: bgp.BGP_ASPATH_ATTR_TYPE_SET, AS: []uint32{64501, 64502}},
+		{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{15169, 15169}},
+	})
+	h.SetAdjacencies(asPath, testTime(0))
+	h.SetAdjacencies(asPath, testTime(1))
+
+	for _, a := range []AsAdjacency{{Neighbour: 3356, As: 174}, {Neighbour: 174, As: 64500}} {
+		if count := h.GetAdjacencyCount(a); count != 2 {
+			t.Errorf("expected adjacency %s to be seen twice, count %d", a, count)
+		}
+	}
+
+	if h.LenAdjacencies() != 2 || h.Len() != 0 {
+		t.Errorf("expected only the AS_SEQUENCE adjacencies, and no routes, %d adjacencies and %d routes held",
+			h.LenAdjacencies(), h.Len())
+	}
+}
+
+// TestHistoryKnownAdjacencies checks that the neighbour peers of the target AS's
+// are known adjacencies, without being counted or persisted
+func TestHistoryKnownAdjacencies(t *testing.T) {
+
+	config := &Config{
+		TargetAs:       map[uint32]struct{}{15169: {}},
+		NeighbourPeers: map[uint32]struct{}{174: {}, 15169: {}},
+		Profiles:       []ProfileConfig{customerProfile},
+	}
+
+	h := NewHistory(90, nil)
+	h.SetKnownAdjacencies(neighbourAdjacencies(config))
+
+	for _, a := range []AsAdjacency{{Neighbour: 174, As: 15169}, {Neighbour: 174, As: 64496}} {
+		if h.IsKnownAdjacency(a) == false || h.GetAdjacencyCount(a) != 0 {
+			t.Errorf("expected adjacency %s to be known, without a count", a)
+		}
+	}
+
+	if h.IsKnownAdjacency(AsAdjacency{Neighbour: 3356, As: 15169}) == true {
+		t.Errorf("expected an adjacency that has not been seen to be unknown")
+	}
+
+	if h.LenAdjacencies() != 0 || len(h.dirtyAdjacencies) != 0 {
+		t.Errorf("expected the known adjacencies not to be held for persisting")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ##### Constants ############################################################
+
+const HISTORY_SNAPSHOT_FILE string = "history.snapshot"
+const HISTORY_LOG_FILE string = "history.log"
+
+// The log is compacted into the snapshot once it is larger than both this and the snapshot
+const HISTORY_COMPACT_MIN_SIZE int64 = 16 * 1024 * 1024
+
+const HISTORY_OP_UPSERT string = "upsert"
+const HISTORY_OP_DELETE string = "delete"
+
+// HISTORY_TYPE_ADJACENCY is the type of the adjacency records, routes have no type
+const HISTORY_TYPE_ADJACENCY string = "adjacency"
+
+// ##### Structs ##############################################################
+
+// FileHistoryStore persists the history to a directory, without a database. Changes
+// are appended to a log, which is periodically compacted into a snapshot of all
+// routes and adjacencies
+type FileHistoryStore struct {
+	mux          sync.Mutex
+	path         string
+	log          *os.File
+	logSize      int64
+	snapshotSize int64
+}
+
+// historyFileRecord is a single line of the snapshot or log, the snapshot only
+// contains upserts. Adjacency records have the neighbour AS and AS instead of the peer AS and route
+type historyFileRecord struct {
+	Op        string          `json:"op,omitempty"`
+	Type      string          `json:"type,omitempty"`
+	PeerAs    uint32          `json:"peer_as,omitempty"`
+	Route     string          `json:"route,omitempty"`
+	Neighbour uint32          `json:"neighbour_as,omitempty"`
+	As        uint32          `json:"asn,omitempty"`
+	Count     uint64          `json:"count,omitempty"`
+	FirstSeen time.Time       `json:"first_seen,omitempty"`
+	LastSeen  time.Time       `json:"last_seen,omitempty"`
+	Days      json.RawMessage `json:"days,omitempty"`
+}
+
+// ##### Methods ##############################################################
+
+// NewFileHistoryStore returns a new FileHistoryStore, creating the directory if required
+func NewFileHistoryStore(path string) (*FileHistoryStore, error) {
+
+	err := os.MkdirAll(path, 0770)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileHistoryStore{path: path}
+	s.logSize = fileSize(s.logPath())
+	s.snapshotSize = fileSize(s.snapshotPath())
+
+	return s, nil
+}
+
+func (s *FileHistoryStore) Name() string {
+
+	return "file"
+}
+
+// Load returns all of the persisted routes and adjacencies, the snapshot with the log applied
+func (s *FileHistoryStore) Load() ([]*HistoryRecord, []*AdjacencyRecord, error) {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	routes, adjacencies, err := s.load()
+	if err != nil {
+		return make([]*HistoryRecord, 0), make([]*AdjacencyRecord, 0), err
+	}
+
+	records := make([]*HistoryRecord, 0, len(routes))
+	for _, r := range routes {
+		records = append(records, r)
+	}
+
+	adjacencyRecords := make([]*AdjacencyRecord, 0, len(adjacencies))
+	for _, r := range adjacencies {
+		adjacencyRecords = append(adjacencyRecords, r)
+	}
+
+	return records, adjacencyRecords, nil
+}
+
+// Save appends the records and removed routes and adjacencies to the log,
+// compacting it if it has grown too large
+func (s *FileHistoryStore) Save(records []*HistoryRecord, removed []HistoryKey, adjacencies []*AdjacencyRecord, removedAdjacencies []AsAdjacency) error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var buffer bytes.Buffer
+	for _, key := range removed {
+		err := writeHistoryFileRecord(&buffer, &historyFileRecord{Op: HISTORY_OP_DELETE, PeerAs: key.As, Route: key.Route})
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range records {
+		err := writeHistoryFileRecord(&buffer, newHistoryFileRecord(HISTORY_OP_UPSERT, r))
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range removedAdjacencies {
+		err := writeHistoryFileRecord(&buffer, &historyFileRecord{Op: HISTORY_OP_DELETE, Type: HISTORY_TYPE_ADJACENCY,
+			Neighbour: a.Neighbour, As: a.As})
+		if err != nil {
+			return err
+		}
+	}
+	for _, r := range adjacencies {
+		err := writeHistoryFileRecord(&buffer, newAdjacencyFileRecord(HISTORY_OP_UPSERT, r))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.openLog()
+	if err != nil {
+		return err
+	}
+
+	n, err := s.log.Write(buffer.Bytes())
+	s.logSize += int64(n)
+	if err != nil {
+		return err
+	}
+
+	err = s.log.Sync()
+	if err != nil {
+		return err
+	}
+
+	if s.logSize > HISTORY_COMPACT_MIN_SIZE && s.logSize > s.snapshotSize {
+		return s.compact()
+	}
+
+	return nil
+}
+
+// Replace writes the records as the snapshot, and empties the log
+func (s *FileHistoryStore) Replace(records []*HistoryRecord, adjacencies []*AdjacencyRecord) error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	routes := make(map[HistoryKey]*HistoryRecord, len(records))
+	for _, r := range records {
+		routes[HistoryKey{As: r.PeerAs, Route: r.Route}] = r
+	}
+
+	adjacencyRecords := make(map[AsAdjacency]*AdjacencyRecord, len(adjacencies))
+	for _, r := range adjacencies {
+		adjacencyRecords[r.Adjacency] = r
+	}
+
+	return s.writeSnapshot(routes, adjacencyRecords)
+}
+
+func (s *FileHistoryStore) Close() error {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.log == nil {
+		return nil
+	}
+
+	err := s.log.Close()
+	s.log = nil
+
+	return err
+}
+
+// compact merges the log into the snapshot
+func (s *FileHistoryStore) compact() error {
+
+	routes, adjacencies, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	return s.writeSnapshot(routes, adjacencies)
+}
+
+// load reads the snapshot and then applies the log to it
+func (s *FileHistoryStore) load() (map[HistoryKey]*HistoryRecord, map[AsAdjacency]*AdjacencyRecord, error) {
+
+	routes := make(map[HistoryKey]*HistoryRecord)
+	adjacencies := make(map[AsAdjacency]*AdjacencyRecord)
+
+	err := readHistoryFile(s.snapshotPath(), routes, adjacencies)
+	if err != nil {
+		return routes, adjacencies, err
+	}
+
+	err = readHistoryFile(s.logPath(), routes, adjacencies)
+	if err != nil {
+		return routes, adjacencies, err
+	}
+
+	return routes, adjacencies, nil
+}
+
+// writeSnapshot writes the routes to a temporary file which then replaces the
+// snapshot, so that a failed write leaves the previous snapshot intact. The log
+// is only emptied once the new snapshot is in place
+func (s *FileHistoryStore) writeSnapshot(routes map[HistoryKey]*HistoryRecord, adjacencies map[AsAdjacency]*AdjacencyRecord) error {
+
+	tempPath := s.snapshotPath() + ".tmp"
+	f, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(f)
+	for _, r := range routes {
+		err = writeHistoryFileRecord(writer, newHistoryFileRecord("", r))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, r := range adjacencies {
+		err = writeHistoryFileRecord(writer, newAdjacencyFileRecord("", r))
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, s.snapshotPath())
+	if err != nil {
+		return err
+	}
+	s.snapshotSize = fileSize(s.snapshotPath())
+
+	err = s.openLog()
+	if err != nil {
+		return err
+	}
+
+	err = s.log.Truncate(0)
+	if err != nil {
+		return err
+	}
+	s.logSize = 0
+
+	return nil
+}
+
+// openLog opens the log for appending. A partial last line, from an interrupted
+// write, is removed so that the following records are not appended to it
+func (s *FileHistoryStore) openLog() error {
+
+	if s.log != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.logPath())
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+
+	f, err := os.OpenFile(s.logPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+
+	valid := int64(bytes.LastIndexByte(data, '\n') + 1)
+	if valid != int64(len(data)) {
+		err = f.Truncate(valid)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	s.log = f
+	s.logSize = valid
+
+	return nil
+}
+
+func (s *FileHistoryStore) snapshotPath() string {
+
+	return filepath.Join(s.path, HISTORY_SNAPSHOT_FILE)
+}
+
+func (s *FileHistoryStore) logPath() string {
+
+	return filepath.Join(s.path, HISTORY_LOG_FILE)
+}
+
+// newHistoryFileRecord converts a record to the form written to the files
+func newHistoryFileRecord(op string, r *HistoryRecord) *historyFileRecord {
+
+	return &historyFileRecord{
+		Op:        op,
+		PeerAs:    r.PeerAs,
+		Route:     r.Route,
+		Count:     r.Count,
+		FirstSeen: r.FirstSeen.UTC(),
+		LastSeen:  r.LastSeen.UTC(),
+		Days:      encodeHistoryDays(r.Days),
+	}
+}
+
+// newAdjacencyFileRecord converts an adjacency record to the form written to the files
+func newAdjacencyFileRecord(op string, r *AdjacencyRecord) *historyFileRecord {
+
+	return &historyFileRecord{
+		Op:        op,
+		Type:      HISTORY_TYPE_ADJACENCY,
+		Neighbour: r.Adjacency.Neighbour,
+		As:        r.Adjacency.As,
+		Count:     r.Count,
+		FirstSeen: r.FirstSeen.UTC(),
+		LastSeen:  r.LastSeen.UTC(),
+		Days:      encodeHistoryDays(r.Days),
+	}
+}
+
+// writeHistoryFileRecord writes the record as a single JSON line
+func writeHistoryFileRecord(w io.Writer, r *historyFileRecord) error {
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// readHistoryFile applies the records in the file to the routes and adjacencies,
+// later records replace earlier ones. A missing file is empty, and a partial
+// last line (from an interrupted write) is ignored
+func readHistoryFile(filePath string, routes map[HistoryKey]*HistoryRecord, adjacencies map[AsAdjacency]*AdjacencyRecord) error {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) == true {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line := 0
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(data)) > 0 {
+				fmt.Printf("Ignoring incomplete history record (%s): line %d\n", filePath, line+1)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line++
+
+		var fr historyFileRecord
+		err = json.Unmarshal(data, &fr)
+		if err != nil {
+			return fmt.Errorf("invalid history record (%s line %d): %v", filePath, line, err)
+		}
+
+		days, err := decodeHistoryDays(fr.Days)
+		if err != nil {
+			return fmt.Errorf("invalid history record days (%s line %d): %v", filePath, line, err)
+		}
+
+		if fr.Type == HISTORY_TYPE_ADJACENCY {
+			a := AsAdjacency{Neighbour: fr.Neighbour, As: fr.As}
+			if fr.Op == HISTORY_OP_DELETE {
+				delete(adjacencies, a)
+				continue
+			}
+
+			adjacencies[a] = &AdjacencyRecord{Adjacency: a, Count: fr.Count, FirstSeen: fr.FirstSeen, LastSeen: fr.LastSeen, Days: days}
+			continue
+		}
+
+		key := HistoryKey{As: fr.PeerAs, Route: fr.Route}
+		if fr.Op == HISTORY_OP_DELETE {
+			delete(routes, key)
+			continue
+		}
+
+		routes[key] = &HistoryRecord{PeerAs: fr.PeerAs, Route: fr.Route, Count: fr.Count, FirstSeen: fr.FirstSeen, LastSeen: fr.LastSeen, Days: days}
+	}
+}
+
+// fileSize returns the size of the file, or 0 if it does not exist
+func fileSize(filePath string) int64 {
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
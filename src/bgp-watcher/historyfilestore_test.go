@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// loadFileHistory returns a new history loaded from the file store in the directory
+func loadFileHistory(t *testing.T, path string) *History {
+
+	t.Helper()
+
+	store, err := NewFileHistoryStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	h := NewHistory(90, store)
+	h.Load()
+	store.Close()
+
+	return h
+}
+
+// TestFileHistoryStore checks that persisted changes and removals are loaded,
+// from the log and after compaction, and that a partial log record is ignored
+func TestFileHistoryStore(t *testing.T) {
+
+	path := t.TempDir()
+
+	store, err := NewFileHistoryStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	h := NewHistory(90, store)
+	h.Set(3356, "3356 15169", testTime(0))
+	h.Set(174, "174 15169", testTime(0))
+	h.PersistAll()
+
+	h.Set(3356, "3356 15169", testTime(60*24*100))
+	h.Set(3356, "3356 15169", testTime(60*24*100+1))
+	h.Persist()
+	store.Close()
+
+	check := func(name string, loaded *History) {
+
+		if count := loaded.GetRouteCount(3356, "3356 15169"); count != 2 {
+			t.Errorf("%s: expected a count of 2, count %d", name, count)
+		}
+		if _, ok := loaded.GetEntry(174, "174 15169"); ok == true {
+			t.Errorf("%s: expected the expired route to be removed", name)
+		}
+
+		e, _ := loaded.GetEntry(3356, "3356 15169")
+		if e.FirstSeen.Equal(testTime(0)) == false || e.LastSeen.Equal(testTime(60*24*100+1)) == false {
+			t.Errorf("%s: unexpected first/last seen: %v %v", name, e.FirstSeen, e.LastSeen)
+		}
+	}
+
+	check("log", loadFileHistory(t, path))
+
+	// An interrupted append leaves a partial record at the end of the log
+	f, err := os.OpenFile(store.logPath(), os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatalf("error opening log: %v", err)
+	}
+	f.WriteString(`{"op":"upsert","peer_as":64666,"rou`)
+	f.Close()
+
+	check("partial log", loadFileHistory(t, path))
+
+	store, err = NewFileHistoryStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+	err = store.Save([]*HistoryRecord{{PeerAs: 1299, Route: "1299 15169", Count: 1, FirstSeen: testTime(0),
+		LastSeen: testTime(0), Days: map[int64]uint64{historyDay(testTime(0)): 1}}}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("error saving after a partial log record: %v", err)
+	}
+
+	err = store.compact()
+	if err != nil {
+		t.Fatalf("error compacting: %v", err)
+	}
+	store.Close()
+
+	if size := fileSize(store.logPath()); size != 0 {
+		t.Errorf("expected an empty log after compaction, size %d", size)
+	}
+
+	loaded := loadFileHistory(t, path)
+	check("compacted", loaded)
+	if _, ok := loaded.GetEntry(1299, "1299 15169"); ok == false {
+		t.Errorf("expected the route saved after the partial record to be kept")
+	}
+}
+
+// TestFileHistoryStoreAdjacencies checks that the adjacencies are persisted apart
+// from the routes, in the log and once it has been compacted
+func TestFileHistoryStoreAdjacencies(t *testing.T) {
+
+	path := t.TempDir()
+
+	store, err := NewFileHistoryStore(path)
+	if err != nil {
+		t.Fatalf("error creating file store: %v", err)
+	}
+
+	h := NewHistory(90, store)
+	h.Load()
+	h.Set(3356, "3356 174 15169", testTime(0))
+	h.SetAdjacencies(newAsPathFromSegments([]AsPathSegment{{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: []uint32{3356, 174, 15169}}}), testTime(1))
+	h.Persist()
+	store.Close()
+
+	for _, name := range []string{"log", "compacted"} {
+		if name == "compacted" {
+			store, _ = NewFileHistoryStore(path)
+			err = store.compact()
+			if err != nil {
+				t.Fatalf("error compacting: %v", err)
+			}
+			store.Close()
+		}
+
+		loaded := loadFileHistory(t, path)
+
+		for _, a := range []AsAdjacency{{Neighbour: 3356, As: 174}, {Neighbour: 174, As: 15169}} {
+			if count := loaded.GetAdjacencyCount(a); count != 1 {
+				t.Errorf("%s: expected a count of 1 for %s, count %d", name, a, count)
+			}
+		}
+		if _, ok := loaded.GetEntry(3356, "3356 174 15169"); ok == false || loaded.Len() != 1 {
+			t.Errorf("%s: expected only the route to be held as a route, %d routes", name, loaded.Len())
+		}
+	}
+}
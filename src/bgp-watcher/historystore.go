@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	pgx "github.com/jackc/pgx"
+)
+
+// ##### Structs ##############################################################
+
+// HistoryRecord is a route used by a peer AS, as persisted by a HistoryStore.
+// The count is the total of the day counts within the history window
+type HistoryRecord struct {
+	PeerAs    uint32
+	Route     string
+	Count     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Days      map[int64]uint64
+}
+
+// AdjacencyRecord is an AS adjacency, as persisted by a HistoryStore. The count
+// is the total of the day counts within the history window
+type AdjacencyRecord struct {
+	Adjacency AsAdjacency
+	Count     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Days      map[int64]uint64
+}
+
+// HistoryStore persists the history routes and adjacencies e.g. to postgres or to local files
+type HistoryStore interface {
+	Name() string
+	Load() ([]*HistoryRecord, []*AdjacencyRecord, error)
+	Save(records []*HistoryRecord, removed []HistoryKey, adjacencies []*AdjacencyRecord, removedAdjacencies []AsAdjacency) error
+	Replace(records []*HistoryRecord, adjacencies []*AdjacencyRecord) error
+	Close() error
+}
+
+// PostgresHistoryStore persists the history to the "routes" and "adjacencies" tables
+type PostgresHistoryStore struct {
+}
+
+// ##### Methods ##############################################################
+
+// NewHistoryStore creates the store described by the configuration
+func NewHistoryStore(config *Config) (HistoryStore, error) {
+
+	switch strings.ToLower(config.HistoryStore) {
+	case "postgres", "database", "":
+		return NewPostgresHistoryStore(), nil
+	case "file":
+		return NewFileHistoryStore(config.HistoryPath)
+	default:
+		return nil, fmt.Errorf("unknown history store type: %s", config.HistoryStore)
+	}
+}
+
+// NewPostgresHistoryStore returns a new PostgresHistoryStore, using the global connection pool
+func NewPostgresHistoryStore() *PostgresHistoryStore {
+
+	return new(PostgresHistoryStore)
+}
+
+func (s *PostgresHistoryStore) Name() string {
+
+	return "postgres"
+}
+
+// Load returns all of the persisted routes and adjacencies
+func (s *PostgresHistoryStore) Load() ([]*HistoryRecord, []*AdjacencyRecord, error) {
+
+	records, err := s.loadRoutes()
+	if err != nil {
+		return records, make([]*AdjacencyRecord, 0), err
+	}
+
+	adjacencies, err := s.loadAdjacencies()
+	return records, adjacencies, err
+}
+
+// loadRoutes returns all of the persisted routes
+func (s *PostgresHistoryStore) loadRoutes() ([]*HistoryRecord, error) {
+
+	records := make([]*HistoryRecord, 0)
+
+	rows, err := pool.Query("select peer_as, route, count, first_seen, last_seen, days::text from routes")
+	if err != nil {
+		return records, err
+	}
+	defer rows.Close()
+
+	var days string
+
+	for rows.Next() {
+		r := new(HistoryRecord)
+
+		err = rows.Scan(&r.PeerAs, &r.Route, &r.Count, &r.FirstSeen, &r.LastSeen, &days)
+		if err != nil {
+			fmt.Printf("Error loading historic data: %v\n", err)
+			continue
+		}
+
+		r.Days, err = decodeHistoryDays([]byte(days))
+		if err != nil {
+			fmt.Printf("Error loading historic data days (%d %s): %v\n", r.PeerAs, r.Route, err)
+			continue
+		}
+
+		// Routes persisted before the days were recorded are counted on the day last seen
+		if len(r.Days) == 0 && r.Count > 0 {
+			r.Days[historyDay(r.LastSeen)] = r.Count
+		}
+
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+// loadAdjacencies returns all of the persisted adjacencies
+func (s *PostgresHistoryStore) loadAdjacencies() ([]*AdjacencyRecord, error) {
+
+	records := make([]*AdjacencyRecord, 0)
+
+	rows, err := pool.Query("select neighbour_as, asn, count, first_seen, last_seen, days::text from adjacencies")
+	if err != nil {
+		return records, err
+	}
+	defer rows.Close()
+
+	var days string
+
+	for rows.Next() {
+		r := new(AdjacencyRecord)
+
+		err = rows.Scan(&r.Adjacency.Neighbour, &r.Adjacency.As, &r.Count, &r.FirstSeen, &r.LastSeen, &days)
+		if err != nil {
+			fmt.Printf("Error loading historic adjacency: %v\n", err)
+			continue
+		}
+
+		r.Days, err = decodeHistoryDays([]byte(days))
+		if err != nil {
+			fmt.Printf("Error loading historic adjacency days (%s): %v\n", r.Adjacency, err)
+			continue
+		}
+
+		records = append(records, r)
+	}
+
+	return records, rows.Err()
+}
+
+// Save upserts the records and deletes the removed routes and adjacencies in a single transaction
+func (s *PostgresHistoryStore) Save(records []*HistoryRecord, removed []HistoryKey, adjacencies []*AdjacencyRecord, removedAdjacencies []AsAdjacency) error {
+
+	tx, err := pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, key := range removed {
+		_, err = tx.Exec("delete from routes where peer_as = $1 and route = $2", key.As, key.Route)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Prepare("upsert_route", `insert into routes (peer_as, route, count, first_seen, last_seen, days)
+		values ($1, $2, $3, $4, $5, $6::jsonb)
+		on conflict (peer_as, route) do update set count = excluded.count, first_seen = excluded.first_seen,
+		last_seen = excluded.last_seen, days = excluded.days`)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range records {
+		_, err = tx.Exec("upsert_route", r.PeerAs, r.Route, r.Count, r.FirstSeen, r.LastSeen, string(encodeHistoryDays(r.Days)))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, a := range removedAdjacencies {
+		_, err = tx.Exec("delete from adjacencies where neighbour_as = $1 and asn = $2", a.Neighbour, a.As)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Prepare("upsert_adjacency", `insert into adjacencies (neighbour_as, asn, count, first_seen, last_seen, days)
+		values ($1, $2, $3, $4, $5, $6::jsonb)
+		on conflict (neighbour_as, asn) do update set count = excluded.count, first_seen = excluded.first_seen,
+		last_seen = excluded.last_seen, days = excluded.days`)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range adjacencies {
+		_, err = tx.Exec("upsert_adjacency", r.Adjacency.Neighbour, r.Adjacency.As, r.Count, r.FirstSeen, r.LastSeen,
+			string(encodeHistoryDays(r.Days)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Replace deletes all of the routes and adjacencies and inserts the records, in a single transaction
+func (s *PostgresHistoryStore) Replace(records []*HistoryRecord, adjacencies []*AdjacencyRecord) error {
+
+	tx, err := pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("delete from routes")
+	if err != nil {
+		return err
+	}
+
+	// Massage the data into a format that can be used with
+	// the postgres COPY functionality e.g. fastest inserts
+	rows := make([][]interface{}, len(records))
+	for i, r := range records {
+		rows[i] = []interface{}{r.PeerAs, r.Route, r.Count, r.FirstSeen, r.LastSeen, string(encodeHistoryDays(r.Days))}
+	}
+
+	_, err = tx.CopyFrom(
+		pgx.Identifier{"routes"},
+		[]string{"peer_as", "route", "count", "first_seen", "last_seen", "days"},
+		pgx.CopyFromRows(rows))
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("delete from adjacencies")
+	if err != nil {
+		return err
+	}
+
+	rows = make([][]interface{}, len(adjacencies))
+	for i, r := range adjacencies {
+		rows[i] = []interface{}{r.Adjacency.Neighbour, r.Adjacency.As, r.Count, r.FirstSeen, r.LastSeen, string(encodeHistoryDays(r.Days))}
+	}
+
+	_, err = tx.CopyFrom(
+		pgx.Identifier{"adjacencies"},
+		[]string{"neighbour_as", "asn", "count", "first_seen", "last_seen", "days"},
+		pgx.CopyFromRows(rows))
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresHistoryStore) Close() error {
+
+	return nil
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	pgx "github.com/jackc/pgx"
 	flags "github.com/jessevdk/go-flags"
@@ -19,12 +22,23 @@ const APP_VERSION string = "0.0.3"
 // ##### Variables #####################################################################################################
 
 var (
-	configReader *viper.Viper
-	config       *Config
-	pool         *pgx.ConnPool
-	options      Options
-	asNames      *AsNames
-	history      *History
+	configReader    *viper.Viper
+	config          *Config
+	pool            *pgx.ConnPool
+	options         Options
+	command         string
+	asNames         *AsNames
+	history         *History
+	routeState      *RouteState
+	roaTable        *RoaTable
+	asRelationships *AsRelationships
+	rtrClient       *RtrClient
+	risLive         *RisLiveClient
+	bmpListener     *BmpListener
+	bgpSpeaker      *BgpSpeaker
+	apiServer       *ApiServer
+	detector        *Detector
+	reloadMux       sync.Mutex
 )
 
 // ##### Methods ##############################################################
@@ -37,7 +51,29 @@ func main() {
 	parseCommandLine()
 	initialiseConfiguration()
 	config = parseConfiguration()
-	configureDatabase()
+
+	if requiresDatabase() == true {
+		configureDatabase()
+
+		// Bring the schema up to date, unless it is being migrated by hand
+		if config.MigrateOnStartup == true && command != "migrate" {
+			_, err := migrateUp(latestMigrationVersion())
+			if err != nil {
+				fmt.Printf("Error migrating database schema: %v\n", err)
+				return
+			}
+		}
+	}
+
+	if command == "migrate" {
+		runMigrateCommand()
+		return
+	}
+
+	if command == "alerts" {
+		runAlertsCommand()
+		return
+	}
 
 	asNames = NewAsNames()
 	err := asNames.Update()
@@ -46,8 +82,51 @@ func main() {
 		return
 	}
 
-	history = NewHistory()
-	detector := NewDetector(config)
+	roaTable = NewRoaTable()
+	if len(config.RpkiVrpFile) > 0 {
+		fmt.Println("Loading RPKI VRP data")
+		err = roaTable.Load(config.RpkiVrpFile)
+		if err != nil {
+			fmt.Printf("Error loading RPKI VRP data: %v\n", err)
+			return
+		}
+		fmt.Printf("Loaded %d ROAs\n", roaTable.Len())
+	}
+
+	asRelationships = NewAsRelationships()
+	if len(config.AsRelationshipFile) > 0 {
+		fmt.Println("Loading AS relationship data")
+		err = asRelationships.Load(config.AsRelationshipFile)
+		if err != nil {
+			fmt.Printf("Error loading AS relationship data: %v\n", err)
+			return
+		}
+		fmt.Printf("Loaded %d AS relationships\n", asRelationships.Len())
+	}
+
+	if command == "replay" {
+		runReplayCommand()
+		return
+	}
+
+	// The RTR data is merged with any VRP file data once the first sync completes
+	if len(config.RtrServer) > 0 {
+		rtrClient = NewRtrClient(config.RtrServer, roaTable)
+		rtrClient.Start()
+	}
+
+	store, err := NewHistoryStore(config)
+	if err != nil {
+		fmt.Printf("Error opening history store: %v\n", err)
+		return
+	}
+	defer store.Close()
+
+	history = NewHistory(config.HistoryWindow, store)
+	history.SetKnownAdjacencies(neighbourAdjacencies(config))
+	routeState = NewRouteState()
+	detector = NewDetector(config)
+	detector.SetCollect(true)
 	historic := NewHistoric(detector, config)
 
 	if options.Reparse == true {
@@ -57,35 +136,95 @@ func main() {
 			historic.Update()
 		} else {
 			history.Load()
+
+			// The history is already built, but the route state still needs the current routes
+			if config.RibBootstrap == true {
+				historic.Bootstrap(time.Now(), false)
+			}
 		}
 	}
 
 	history.Summary()
+	routeState.Summary()
 
 	monitor := NewMonitor(detector, config.Processes)
 	monitor.Start()
 
-	// Ensure the application does not exit and we capture CTRL-C
+	// Stream updates as well as polling the update files, if a feed is configured
+	if len(config.RisLiveUrl) > 0 {
+		risLive = NewRisLiveClient(config.RisLiveUrl, config.RisLiveSubscriptions, detector, config)
+		risLive.Start()
+	}
+
+	// Accept BMP sessions from our routers, if a listen address is configured
+	if len(config.BmpListen) > 0 {
+		bmpListener = NewBmpListener(config.BmpListen, detector)
+		err = bmpListener.Start()
+		if err != nil {
+			fmt.Printf("Error starting BMP listener (%s): %v\n", config.BmpListen, err)
+			return
+		}
+	}
+
+	// Peer directly with our routers, if any neighbours are configured
+	if len(config.BgpNeighbours) > 0 {
+		bgpSpeaker = NewBgpSpeaker(config.BgpLocalAs, config.BgpRouterId, time.Duration(config.BgpHoldTime)*time.Second,
+			config.BgpListen, config.BgpNeighbours, detector)
+		err = bgpSpeaker.Start()
+		if err != nil {
+			fmt.Printf("Error starting BGP speaker (%s): %v\n", config.BgpListen, err)
+			return
+		}
+	}
+
+	// Serve the JSON API, if a listen address is configured
+	if len(config.ApiListen) > 0 {
+		apiServer = NewApiServer(config.ApiListen, detector, monitor)
+		err = apiServer.Start()
+		if err != nil {
+			fmt.Printf("Error starting API server (%s): %v\n", config.ApiListen, err)
+			return
+		}
+	}
+
+	// Ensure the application does not exit and we capture CTRL-C, a SIGHUP (or a change to the config file) reloads the config
+	watchConfiguration()
+
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
-		_ = <-sigs
+		for sig := range sigs {
+			if sig != syscall.SIGHUP {
+				break
+			}
+
+			reloadConfig(true)
+		}
 		done <- true
 	}()
 	<-done
 
+	if apiServer != nil {
+		apiServer.Close()
+	}
+
+	routeState.Summary()
+
 	fmt.Printf("\nPersisting historic data\n")
 	history.Persist()
 	fmt.Println("Persistance complete")
+
+	detector.Close()
 }
 
 //
 func parseCommandLine() {
 
 	var parser = flags.NewParser(&options, flags.Default)
+	parser.SubcommandsOptional = true
 	if _, err := parser.Parse(); err != nil {
 		fmt.Printf("%v\n", err)
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
@@ -94,6 +233,36 @@ func parseCommandLine() {
 			os.Exit(1)
 		}
 	}
+
+	if parser.Active != nil {
+		command = parser.Active.Name
+	}
+}
+
+// requiresDatabase returns whether the command uses the database, for the history
+// store, the alert store or the alerts it queries
+func requiresDatabase() bool {
+
+	if command == "alerts" || command == "migrate" {
+		return true
+	}
+
+	// Replays only read the history, and only from the store if they detect against it
+	if command == "replay" {
+		return config.HistoryStore == "postgres" && isStoreHistory(options.Replay.History) == true
+	}
+
+	if config.HistoryStore == "postgres" {
+		return true
+	}
+
+	for _, as := range config.AlertSinks {
+		if strings.ToLower(as.Type) == "database" {
+			return true
+		}
+	}
+
+	return false
 }
 
 //
@@ -128,8 +297,44 @@ func configureDatabase() {
 // 	return
 // }
 
-//
-func reloadConfig() {
+// reloadConfig applies changes to the detection rules, the other settings
+// require a restart. The rules are built from a copy of the configuration, which
+// is not changed as it is read without locking, and invalid rules are reported
+// and the current rules kept. Reloads are serialised, since both SIGHUP and
+// changes to the config file trigger them. If read is set the file is re-read first
+func reloadConfig(read bool) {
 
-	config = parseConfiguration()
+	reloadMux.Lock()
+	defer reloadMux.Unlock()
+
+	if config == nil || detector == nil {
+		return
+	}
+
+	if read == true {
+		err := configReader.ReadInConfig()
+		if err != nil {
+			fmt.Printf("Error reading config file: %v\n", err)
+			return
+		}
+	}
+
+	rules, err := parseRuleConfigs()
+	if err != nil {
+		fmt.Printf("Error decoding config rules: %v\n", err)
+		return
+	}
+
+	c := *config
+	c.Rules = rules
+
+	detectionRules, err := NewRules(&c)
+	if err != nil {
+		fmt.Printf("Error reloading detection rules: %v\n", err)
+		return
+	}
+
+	detector.SetRules(detectionRules)
+
+	fmt.Printf("Reloaded %d detection rules\n", len(detectionRules))
 }
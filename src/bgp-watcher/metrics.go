@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ##### Constants ############################################################
+
+const METRIC_COUNTER string = "counter"
+const METRIC_GAUGE string = "gauge"
+const METRIC_HISTOGRAM string = "histogram"
+
+// ##### Structs ##############################################################
+
+// Metric is a Prometheus counter, gauge or histogram, with a value for each set
+// of label values. Gauges with a collect function are read when scraped
+type Metric struct {
+	Name       string
+	Help       string
+	Type       string
+	mux        sync.Mutex
+	labelNames []string
+	buckets    []float64
+	values     map[string]*metricValue
+	collect    func() float64
+}
+
+// metricValue is the value of a metric for a set of label values
+type metricValue struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+// Metrics is a set of metrics, output in the Prometheus text format
+type Metrics struct {
+	mux     sync.Mutex
+	metrics []*Metric
+}
+
+// ##### Variables ############################################################
+
+var metrics = new(Metrics)
+
+// Ingest of the update files
+var (
+	metricMonitorChecks = metrics.NewCounter("bgpm_monitor_checks_total",
+		"Update checks started")
+	metricMonitorChecksSkipped = metrics.NewCounter("bgpm_monitor_checks_skipped_total",
+		"Update checks skipped as the previous check was still running")
+	metricFilesDiscovered = metrics.NewCounter("bgpm_update_files_discovered_total",
+		"Uncached update files listed by the collector", "collector")
+	metricFilesDownloaded = metrics.NewCounter("bgpm_update_files_downloaded_total",
+		"Update files downloaded to the cache", "collector")
+	metricFilesFailed = metrics.NewCounter("bgpm_update_files_failed_total",
+		"Update file listing, download or parse failures", "collector", "stage")
+	metricFileDuration = metrics.NewHistogram("bgpm_update_file_duration_seconds",
+		"Time taken to download and parse an update file", []float64{1, 5, 10, 30, 60, 120, 300}, "collector")
+	metricMrtRecords = metrics.NewCounter("bgpm_mrt_records_total",
+		"MRT records parsed", "collector")
+	metricMrtErrors = metrics.NewCounter("bgpm_mrt_parse_errors_total",
+		"MRT records that could not be parsed", "collector")
+	metricNewestUpdate = metrics.NewGauge("bgpm_newest_update_timestamp_seconds",
+		"Time of the newest update processed (Unix seconds)", "collector")
+)
+
+// Detection
+var (
+	metricUpdatesQueued = metrics.NewCounter("bgpm_detector_updates_queued_total",
+		"Updates queued for detection")
+	metricQueueDepth = metrics.NewGauge("bgpm_detector_queue_depth",
+		"Updates queued, or being processed, for detection")
+	metricAlerts = metrics.NewCounter("bgpm_alerts_total",
+		"Alerts sent to the alert sinks", "reason", "priority")
+)
+
+// History
+var (
+	metricHistoryRoutes = metrics.NewGaugeFunc("bgpm_history_routes",
+		"Routes (peer AS and path) held in the history", historyRoutes)
+	metricPersistDuration = metrics.NewHistogram("bgpm_history_persist_duration_seconds",
+		"Time taken to persist the history", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300}, "operation")
+	metricPersistFailures = metrics.NewCounter("bgpm_history_persist_failures_total",
+		"History persists that failed", "operation")
+)
+
+// ##### Methods ##############################################################
+
+// NewCounter adds a counter with the label names
+func (m *Metrics) NewCounter(name string, help string, labelNames ...string) *Metric {
+
+	return m.add(&Metric{Name: name, Help: help, Type: METRIC_COUNTER, labelNames: labelNames})
+}
+
+// NewGauge adds a gauge with the label names
+func (m *Metrics) NewGauge(name string, help string, labelNames ...string) *Metric {
+
+	return m.add(&Metric{Name: name, Help: help, Type: METRIC_GAUGE, labelNames: labelNames})
+}
+
+// NewGaugeFunc adds a gauge, without labels, whose value is read when scraped
+func (m *Metrics) NewGaugeFunc(name string, help string, collect func() float64) *Metric {
+
+	return m.add(&Metric{Name: name, Help: help, Type: METRIC_GAUGE, collect: collect})
+}
+
+// NewHistogram adds a histogram with the (ascending) bucket upper bounds and label names
+func (m *Metrics) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Metric {
+
+	return m.add(&Metric{Name: name, Help: help, Type: METRIC_HISTOGRAM, buckets: buckets, labelNames: labelNames})
+}
+
+func (m *Metrics) add(metric *Metric) *Metric {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	metric.values = make(map[string]*metricValue)
+	m.metrics = append(m.metrics, metric)
+
+	// Metrics without labels are output from the start, rather than from the first change
+	if len(metric.labelNames) == 0 && metric.collect == nil {
+		metric.get(nil)
+	}
+
+	return metric
+}
+
+// Write outputs all of the metrics in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) error {
+
+	m.mux.Lock()
+	list := append([]*Metric{}, m.metrics...)
+	m.mux.Unlock()
+
+	var b bytes.Buffer
+	for _, metric := range list {
+		metric.write(&b)
+	}
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Write(w)
+}
+
+// Inc adds one to the counter or gauge
+func (mt *Metric) Inc(labels ...string) {
+
+	mt.Add(1, labels...)
+}
+
+// Add adds to the counter or gauge, the label values are in the order of the names
+func (mt *Metric) Add(value float64, labels ...string) {
+
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	mt.get(labels).value += value
+}
+
+// Set sets the gauge
+func (mt *Metric) Set(value float64, labels ...string) {
+
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	mt.get(labels).value = value
+}
+
+// SetMax sets the gauge, if the value is greater than the current value
+func (mt *Metric) SetMax(value float64, labels ...string) {
+
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	v := mt.get(labels)
+	if value > v.value {
+		v.value = value
+	}
+}
+
+// Observe adds the value to the histogram
+func (mt *Metric) Observe(value float64, labels ...string) {
+
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	v := mt.get(labels)
+	for i, upper := range mt.buckets {
+		if value <= upper {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.value += value
+}
+
+// get returns the value for the label values, creating it if required. The lock must be held
+func (mt *Metric) get(labels []string) *metricValue {
+
+	key := strings.Join(labels, "\xff")
+	v := mt.values[key]
+	if v == nil {
+		v = &metricValue{labels: append([]string{}, labels...), counts: make([]uint64, len(mt.buckets))}
+		mt.values[key] = v
+	}
+
+	return v
+}
+
+// write outputs the metric and its values, ordered by the label values
+func (mt *Metric) write(b *bytes.Buffer) {
+
+	fmt.Fprintf(b, "# HELP %s %s\n", mt.Name, mt.Help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", mt.Name, mt.Type)
+
+	if mt.collect != nil {
+		fmt.Fprintf(b, "%s %s\n", mt.Name, formatMetricValue(mt.collect()))
+		return
+	}
+
+	mt.mux.Lock()
+	defer mt.mux.Unlock()
+
+	keys := make([]string, 0, len(mt.values))
+	for key := range mt.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := mt.values[key]
+		labels := formatMetricLabels(mt.labelNames, v.labels)
+
+		if mt.Type != METRIC_HISTOGRAM {
+			fmt.Fprintf(b, "%s%s %s\n", mt.Name, labels, formatMetricValue(v.value))
+			continue
+		}
+
+		bucketNames := append(append([]string{}, mt.labelNames...), "le")
+		bucketLabels := func(upper string) string {
+			return formatMetricLabels(bucketNames, append(append([]string{}, v.labels...), upper))
+		}
+
+		for i, upper := range mt.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", mt.Name, bucketLabels(formatMetricValue(upper)), v.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", mt.Name, bucketLabels("+Inf"), v.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", mt.Name, labels, formatMetricValue(v.value))
+		fmt.Fprintf(b, "%s_count%s %d\n", mt.Name, labels, v.count)
+	}
+}
+
+// formatMetricLabels returns the labels e.g. {collector="LONDON-UK"}, or an empty string if there are none
+func formatMetricLabels(names []string, values []string) string {
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		value = strings.Replace(value, `\`, `\\`, -1)
+		value = strings.Replace(value, "\n", `\n`, -1)
+		value = strings.Replace(value, `"`, `\"`, -1)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatMetricValue returns the value in the Prometheus format e.g. 1.5, 3 or +Inf
+func formatMetricValue(value float64) string {
+
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// historyRoutes returns the number of routes held in the history
+func historyRoutes() float64 {
+
+	if history == nil {
+		return 0
+	}
+
+	return float64(history.Len())
+}
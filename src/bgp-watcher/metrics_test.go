@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestMetricsFormat checks the Prometheus text output of each type of metric
+func TestMetricsFormat(t *testing.T) {
+
+	m := new(Metrics)
+	counter := m.NewCounter("test_total", "A counter", "collector", "stage")
+	gauge := m.NewGauge("test_gauge", "A gauge")
+	histogram := m.NewHistogram("test_seconds", "A histogram", []float64{0.5, 1}, "operation")
+	m.NewGaugeFunc("test_func", "A gauge func", func() float64 { return 42 })
+
+	counter.Inc("LONDON-UK", "list")
+	counter.Add(2, `NEW "YORK"`, "parse")
+	gauge.SetMax(10)
+	gauge.SetMax(5)
+	histogram.Observe(0.25, "persist")
+	histogram.Observe(2, "persist")
+
+	var b bytes.Buffer
+	m.Write(&b)
+
+	expected := strings.Join([]string{
+		"# HELP test_total A counter",
+		"# TYPE test_total counter",
+		`test_total{collector="LONDON-UK",stage="list"} 1`,
+		`test_total{collector="NEW \"YORK\"",stage="parse"} 2`,
+		"# HELP test_gauge A gauge",
+		"# TYPE test_gauge gauge",
+		"test_gauge 10",
+		"# HELP test_seconds A histogram",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{operation="persist",le="0.5"} 1`,
+		`test_seconds_bucket{operation="persist",le="1"} 1`,
+		`test_seconds_bucket{operation="persist",le="+Inf"} 2`,
+		`test_seconds_sum{operation="persist"} 2.25`,
+		`test_seconds_count{operation="persist"} 2`,
+		"# HELP test_func A gauge func",
+		"# TYPE test_func gauge",
+		"test_func 42",
+	}, "\n") + "\n"
+
+	if b.String() != expected {
+		t.Errorf("unexpected metrics\nexpected:\n%s\nactual:\n%s", expected, b.String())
+	}
+}
+
+// TestMetricsIngest checks that parsing an update file is counted
+func TestMetricsIngest(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+
+	records := metricMrtRecords.get([]string{TEST_COLLECTOR}).value
+	detectUpdates(t, []testUpdate{
+		{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"198.51.100.0/24"}},
+		{Timestamp: testTime(5), PeerAs: 3356, PeerIP: testPeerIP(0), Withdrawn: []string{"198.51.100.0/24"}},
+	})
+
+	if count := metricMrtRecords.get([]string{TEST_COLLECTOR}).value - records; count != 2 {
+		t.Errorf("expected 2 records to be counted, counted %v", count)
+	}
+	if newest := metricNewestUpdate.get([]string{TEST_COLLECTOR}).value; newest < float64(testTime(5).Unix()) {
+		t.Errorf("expected the newest update to be at least %d, %v", testTime(5).Unix(), newest)
+	}
+}
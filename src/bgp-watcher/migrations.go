@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ##### Constants ############################################################
+
+// Serialises migrations run by more than one instance at the same time
+const MIGRATION_LOCK_ID int64 = 0x62677077
+
+// ##### Structs ##############################################################
+
+// Migration is a versioned change to the database schema, and how to revert it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus is a migration and when, if at all, it was applied
+type MigrationStatus struct {
+	Migration *Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// ##### Variables ############################################################
+
+// migrations are applied in version order, and must never be edited once released.
+// The early migrations use "if not exists" so that databases created from the
+// original schema.sql are brought under version control without changes
+var migrations = []*Migration{
+	{
+		Version: 1,
+		Name:    "routes",
+		Up: `create table if not exists public.routes (
+				peer_as bigint not null,
+				route character varying(200) not null,
+				id bigserial not null constraint routes_pk primary key,
+				count bigint default 0 not null
+			);
+			create index if not exists routes_route_idx on public.routes using btree (route, peer_as);`,
+		Down: `drop table if exists public.routes;`,
+	},
+	{
+		Version: 2,
+		Name:    "alerts",
+		Up: `create table if not exists public.alerts (
+				id bigserial not null constraint alerts_pk primary key,
+				"timestamp" timestamp with time zone not null,
+				collector character varying(100) not null,
+				peer_as bigint not null,
+				peer_ip character varying(50) not null,
+				prefixes text[] default '{}'::text[] not null,
+				path character varying(2000) not null,
+				origin bigint default 0 not null,
+				reason character varying(50) not null,
+				priority integer not null,
+				data jsonb default '{}'::jsonb not null,
+				acknowledged boolean default false not null
+			);
+			create index if not exists alerts_timestamp_idx on public.alerts using btree ("timestamp");
+			create index if not exists alerts_peer_as_idx on public.alerts using btree (peer_as, origin);`,
+		Down: `drop table if exists public.alerts;`,
+	},
+	{
+		Version: 3,
+		Name:    "routes_history_days",
+		Up: `alter table public.routes add column if not exists first_seen timestamp with time zone default now() not null;
+			alter table public.routes add column if not exists last_seen timestamp with time zone default now() not null;
+			alter table public.routes add column if not exists days jsonb default '{}'::jsonb not null;`,
+		Down: `alter table public.routes drop column if exists days;
+			alter table public.routes drop column if exists last_seen;
+			alter table public.routes drop column if exists first_seen;`,
+	},
+	{
+		Version: 4,
+		Name:    "routes_peer_as_route_key",
+		Up: `delete from public.routes a using public.routes b where a.peer_as = b.peer_as and a.route = b.route and a.id < b.id;
+			create unique index if not exists routes_peer_as_route_key on public.routes using btree (peer_as, route);`,
+		Down: `drop index if exists public.routes_peer_as_route_key;`,
+	},
+	{
+		Version: 5,
+		Name:    "adjacencies",
+		Up: `create table if not exists public.adjacencies (
+				neighbour_as bigint not null,
+				asn bigint not null,
+				count bigint default 0 not null,
+				first_seen timestamp with time zone default now() not null,
+				last_seen timestamp with time zone default now() not null,
+				days jsonb default '{}'::jsonb not null,
+				constraint adjacencies_pk primary key (neighbour_as, asn)
+			);`,
+		Down: `drop table if exists public.adjacencies;`,
+	},
+	{
+		Version: 6,
+		Name:    "alerts_profiles",
+		Up: `alter table public.alerts add column if not exists profiles text[] default '{}'::text[] not null;
+			create index if not exists alerts_profiles_idx on public.alerts using gin (profiles);`,
+		Down: `drop index if exists public.alerts_profiles_idx;
+			alter table public.alerts drop column if exists profiles;`,
+	},
+}
+
+// ##### Methods ##############################################################
+
+// latestMigrationVersion returns the version of the last migration
+func latestMigrationVersion() int {
+
+	if len(migrations) == 0 {
+		return 0
+	}
+
+	return migrations[len(migrations)-1].Version
+}
+
+// ensureSchemaVersion creates the table recording the applied migrations, if required
+func ensureSchemaVersion() error {
+
+	_, err := pool.Exec(`create table if not exists public.schema_version (
+		version integer not null constraint schema_version_pk primary key,
+		name character varying(200) not null,
+		applied timestamp with time zone default now() not null)`)
+
+	return err
+}
+
+// schemaVersion returns the highest applied migration version, 0 if none have been applied
+func schemaVersion() (int, error) {
+
+	err := ensureSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = pool.QueryRow("select coalesce(max(version), 0) from public.schema_version").Scan(&version)
+
+	return version, err
+}
+
+// migrationStatus returns every migration and whether it has been applied
+func migrationStatus() ([]*MigrationStatus, error) {
+
+	statuses := make([]*MigrationStatus, 0, len(migrations))
+
+	err := ensureSchemaVersion()
+	if err != nil {
+		return statuses, err
+	}
+
+	applied := make(map[int]time.Time)
+
+	rows, err := pool.Query("select version, applied from public.schema_version")
+	if err != nil {
+		return statuses, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var ts time.Time
+
+		err = rows.Scan(&version, &ts)
+		if err != nil {
+			return statuses, err
+		}
+		applied[version] = ts
+	}
+
+	if rows.Err() != nil {
+		return statuses, rows.Err()
+	}
+
+	for _, m := range migrations {
+		ts, ok := applied[m.Version]
+		statuses = append(statuses, &MigrationStatus{Migration: m, Applied: ok, AppliedAt: ts})
+	}
+
+	return statuses, nil
+}
+
+// migrateUp applies the migrations after the current version, up to and including
+// the target version. Each migration is applied in its own transaction
+func migrateUp(target int) (int, error) {
+
+	err := ensureSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.Version > target {
+			break
+		}
+
+		ok, err := applyMigration(m, true)
+		if err != nil {
+			return applied, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+
+		if ok == true {
+			fmt.Printf("Applied migration %d (%s)\n", m.Version, m.Name)
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+// migrateDown reverts the applied migrations after the target version, latest first
+func migrateDown(target int) (int, error) {
+
+	err := ensureSchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+
+	reverted := 0
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.Version <= target {
+			break
+		}
+
+		ok, err := applyMigration(m, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+
+		if ok == true {
+			fmt.Printf("Reverted migration %d (%s)\n", m.Version, m.Name)
+			reverted++
+		}
+	}
+
+	return reverted, nil
+}
+
+// applyMigration runs the up or down SQL of the migration, and records it, in a
+// transaction. The migration lock is held and the version checked within the
+// transaction, so that another instance migrating at the same time cannot apply
+// it twice. Returns false if there was nothing to do
+func applyMigration(m *Migration, up bool) (bool, error) {
+
+	tx, err := pool.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("select pg_advisory_xact_lock($1)", MIGRATION_LOCK_ID)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	err = tx.QueryRow("select count(*) from public.schema_version where version = $1", m.Version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	if up == true {
+		if count > 0 {
+			return false, nil
+		}
+
+		_, err = tx.Exec(m.Up)
+		if err == nil {
+			_, err = tx.Exec("insert into public.schema_version (version, name) values ($1, $2)", m.Version, m.Name)
+		}
+	} else {
+		if count == 0 {
+			return false, nil
+		}
+
+		_, err = tx.Exec(m.Down)
+		if err == nil {
+			_, err = tx.Exec("delete from public.schema_version where version = $1", m.Version)
+		}
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
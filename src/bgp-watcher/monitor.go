@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -12,9 +13,21 @@ import (
 
 //
 type Monitor struct {
-	Processes int
-	updating  bool
-	detector  *Detector
+	Processes  int
+	updating   bool
+	detector   *Detector
+	mux        sync.Mutex
+	collectors map[string]*CollectorStatus
+}
+
+// CollectorStatus is the last update file processed for a data set (collector)
+type CollectorStatus struct {
+	Name      string    `json:"name"`
+	LastFile  string    `json:"last_file"`
+	FileTime  time.Time `json:"file_time"`
+	Processed time.Time `json:"processed"`
+	Files     uint64    `json:"files"`
+	Errors    uint64    `json:"errors"`
 }
 
 // ##### Methods ##############################################################
@@ -22,8 +35,9 @@ type Monitor struct {
 //
 func NewMonitor(d *Detector, processes int) *Monitor {
 	return &Monitor{
-		Processes: processes,
-		detector:  d,
+		Processes:  processes,
+		detector:   d,
+		collectors: make(map[string]*CollectorStatus),
 	}
 }
 
@@ -31,9 +45,15 @@ func NewMonitor(d *Detector, processes int) *Monitor {
 func (m *Monitor) Start() {
 
 	m.detector.Start()
+
+	// The history may be older than the window, if the watcher has not been running
+	history.ExpireNow()
+
 	c := cron.New()
 	c.AddFunc("@every 1m", m.check)
 	c.AddFunc("@every 5m", history.Persist)
+	c.AddFunc("@every 1h", history.ExpireNow)
+	c.AddFunc("@every 5m", routeState.Summary)
 	c.Start()
 
 	// DEBUG
@@ -43,18 +63,24 @@ func (m *Monitor) Start() {
 //
 func (m *Monitor) check() {
 
+	m.mux.Lock()
 	if m.updating == true {
+		m.mux.Unlock()
+		fmt.Println("Previous update check still running, skipping")
+		metricMonitorChecksSkipped.Inc()
 		return
 	}
-
 	m.updating = true
-	defer func() { m.updating = false }()
+	m.mux.Unlock()
+
+	defer func() {
+		m.mux.Lock()
+		m.updating = false
+		m.mux.Unlock()
+	}()
+	metricMonitorChecks.Inc()
 
-	// We use a temp history store so that detection is based
-	// on historic data, not data that is incoming. Hopefully our
-	// detection processing is fast enough to out run the adding of
-	// the temp data into the primary history store
-	tempHistory := new(History)
+	// The detector adds each path to the history once it has been detected against
 	mrtParser := new(MrtParser)
 
 	// Get a constant value for NOW
@@ -63,52 +89,10 @@ func (m *Monitor) check() {
 	year := ts.Year()
 	month := int(ts.Month())
 
-	//DEBUG
-	// for name := range config.DataSets {
-
-	// 	files, err := ioutil.ReadDir("./cache/" + name + "/2018/11/")
-	// 	if err != nil {
-	// 		log.Fatal(err)
-	// 	}
-
-	// 	// Now perform the actual downloading concurrently
-	// 	var wg sync.WaitGroup
-	// 	semaphore := make(chan struct{}, m.Processes)
-	// 	fmt.Println(len(files))
-
-	// 	for _, file := range files {
-	// 		wg.Add(1)
-
-	// 		go func(file string) {
-	// 			defer wg.Done()
-
-	// 			semaphore <- struct{}{} // Lock
-	// 			defer func() {
-	// 				<-semaphore // Unlock
-	// 			}()
-
-	// 			if strings.Contains(file, "20181109") == false && strings.Contains(file, "20181110") == false &&
-	// 				strings.Contains(file, "20181111") == false && strings.Contains(file, "20181112") == false &&
-	// 				strings.Contains(file, "20181113") == false && strings.Contains(file, "20181114") == false {
-	// 				return
-	// 			}
-
-	// 			//fmt.Println("Parsing file: " + file.Name())
-	// 			tempHistory, err = mrtParser.ParseAndDetect(m.detector, name, "./cache/"+name+"/2018/11/"+file)
-	// 			if err != nil {
-	// 				fmt.Printf("Error parsing update file (%s): %v\n", file, err)
-	// 			}
-
-	// 		}(file.Name())
-	// 	}
-	// 	wg.Wait()
-	// }
-
 	fmt.Printf("Processing updates starting: %v\n", time.Now().Format("2006-01-02T15:04:05"))
 
 	var wg sync.WaitGroup
 	var files []string
-	var file string
 	var err error
 
 	semaphore := make(chan struct{}, m.Processes)
@@ -116,13 +100,17 @@ func (m *Monitor) check() {
 
 		files, err = getUpdateFiles(name, url, year, month)
 		if err != nil {
-			return
+			fmt.Printf("Error listing update files (%s): %v\n", name, err)
+			metricFilesFailed.Inc(name, "list")
+			continue
 		}
+		metricFilesDiscovered.Add(float64(len(files)), name)
 
-		for _, file = range files {
+		// Each file is processed concurrently, so has its own error
+		for _, file := range files {
 			wg.Add(1)
 
-			go func(year int, month int, fileName string) {
+			go func(name string, url string, year int, month int, fileName string) {
 				defer wg.Done()
 
 				semaphore <- struct{}{} // Lock
@@ -130,27 +118,124 @@ func (m *Monitor) check() {
 					<-semaphore // Unlock
 				}()
 
+				start := time.Now()
+				defer func() {
+					metricFileDuration.Observe(time.Since(start).Seconds(), name)
+				}()
+
 				fmt.Printf("Uncached update file: %s\n", fileName)
-				err = downloadUpdateFile(name, url, year, month, fileName)
+				err := downloadUpdateFile(name, url, year, month, fileName)
 				if err != nil {
 					fmt.Printf("Error downloading update file (%s): %v\n", fileName, err)
+					metricFilesFailed.Inc(name, "download")
 				} else {
-					tempHistory, err = mrtParser.ParseAndDetect(m.detector, name, fmt.Sprintf("./cache/%s/%d/%d/%s", name, year, month, fileName))
+					metricFilesDownloaded.Inc(name)
+					err = mrtParser.ParseAndDetect(m.detector, name, fmt.Sprintf("./cache/%s/%d/%d/%s", name, year, month, fileName))
 					if err != nil {
-						fmt.Printf("Error parsing update file (%s): %v\n", file, err)
+						fmt.Printf("Error parsing update file (%s): %v\n", fileName, err)
+						metricFilesFailed.Inc(name, "parse")
 					}
 				}
-			}(year, month, file)
+				m.processed(name, fileName, err)
+			}(name, url, year, month, file)
 		}
 	}
 	wg.Wait()
 
-	// Now update our data to the primary history object
-	for peer, a := range tempHistory.data {
-		for route, count := range a {
-			history.SetAdd(peer, route, count)
+	fmt.Printf("Processing updates finished: %v\n", time.Now().Format("2006-01-02T15:04:05"))
+
+	m.printStatus()
+}
+
+// processed records that an update file for the data set has been processed, the
+// files are processed concurrently so only the latest file time is kept
+func (m *Monitor) processed(name string, fileName string, err error) {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	cs := m.collectors[name]
+	if cs == nil {
+		cs = &CollectorStatus{Name: name}
+		m.collectors[name] = cs
+	}
+
+	if err != nil {
+		cs.Errors++
+		return
+	}
+
+	cs.Files++
+	cs.Processed = time.Now().UTC()
+
+	ts, _ := updateFileTime(fileName)
+	if len(cs.LastFile) == 0 || ts.After(cs.FileTime) == true {
+		cs.LastFile = fileName
+		cs.FileTime = ts
+	}
+}
+
+// Collectors returns a copy of the status of each data set, ordered by name
+func (m *Monitor) Collectors() []CollectorStatus {
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	collectors := make([]CollectorStatus, 0, len(config.DataSets))
+	for name := range config.DataSets {
+		cs := CollectorStatus{Name: name}
+		if m.collectors[name] != nil {
+			cs = *m.collectors[name]
 		}
+		collectors = append(collectors, cs)
 	}
 
-	fmt.Printf("Processing updates finished: %v\n", time.Now().Format("2006-01-02T15:04:05"))
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].Name < collectors[j].Name })
+
+	return collectors
+}
+
+// printStatus outputs the state of the data sources used for detection
+func (m *Monitor) printStatus() {
+
+	if rtrClient != nil {
+		serial, age, count, ok := rtrClient.Status()
+		if ok == true {
+			fmt.Printf("RPKI status: serial %d, age %v, %d ROAs\n", serial, age.Truncate(time.Second), count)
+		} else {
+			fmt.Printf("RPKI status: not synchronised with %s\n", rtrClient.Address)
+		}
+	} else if roaTable.Len() > 0 {
+		fmt.Printf("RPKI status: %d ROAs (VRP file)\n", roaTable.Len())
+	}
+
+	if risLive != nil {
+		connected, messages, last := risLive.Status()
+		if connected == true {
+			fmt.Printf("RIS Live status: connected, %d updates, last %v\n", messages, last.Format("2006-01-02T15:04:05"))
+		} else {
+			fmt.Printf("RIS Live status: not connected to %s, %d updates\n", risLive.Url, messages)
+		}
+	}
+
+	if bmpListener != nil {
+		for _, r := range bmpListener.Routers() {
+			up, total := r.PeersUp()
+			state := "connected"
+			if r.Connected == false {
+				state = "disconnected"
+			}
+
+			fmt.Printf("BMP status: %s (%s) %s since %v, %d/%d peers up, %d messages\n", r.Name, r.Address, state,
+				r.Changed.Format("2006-01-02T15:04:05"), up, total, r.Messages)
+		}
+	}
+
+	if bgpSpeaker != nil {
+		for _, s := range bgpSpeaker.Sessions() {
+			state, changed, updates, peerAs := s.Status()
+			fmt.Printf("BGP status: %s (AS%d) %s since %v, %d updates\n", s.Neighbour.Name, peerAs,
+				state, changed.Format("2006-01-02T15:04:05"), updates)
+		}
+	}
 }
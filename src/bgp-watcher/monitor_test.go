@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMonitorCheck checks that the update files of a data set are downloaded
+// and detected concurrently, with each file's own result recorded in the status
+func TestMonitorCheck(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "updates.gz")
+	writeMrtFile(t, filePath, []testUpdate{
+		{Timestamp: testTime(0), PeerAs: 3356, PeerIP: testPeerIP(0), Path: []uint32{3356, 64666}, Announced: []string{"192.104.160.0/23"}},
+	})
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("error reading MRT file: %v", err)
+	}
+
+	// The listing has a valid update file, and one that is not gzipped
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "updates.20181112.0800.gz"):
+			w.Write(data)
+		case strings.HasSuffix(r.URL.Path, "updates.20181112.0805.gz"):
+			w.Write([]byte("not gzipped"))
+		default:
+			w.Write([]byte(`<a href="updates.20181112.0800.gz">0800</a><a href="updates.20181112.0805.gz">0805</a>`))
+		}
+	}))
+	defer server.Close()
+
+	config.DataSets = map[string]string{TEST_COLLECTOR: server.URL + "/"}
+
+	// The files are cached relative to the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("error getting working directory: %v", err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatalf("error changing working directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	now := time.Now()
+	err = checkDirectory(TEST_COLLECTOR, now.Year(), int(now.Month()))
+	if err != nil {
+		t.Fatalf("error creating cache directories: %v", err)
+	}
+
+	sink := new(testSink)
+	detector := NewDetector(config)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.StartInOrder()
+
+	m := NewMonitor(detector, 2)
+	m.check()
+
+	detector.Wait()
+	detector.Close()
+
+	assertAlerts(t, sink.Alerts(),
+		"High first_appearance AS3356 [192.104.160.0/23] path [3356 64666]",
+		"High invalid_prefix_peer AS3356 [192.104.160.0/23] path [3356 64666]")
+
+	collectors := m.Collectors()
+	if len(collectors) != 1 || collectors[0].Files != 1 || collectors[0].Errors != 1 ||
+		collectors[0].LastFile != "updates.20181112.0800.gz" {
+		t.Errorf("unexpected collector status: %+v", collectors)
+	}
+}
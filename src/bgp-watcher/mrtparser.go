@@ -5,12 +5,19 @@ import (
 	"compress/gzip"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"time"
 
 	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
 	mrt "github.com/osrg/gobgp/pkg/packet/mrt"
 )
 
+// ##### Constants ############################################################
+
+// MRT_MAX_RECORD_SIZE is the largest MRT record that will be read
+const MRT_MAX_RECORD_SIZE int = 16 * 1024 * 1024
+
 // ##### Structs ##############################################################
 
 type MrtParser struct {
@@ -19,7 +26,7 @@ type MrtParser struct {
 // ##### Methods ##############################################################
 
 //
-func (b *MrtParser) ParseAndCollect(detector *Detector, filePath string) error {
+func (b *MrtParser) ParseAndCollect(detector *Detector, name string, filePath string) error {
 
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -34,15 +41,19 @@ func (b *MrtParser) ParseAndCollect(detector *Detector, filePath string) error {
 	scanner := bufio.NewScanner(gzipReader)
 	scanner.Split(mrt.SplitMrt)
 
-	var last uint32
+	// The number of records parsed, and that could not be parsed, are counted once the file is finished
+	var records, parseErrors float64
+	defer func() {
+		metricMrtRecords.Add(records, name)
+		metricMrtErrors.Add(parseErrors, name)
+	}()
+
 	var data []byte
 	var hdr *mrt.MRTHeader
 	var msg *mrt.MRTMessage
 	var bgp4mp *mrt.BGP4MPMessage
 	var bgpUpdate *bgp.BGPUpdate
-	var pa bgp.PathAttributeInterface
-	var paAsPath *bgp.PathAttributeAsPath
-	var asValue bgp.AsPathParamInterface
+	var asPath *AsPath
 
 entries:
 	for scanner.Scan() {
@@ -57,8 +68,10 @@ entries:
 		msg, err = mrt.ParseMRTBody(hdr, data[mrt.MRT_COMMON_HEADER_LEN:])
 		if err != nil {
 			log.Printf("could not parse mrt body: %v", err)
+			parseErrors++
 			continue entries
 		}
+		records++
 
 		switch msg.Body.(type) {
 		case *mrt.BGP4MPMessage:
@@ -70,82 +83,15 @@ entries:
 
 				bgpUpdate = bgp4mp.BGPMessage.Body.(*bgp.BGPUpdate)
 
-				// for a, b := range bgpUpdate.WithdrawnRoutes {
-				// 	fmt.Printf("%v:%v\n", a, b)0
-				// }
-
-				for _, pa = range bgpUpdate.PathAttributes {
-
-					if pa.GetType() != bgp.BGP_ATTR_TYPE_AS_PATH {
-						continue
-					}
-
-					paAsPath = pa.(*bgp.PathAttributeAsPath)
-
-					for _, asValue = range paAsPath.Value {
-
-						switch asValue.(type) {
-						case *bgp.As4PathParam:
-							//temp1 := asValue.(*bgp.As4PathParam).AS
-							//fmt.Printf("LAST: %v\n", temp1[len(temp1)-1])
-
-							//last = temp1[len(temp1)-1]
-
-							last = asValue.(*bgp.As4PathParam).AS[len(asValue.(*bgp.As4PathParam).AS)-1]
-
-							// Is the last part of the path one of ours
-							if detector.CheckTargetAs(last) == true {
-
-								history.Set(bgp4mp.PeerAS, asValue.String())
-								// if asns[bgp4mp.PeerAS] == nil {
-								// 	asns[bgp4mp.PeerAS] = make(map[string]uint64)
-								// }
-								// asns[bgp4mp.PeerAS][asValue.String()]++
-								continue entries
-							}
-
-							// if last == 34178 {
-
-							// 	fmt.Println(bgp4mp.String())
-							// 	for _, b := range bgpUpdate.NLRI {bgp
-
-							// 		// if d.CheckPrefix(b) == false {
-							// 		// 	continue
-							// 		// }
-
-							// 		fmt.Printf("%v\n", b)
-							// 	}
-							// 	fmt.Printf("-----------------------\n")
-
-							// 	//fmt.Println(bgp4mp.String())
-							// 	//fmt.Println("QINETIQ")
-							// 	//fmt.Printf("%v\n", asValue)
-							// 	//fmt.Printf("-----------------------\n")
-
-							// 	if asns[bgp4mp.PeerAS] == nil {
-							// 		asns[bgp4mp.PeerAS] = make(map[string]uint64)
-							// 	}
-							// 	asns[bgp4mp.PeerAS][asValue.String()]++
-
-							// 	// for _, e := range asValue.(*bgp.As4PathParam).AS {
-							// 	// 	fmt.Printf("EE1 %v\n", e)
-							// 	// 	//fmt.Printf("FF1 %v\n", f)
-							// 	// }
-							// }
-							//fmt.Printf("LAST2: %v", asValue.(*bgp.As4PathParam).AS[len(asValue.(*bgp.As4PathParam).AS)-1])
-							// for _, e := range asValue.(*bgp.As4PathParam).AS {
-							// 	fmt.Printf("EE1 %v\n", e)
-							// 	//fmt.Printf("FF1 %v\n", f)
-							// }
-							break
-
-						case *bgp.AsPathParam:
-							//temp1 := asValue.(*bgp.AsPathParam).AS
-							//fmt.Printf("LAST: %v", asValue.(*bgp.AsPathParam).AS[len(asValue.(*bgp.AsPathParam).AS)-1])
+				asPath = NewAsPath(bgpUpdate.PathAttributes)
+				if asPath == nil || len(asPath.Path) == 0 {
+					continue entries
+				}
 
-							break
-						}
-					}
+				// Is the origin of the path one of ours
+				if detector.CheckOrigin(asPath) == true {
+					history.Set(bgp4mp.PeerAS, asPath.String(), hdr.GetTime())
+					history.SetAdjacencies(asPath, hdr.GetTime())
 				}
 
 				// case *mrt.PeerIndexTable:
@@ -166,33 +112,37 @@ entries:
 	return nil
 }
 
-//
-func (b *MrtParser) ParseAndDetect(detector *Detector, name string, filePath string) (*History, error) {
-
-	history := &History{data: make(map[uint32]map[string]uint64)}
+// ParseAndDetect passes the updates of the file to the detector, which adds the
+// paths to the history once they have been detected against, if it collects them
+func (b *MrtParser) ParseAndDetect(detector *Detector, name string, filePath string) error {
 
 	f, err := os.Open(filePath)
 	if err != nil {
-		return history, err
+		return err
 	}
+	defer f.Close()
 
 	gzipReader, err := gzip.NewReader(f)
 	if err != nil {
-		return history, fmt.Errorf("couldn't create gzip reader: %v", err)
+		return fmt.Errorf("couldn't create gzip reader: %v", err)
 	}
 
 	scanner := bufio.NewScanner(gzipReader)
 	scanner.Split(mrt.SplitMrt)
 
-	var last uint32
+	var records, parseErrors float64
+	defer func() {
+		metricMrtRecords.Add(records, name)
+		metricMrtErrors.Add(parseErrors, name)
+	}()
+
 	var data []byte
 	var hdr *mrt.MRTHeader
 	var msg *mrt.MRTMessage
 	var bgp4mp *mrt.BGP4MPMessage
 	var bgpUpdate *bgp.BGPUpdate
-	var pa bgp.PathAttributeInterface
-	var paAsPath *bgp.PathAttributeAsPath
-	var asValue bgp.AsPathParamInterface
+	var nlri []bgp.AddrPrefixInterface
+	var withdrawn []bgp.AddrPrefixInterface
 
 entries:
 	for scanner.Scan() {
@@ -201,14 +151,16 @@ entries:
 		hdr = &mrt.MRTHeader{}
 		err = hdr.DecodeFromBytes(data[:mrt.MRT_COMMON_HEADER_LEN])
 		if err != nil {
-			return history, err
+			return err
 		}
 
 		msg, err = mrt.ParseMRTBody(hdr, data[mrt.MRT_COMMON_HEADER_LEN:])
 		if err != nil {
 			log.Printf("could not parse mrt body: %v", err)
+			parseErrors++
 			continue entries
 		}
+		records++
 
 		switch msg.Body.(type) {
 		case *mrt.BGP4MPMessage:
@@ -232,63 +184,232 @@ entries:
 
 				bgpUpdate = bgp4mp.BGPMessage.Body.(*bgp.BGPUpdate)
 
-				// for a, b := range bgpUpdate.WithdrawnRoutes {
-				// 	fmt.Printf("%v:%v\n", a, b)0
-				// }
+				nlri, withdrawn = extractPrefixes(bgpUpdate)
+				detectUpdate(detector, name, hdr.GetTime(), bgp4mp.PeerAS, bgp4mp.PeerIpAddress,
+					NewAsPath(bgpUpdate.PathAttributes), nlri, withdrawn)
+			}
+		}
+	}
+
+	return nil
+}
 
-				for _, pa = range bgpUpdate.PathAttributes {
+// ParseRib loads a TABLE_DUMP_V2 RIB snapshot (e.g. a RIS bview file), applying
+// the routes for our prefixes to the route state. If collect is set then the
+// paths originated by our AS's are also added to the history, once per peer
+func (b *MrtParser) ParseRib(detector *Detector, name string, filePath string, collect bool) (int, error) {
 
-					if pa.GetType() != bgp.BGP_ATTR_TYPE_AS_PATH {
-						continue
-					}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
 
-					paAsPath = pa.(*bgp.PathAttributeAsPath)
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't create gzip reader: %v", err)
+	}
 
-					for _, asValue = range paAsPath.Value {
+	// RIB records for a full table can exceed the default token size
+	scanner := bufio.NewScanner(gzipReader)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), MRT_MAX_RECORD_SIZE)
+	scanner.Split(mrt.SplitMrt)
 
-						switch asValue.(type) {
-						case *bgp.As4PathParam:
+	var records, parseErrors float64
+	defer func() {
+		metricMrtRecords.Add(records, name)
+		metricMrtErrors.Add(parseErrors, name)
+	}()
 
-							last = asValue.(*bgp.As4PathParam).AS[len(asValue.(*bgp.As4PathParam).AS)-1]
+	var data []byte
+	var hdr *mrt.MRTHeader
+	var msg *mrt.MRTMessage
+	var rib *mrt.Rib
+	var peer *mrt.Peer
+	var asPath *AsPath
+	var peers []*mrt.Peer
+	var nlri []bgp.AddrPrefixInterface
+	var monitored bool
+	routes := 0
 
-							// Is the last part of the path one of ours
-							if detector.CheckTargetAs(last) == true {
+entries:
+	for scanner.Scan() {
+		data = scanner.Bytes()
+
+		hdr = &mrt.MRTHeader{}
+		err = hdr.DecodeFromBytes(data[:mrt.MRT_COMMON_HEADER_LEN])
+		if err != nil {
+			return routes, err
+		}
+
+		if hdr.Type != mrt.TABLE_DUMPv2 {
+			continue entries
+		}
+
+		msg, err = mrt.ParseMRTBody(hdr, data[mrt.MRT_COMMON_HEADER_LEN:])
+		if err != nil {
+			log.Printf("could not parse mrt body: %v", err)
+			parseErrors++
+			continue entries
+		}
+		records++
 
-								//historyStore.Set(bgp4mp.PeerAS, asValue.String())
+		switch msg.Body.(type) {
+		case *mrt.PeerIndexTable:
 
-								//fmt.Println(bgp4mp.String())
-								detector.Add(name, hdr.GetTime(), bgp4mp.PeerAS, bgp4mp.PeerIpAddress,
-									asValue.(*bgp.As4PathParam).String(), asValue.(*bgp.As4PathParam).AS, bgpUpdate.NLRI)
-								continue entries
-							}
+			// The RIB entries reference the peers by their index in this table
+			peers = msg.Body.(*mrt.PeerIndexTable).Peers
 
-							// Is one of the prefixes one of ours
-							for _, b := range bgpUpdate.NLRI {
+		case *mrt.Rib:
 
-								if detector.CheckPrefix(b) == false {
-									continue
-								}
+			rib = msg.Body.(*mrt.Rib)
+			if rib.RouteFamily != bgp.RF_IPv4_UC && rib.RouteFamily != bgp.RF_IPv6_UC {
+				continue entries
+			}
 
-								//fmt.Println(bgp4mp.String())
+			nlri = []bgp.AddrPrefixInterface{rib.Prefix}
+			monitored = detector.CheckPrefix(rib.Prefix)
 
-								detector.Add(name, hdr.GetTime(), bgp4mp.PeerAS, bgp4mp.PeerIpAddress,
-									asValue.(*bgp.As4PathParam).String(), asValue.(*bgp.As4PathParam).AS, bgpUpdate.NLRI)
-								continue entries
-							}
+			for _, e := range rib.Entries {
+				if int(e.PeerIndex) >= len(peers) {
+					continue
+				}
+				peer = peers[e.PeerIndex]
 
-							break
+				asPath = NewAsPath(e.PathAttributes)
+				if asPath == nil || len(asPath.Path) == 0 {
+					continue
+				}
 
-						case *bgp.AsPathParam:
-							//temp1 := asValue.(*bgp.AsPathParam).AS
-							//fmt.Printf("LAST: %v", asValue.(*bgp.AsPathParam).AS[len(asValue.(*bgp.AsPathParam).AS)-1])
+				// Is the origin of the path one of ours
+				if collect == true && detector.CheckOrigin(asPath) == true {
+					history.Set(peer.AS, asPath.String(), hdr.GetTime())
+					history.SetAdjacencies(asPath, hdr.GetTime())
+				}
 
-							break
-						}
-					}
+				if monitored == true {
+					announceRoutes(detector, name, time.Unix(int64(e.OriginatedTime), 0), peer.AS, peer.IpAddress, asPath, nlri)
+					routes++
 				}
 			}
 		}
 	}
 
-	return history, nil
+	return routes, scanner.Err()
+}
+
+// extractPrefixes returns the announced and withdrawn IPv4/IPv6 unicast prefixes
+// of an update, from both the NLRI/withdrawn routes fields and from the
+// MP_REACH_NLRI/MP_UNREACH_NLRI attributes
+func extractPrefixes(bgpUpdate *bgp.BGPUpdate) ([]bgp.AddrPrefixInterface, []bgp.AddrPrefixInterface) {
+
+	announced := make([]bgp.AddrPrefixInterface, 0, len(bgpUpdate.NLRI))
+	withdrawn := make([]bgp.AddrPrefixInterface, 0, len(bgpUpdate.WithdrawnRoutes))
+
+	for _, n := range bgpUpdate.NLRI {
+		announced = append(announced, n)
+	}
+
+	for _, w := range bgpUpdate.WithdrawnRoutes {
+		withdrawn = append(withdrawn, w)
+	}
+
+	for _, pa := range bgpUpdate.PathAttributes {
+
+		switch pa.(type) {
+		case *bgp.PathAttributeMpReachNLRI:
+			mpReach := pa.(*bgp.PathAttributeMpReachNLRI)
+			if isUnicast(mpReach.AFI, mpReach.SAFI) == true {
+				announced = append(announced, mpReach.Value...)
+			}
+
+		case *bgp.PathAttributeMpUnreachNLRI:
+			mpUnreach := pa.(*bgp.PathAttributeMpUnreachNLRI)
+			if isUnicast(mpUnreach.AFI, mpUnreach.SAFI) == true {
+				withdrawn = append(withdrawn, mpUnreach.Value...)
+			}
+		}
+	}
+
+	return announced, withdrawn
+}
+
+// isUnicast returns true if the AFI/SAFI pair is IPv4 or IPv6 unicast
+func isUnicast(afi uint16, safi uint8) bool {
+
+	if safi != bgp.SAFI_UNICAST {
+		return false
+	}
+
+	return afi == bgp.AFI_IP || afi == bgp.AFI_IP6
+}
+
+// monitoredPrefixes returns the prefixes that are, cover or are covered by one of our prefixes
+func monitoredPrefixes(detector *Detector, prefixes []bgp.AddrPrefixInterface) []bgp.AddrPrefixInterface {
+
+	monitored := make([]bgp.AddrPrefixInterface, 0)
+	for _, p := range prefixes {
+		if detector.CheckPrefix(p) == true {
+			monitored = append(monitored, p)
+		}
+	}
+
+	return monitored
+}
+
+// detectUpdate applies an update to the route state and queues it for detection
+// if it withdraws or announces one of our prefixes, or originates from one of our
+// AS's. It is shared by all of the update sources e.g. MRT files and RIS Live
+func detectUpdate(detector *Detector, name string, timestamp time.Time, peerAs uint32, peerIP net.IP,
+	asPath *AsPath, nlri []bgp.AddrPrefixInterface, withdrawn []bgp.AddrPrefixInterface) {
+
+	metricNewestUpdate.SetMax(float64(timestamp.Unix()), name)
+
+	// Apply the withdrawals of our prefixes to the route state and check them
+	withdrawn = monitoredPrefixes(detector, withdrawn)
+	if len(withdrawn) > 0 {
+		for _, w := range withdrawn {
+			routeState.Withdraw(name, peerIP, peerAs, w.String(), timestamp)
+		}
+
+		detector.AddWithdrawal(name, timestamp, peerAs, peerIP, withdrawn)
+	}
+
+	if asPath == nil || len(asPath.Path) == 0 {
+		return
+	}
+
+	// Is the origin of the path one of ours, or is one of the prefixes one of ours
+	if detector.CheckOrigin(asPath) == true || len(monitoredPrefixes(detector, nlri)) > 0 {
+
+		announceRoutes(detector, name, timestamp, peerAs, peerIP, asPath, nlri)
+		detector.Add(name, timestamp, peerAs, peerIP, asPath, nlri)
+	}
+}
+
+// withdrawPeer withdraws all of our prefixes that the peer had announced e.g.
+// when a BMP monitored peer or a BGP neighbour session goes down
+func withdrawPeer(detector *Detector, name string, peerIP net.IP, peerAs uint32, timestamp time.Time) {
+
+	withdrawn := make([]bgp.AddrPrefixInterface, 0)
+	for _, p := range routeState.WithdrawPeer(name, peerIP, timestamp) {
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			continue
+		}
+		withdrawn = append(withdrawn, prefix)
+	}
+
+	if len(withdrawn) > 0 {
+		detector.AddWithdrawal(name, timestamp, peerAs, peerIP, withdrawn)
+	}
+}
+
+// announceRoutes applies the announcements of our prefixes to the route state
+func announceRoutes(detector *Detector, name string, timestamp time.Time, peerAs uint32, peerIP net.IP,
+	asPath *AsPath, nlri []bgp.AddrPrefixInterface) {
+
+	for _, n := range monitoredPrefixes(detector, nlri) {
+		routeState.Announce(name, peerIP, peerAs, n.String(), asPath.String(), asPath.Origin, timestamp)
+	}
 }
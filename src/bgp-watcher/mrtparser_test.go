@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestMrtParserRib checks that a RIB snapshot seeds the route state with the
+// routes of our prefixes, looking up the peers in the peer index table and
+// skipping entries of peers that are not in it, and that the paths from our
+// AS's are only added to the history when collecting
+func TestMrtParserRib(t *testing.T) {
+
+	ribs := []testRib{
+		{Prefix: TEST_PREFIX_V4, Entries: []testRibEntry{
+			{PeerIndex: 0, Path: []uint32{3356, 15169}},
+			{PeerIndex: 1, Path: []uint32{174, 15169}},
+			{PeerIndex: 5, Path: []uint32{64666, 15169}},
+		}},
+		{Prefix: TEST_PREFIX_V6, Entries: []testRibEntry{
+			{PeerIndex: 1, Path: []uint32{174, 15169}},
+		}},
+		{Prefix: "198.51.100.0/24", Entries: []testRibEntry{
+			{PeerIndex: 0, Path: []uint32{3356, 15169}},
+			{PeerIndex: 1, Path: []uint32{174, 64666}},
+		}},
+	}
+
+	filePath := filepath.Join(t.TempDir(), "bview.20181112.0800.gz")
+	writeRibFile(t, filePath, []uint32{3356, 174}, ribs)
+
+	for _, collect := range []bool{false, true} {
+		newTestEnvironment(t, testCountries)
+
+		routes, err := new(MrtParser).ParseRib(NewDetector(config), TEST_COLLECTOR, filePath, collect)
+		if err != nil {
+			t.Fatalf("error parsing RIB file: %v", err)
+		}
+		if routes != 3 {
+			t.Errorf("expected 3 routes of our prefixes, %d (collect %v)", routes, collect)
+		}
+
+		peers := make(map[string]Route)
+		for _, p := range []string{TEST_PREFIX_V4, TEST_PREFIX_V6} {
+			for _, r := range routeState.Routes(p) {
+				peers[p+" "+r.PeerIP.String()] = r
+			}
+		}
+		if len(peers) != 3 {
+			t.Errorf("expected 3 routes in the route state, %d (collect %v)", len(peers), collect)
+		}
+		for key, path := range map[string]string{
+			TEST_PREFIX_V4 + " " + testPeerIP(0): "3356 15169",
+			TEST_PREFIX_V4 + " " + testPeerIP(1): "174 15169",
+			TEST_PREFIX_V6 + " " + testPeerIP(1): "174 15169",
+		} {
+			if r, ok := peers[key]; ok == false || r.Path != path || r.Active == false {
+				t.Errorf("expected an active route (%s) with path %s, got %+v (collect %v)", key, path, r, collect)
+			}
+		}
+
+		expected := map[uint32]map[string]uint64{
+			3356:  {"3356 15169": 0},
+			174:   {"174 15169": 0, "174 64666": 0},
+			64666: {"64666 15169": 0},
+		}
+		if collect == true {
+			expected[3356]["3356 15169"] = 2
+			expected[174]["174 15169"] = 2
+		}
+		for as, paths := range expected {
+			for path, count := range paths {
+				if actual := history.GetRouteCount(as, path); actual != count {
+					t.Errorf("expected AS%d path %s to have been seen %d times, %d (collect %v)", as, path, count, actual, collect)
+				}
+			}
+		}
+	}
+}
@@ -3,6 +3,42 @@ package main
 // ##### Structs ##############################################################
 
 type Options struct {
-	Verbose bool `short:"v" long:"verbose" description:"Show verbose debug information"`
-	Reparse bool `short:"r" long:"reparse" description:"Performs history re-parse"`
+	Verbose bool           `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Reparse bool           `short:"r" long:"reparse" description:"Performs history re-parse"`
+	Alerts  AlertsOptions  `command:"alerts" description:"Lists, filters and acknowledges persisted alerts"`
+	Replay  ReplayOptions  `command:"replay" description:"Replays update files through the detector, writing the alerts to a file"`
+	Migrate MigrateOptions `command:"migrate" description:"Applies, reverts or lists the database schema migrations"`
+}
+
+type AlertsOptions struct {
+	From           string  `long:"from" description:"Only show alerts at or after this time (2006-01-02 or 2006-01-02T15:04:05)"`
+	To             string  `long:"to" description:"Only show alerts at or before this time (2006-01-02 or 2006-01-02T15:04:05)"`
+	As             uint32  `long:"as" description:"Only show alerts where the AS is the peer or origin"`
+	Prefix         string  `long:"prefix" description:"Only show alerts for the prefix, or more specifics of it"`
+	Reason         string  `long:"reason" description:"Only show alerts with the reason code e.g. sub_prefix_hijack"`
+	Profile        string  `long:"profile" description:"Only show alerts tagged with the monitoring profile"`
+	Priority       string  `long:"priority" description:"Only show alerts of the priority or higher (high, medium, low)"`
+	Unacknowledged bool    `short:"u" long:"unacknowledged" description:"Only show unacknowledged alerts"`
+	Limit          int     `short:"l" long:"limit" default:"100" description:"Maximum number of alerts to show"`
+	Acknowledge    []int64 `short:"a" long:"ack" description:"Acknowledge the alert with the ID (can be repeated)"`
+}
+
+type ReplayOptions struct {
+	From        string   `long:"from" description:"Replay the cached update files at or after this time (2006-01-02 or 2006-01-02T15:04:05)"`
+	To          string   `long:"to" description:"Replay the cached update files at or before this time (2006-01-02 or 2006-01-02T15:04:05)"`
+	DataSets    []string `long:"data-set" description:"Only replay the cached update files of the data set (can be repeated)"`
+	Name        string   `long:"name" default:"replay" description:"Collector name for update files outside of the cache"`
+	History     string   `long:"history" default:"store" description:"History to detect against: store (the configured history store, read only), none or a snapshot file"`
+	SaveHistory string   `long:"save-history" description:"Save the history to a snapshot file, for use by later replays"`
+	Output      string   `short:"o" long:"output" default:"./alerts/replay.jsonl" description:"File to write the alerts to (JSON lines), it is overwritten"`
+	Args        struct {
+		Files []string `positional-arg-name:"FILE" description:"Update files or globs to replay e.g. ./cache/LONDON-UK/2018/11/updates.20181112.*"`
+	} `positional-args:"yes"`
+}
+
+type MigrateOptions struct {
+	Version int `long:"version" default:"-1" description:"Version to migrate up/down to, the latest (up) or the previous (down) by default"`
+	Args    struct {
+		Action string `positional-arg-name:"ACTION" description:"up, down or status" required:"yes"`
+	} `positional-args:"yes"`
 }
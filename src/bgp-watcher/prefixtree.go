@@ -0,0 +1,291 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Structs ##############################################################
+
+// PrefixMatchType describes how an announced prefix relates to a monitored prefix
+type PrefixMatchType int
+
+// PrefixMatchExact is an announcement of exactly a monitored prefix,
+// PrefixMatchMoreSpecific is an announcement inside a monitored prefix
+// (sub-prefix hijack) and PrefixMatchLessSpecific is an announcement that
+// covers a monitored prefix
+const (
+	PrefixMatchExact        PrefixMatchType = 1
+	PrefixMatchMoreSpecific PrefixMatchType = 2
+	PrefixMatchLessSpecific PrefixMatchType = 3
+)
+
+// PrefixMatch is a single monitored prefix that matched an announced prefix
+type PrefixMatch struct {
+	Type      PrefixMatchType
+	Monitored bgp.AddrPrefixInterface
+}
+
+// PrefixTree is a path compressed binary (Patricia) trie of prefixes, used
+// to perform longest/shortest prefix matching of announced prefixes. IPv4
+// and IPv6 prefixes are held in separate tries
+type PrefixTree struct {
+	mux  sync.RWMutex
+	ipv4 *prefixNode
+	ipv6 *prefixNode
+	size int
+}
+
+// prefixNode is a single node in the trie. Nodes without a value are
+// "glue" nodes that only exist to join two branches together
+type prefixNode struct {
+	key      []byte
+	length   uint8
+	value    bgp.AddrPrefixInterface
+	children [2]*prefixNode
+}
+
+// ##### Methods ##############################################################
+
+// String returns a readable name for the match type
+func (pmt PrefixMatchType) String() string {
+
+	switch pmt {
+	case PrefixMatchExact:
+		return "Exact"
+	case PrefixMatchMoreSpecific:
+		return "More Specific"
+	case PrefixMatchLessSpecific:
+		return "Less Specific"
+	default:
+		return "Unknown"
+	}
+}
+
+// NewPrefixTree returns a new, empty, PrefixTree
+func NewPrefixTree() *PrefixTree {
+
+	return new(PrefixTree)
+}
+
+// Len returns the number of prefixes held in the tree
+func (t *PrefixTree) Len() int {
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	return t.size
+}
+
+// Add inserts a prefix into the tree, replacing any identical prefix.
+// Prefixes that are not IPv4/IPv6 unicast are ignored
+func (t *PrefixTree) Add(prefix bgp.AddrPrefixInterface) {
+
+	key, length, ok := prefixKey(prefix)
+	if ok == false {
+		return
+	}
+
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	link := t.root(prefix.AFI())
+	for {
+		n := *link
+		if n == nil {
+			*link = &prefixNode{key: key, length: length, value: prefix}
+			t.size++
+			return
+		}
+
+		common := commonBits(key, n.key, minLength(length, n.length))
+
+		if common < n.length {
+			if common == length {
+				// The new prefix covers the existing node, so sits above it
+				node := &prefixNode{key: key, length: length, value: prefix}
+				node.children[keyBit(n.key, length)] = n
+				*link = node
+				t.size++
+				return
+			}
+
+			// The prefixes diverge, so join them with a glue node
+			glue := &prefixNode{key: maskKey(key, common), length: common}
+			glue.children[keyBit(n.key, common)] = n
+			glue.children[keyBit(key, common)] = &prefixNode{key: key, length: length, value: prefix}
+			*link = glue
+			t.size++
+			return
+		}
+
+		if n.length == length {
+			if n.value == nil {
+				t.size++
+			}
+			n.value = prefix
+			return
+		}
+
+		link = &n.children[keyBit(key, n.length)]
+	}
+}
+
+// Match returns every prefix in the tree that is identical to, covers
+// (PrefixMatchMoreSpecific) or is covered by (PrefixMatchLessSpecific)
+// the supplied prefix. The match type is from the perspective of the
+// supplied (announced) prefix
+func (t *PrefixTree) Match(prefix bgp.AddrPrefixInterface) []*PrefixMatch {
+
+	matches := make([]*PrefixMatch, 0)
+
+	key, length, ok := prefixKey(prefix)
+	if ok == false {
+		return matches
+	}
+
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+
+	n := *t.root(prefix.AFI())
+	for n != nil {
+		common := commonBits(key, n.key, minLength(length, n.length))
+
+		if common < n.length {
+			// Everything below this node is more specific than the
+			// supplied prefix, as long as the supplied prefix covers it
+			if common == length {
+				matches = n.collect(matches)
+			}
+			break
+		}
+
+		if n.value != nil {
+			if n.length == length {
+				matches = append(matches, &PrefixMatch{Type: PrefixMatchExact, Monitored: n.value})
+			} else {
+				matches = append(matches, &PrefixMatch{Type: PrefixMatchMoreSpecific, Monitored: n.value})
+			}
+		}
+
+		if n.length == length {
+			for _, c := range n.children {
+				if c != nil {
+					matches = c.collect(matches)
+				}
+			}
+			break
+		}
+
+		n = n.children[keyBit(key, n.length)]
+	}
+
+	return matches
+}
+
+// root returns the link to the root node of the trie for the address family
+func (t *PrefixTree) root(afi uint16) **prefixNode {
+
+	if afi == bgp.AFI_IP6 {
+		return &t.ipv6
+	}
+
+	return &t.ipv4
+}
+
+// collect appends the values of the node and all of its descendants as less specific matches
+func (n *prefixNode) collect(matches []*PrefixMatch) []*PrefixMatch {
+
+	if n.value != nil {
+		matches = append(matches, &PrefixMatch{Type: PrefixMatchLessSpecific, Monitored: n.value})
+	}
+
+	for _, c := range n.children {
+		if c != nil {
+			matches = c.collect(matches)
+		}
+	}
+
+	return matches
+}
+
+// prefixKey returns the masked network bytes and length of an IPv4/IPv6 unicast prefix
+func prefixKey(prefix bgp.AddrPrefixInterface) ([]byte, uint8, bool) {
+
+	var ip net.IP
+	var length uint8
+
+	switch p := prefix.(type) {
+	case *bgp.IPAddrPrefix:
+		ip = p.Prefix.To4()
+		length = p.Length
+	case *bgp.IPv6AddrPrefix:
+		ip = p.Prefix.To16()
+		length = p.Length
+	default:
+		return nil, 0, false
+	}
+
+	if ip == nil {
+		return nil, 0, false
+	}
+
+	return maskKey(ip, length), length, true
+}
+
+// maskKey returns a copy of the key with all bits after length cleared
+func maskKey(key []byte, length uint8) []byte {
+
+	masked := make([]byte, len(key))
+	copy(masked, key)
+
+	for i := range masked {
+		bits := int(length) - (i * 8)
+		if bits >= 8 {
+			continue
+		}
+		if bits <= 0 {
+			masked[i] = 0
+			continue
+		}
+		masked[i] &= byte(0xff << uint(8-bits))
+	}
+
+	return masked
+}
+
+// keyBit returns the value (0 or 1) of the bit at the supplied position
+func keyBit(key []byte, position uint8) int {
+
+	index := int(position) / 8
+	if index >= len(key) {
+		return 0
+	}
+
+	return int(key[index]>>(7-(position%8))) & 1
+}
+
+// commonBits returns the number of leading bits (up to max) that are identical in both keys
+func commonBits(a []byte, b []byte, max uint8) uint8 {
+
+	var i uint8
+	for i = 0; i < max; i++ {
+		if keyBit(a, i) != keyBit(b, i) {
+			return i
+		}
+	}
+
+	return max
+}
+
+// minLength returns the smaller of two prefix lengths
+func minLength(a uint8, b uint8) uint8 {
+
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Structs ##############################################################
+
+// ProfileConfig is a named monitoring profile e.g. for our own AS, a customer's
+// AS or a critical provider, with the alert sinks of the team that owns it
+type ProfileConfig struct {
+	Name                string            `mapstructure:"name"`
+	TargetAs            []uint32          `mapstructure:"target_as"`
+	Prefixes            []string          `mapstructure:"prefixes"`
+	NeighbourPeers      []uint32          `mapstructure:"neighbour_peers"`
+	MonitorCountryCodes []string          `mapstructure:"monitor_country_codes"`
+	Rules               []string          `mapstructure:"rules"`
+	AlertSinks          []AlertSinkConfig `mapstructure:"alert_sinks"`
+}
+
+type ProfileConfigs struct {
+	Profiles []ProfileConfig `mapstructure:"profiles"`
+}
+
+// Profile is a monitoring policy: the AS's and prefixes it owns, their expected
+// upstreams, the countries it monitors and the rules it uses (all if none). The
+// top level configuration is the default, unnamed, profile. Alerts are tagged
+// with the named profiles that accept them and sent to their alert sinks
+type Profile struct {
+	Name                string
+	TargetAs            map[uint32]struct{}
+	Prefixes            []bgp.AddrPrefixInterface
+	NeighbourPeers      map[uint32]struct{}
+	MonitorCountryCodes map[string]struct{}
+	Rules               map[string]struct{}
+	prefixTree          *PrefixTree
+	sinks               []*alertSinkFilter
+}
+
+// ##### Methods ##############################################################
+
+// NewProfile returns the profile described by the configuration, without its
+// alert sinks. Returns an error for invalid prefixes or unknown rules
+func NewProfile(pc ProfileConfig) (*Profile, error) {
+
+	p := &Profile{
+		Name:                pc.Name,
+		TargetAs:            make(map[uint32]struct{}),
+		Prefixes:            make([]bgp.AddrPrefixInterface, 0),
+		NeighbourPeers:      make(map[uint32]struct{}),
+		MonitorCountryCodes: make(map[string]struct{}),
+		Rules:               make(map[string]struct{}),
+		prefixTree:          NewPrefixTree(),
+	}
+
+	for _, as := range pc.TargetAs {
+		p.TargetAs[as] = struct{}{}
+	}
+	for _, as := range pc.NeighbourPeers {
+		p.NeighbourPeers[as] = struct{}{}
+	}
+	for _, cc := range pc.MonitorCountryCodes {
+		p.MonitorCountryCodes[cc] = struct{}{}
+	}
+
+	for _, t := range pc.Prefixes {
+		prefix, err := parsePrefix(t)
+		if err != nil {
+			return p, fmt.Errorf("profile %s: invalid prefix: %s", pc.Name, t)
+		}
+		p.AddPrefix(prefix)
+	}
+
+	names := make(map[string]struct{})
+	for _, r := range defaultRules(new(Config)) {
+		names[r.Name] = struct{}{}
+	}
+
+	for _, name := range pc.Rules {
+		name = strings.ToLower(name)
+		if _, ok := names[name]; ok == false {
+			return p, fmt.Errorf("profile %s: unknown rule: %s", pc.Name, name)
+		}
+		p.Rules[name] = struct{}{}
+	}
+
+	return p, nil
+}
+
+// neighbourAdjacencies returns the adjacencies of the neighbour peers to the
+// target AS's, of the top level configuration and of each of the profiles
+func neighbourAdjacencies(config *Config) []AsAdjacency {
+
+	adjacencies := make([]AsAdjacency, 0)
+	add := func(targetAs []uint32, neighbourPeers []uint32) {
+		for _, as := range targetAs {
+			for _, n := range neighbourPeers {
+				if n != as {
+					adjacencies = append(adjacencies, AsAdjacency{Neighbour: n, As: as})
+				}
+			}
+		}
+	}
+
+	add(sortedAsList(config.TargetAs), sortedAsList(config.NeighbourPeers))
+	for _, pc := range config.Profiles {
+		add(pc.TargetAs, pc.NeighbourPeers)
+	}
+
+	return adjacencies
+}
+
+// newDefaultProfile returns the unnamed profile of the top level configuration
+func newDefaultProfile(config *Config) *Profile {
+
+	p := &Profile{
+		TargetAs:            config.TargetAs,
+		Prefixes:            make([]bgp.AddrPrefixInterface, 0),
+		NeighbourPeers:      config.NeighbourPeers,
+		MonitorCountryCodes: config.MonitorCountryCodes,
+		Rules:               make(map[string]struct{}),
+		prefixTree:          NewPrefixTree(),
+	}
+
+	for _, prefix := range config.Prefixes {
+		p.AddPrefix(prefix)
+	}
+
+	return p
+}
+
+// AddPrefix adds a prefix that the profile owns
+func (p *Profile) AddPrefix(prefix bgp.AddrPrefixInterface) {
+
+	p.Prefixes = append(p.Prefixes, prefix)
+	p.prefixTree.Add(prefix)
+}
+
+// Accepts returns true if the profile owns the alert raised by the rule i.e.
+// the rule is one of the profile's, the origin is one of its AS's or one of
+// the alert's prefixes is, covers or is covered by one of its prefixes, and
+// the alert holds for the profile's own AS's, upstreams and countries
+func (p *Profile) Accepts(r *Rule, dd *DetectData, alert *Alert) bool {
+
+	if _, ok := p.Rules[r.Name]; len(p.Rules) > 0 && ok == false {
+		return false
+	}
+
+	ownOrigin := false
+	if dd.AsPath != nil {
+		for _, as := range dd.AsPath.Origins() {
+			if _, ok := p.TargetAs[as]; ok == true {
+				ownOrigin = true
+			}
+		}
+	}
+
+	ownPrefix := false
+	for _, prefix := range alert.Prefixes {
+		n, err := parsePrefix(prefix)
+		if err == nil && len(p.prefixTree.Match(n)) > 0 {
+			ownPrefix = true
+			break
+		}
+	}
+
+	if ownOrigin == false && ownPrefix == false {
+		return false
+	}
+
+	switch alert.Reason {
+	case ReasonInvalidPrefixPeer, ReasonSubPrefixHijack, ReasonCoveringPrefix:
+		// Our own AS's may announce our prefixes, unless from an AS_SET
+		return ownOrigin == false || dd.AsPath.OriginSet == true
+
+	case ReasonMonitoredCountry:
+		_, ok := p.MonitorCountryCodes[alert.Metadata["external_country"]]
+		return ok
+
+	case ReasonNewAdjacency:
+		return hasAs(p.TargetAs, alert.Metadata["target_as"]) == true &&
+			hasAs(p.NeighbourPeers, alert.Metadata["neighbour_as"]) == false
+	}
+
+	return true
+}
+
+// Send passes the alert to each of the profile's alert sinks that accept its priority
+func (p *Profile) Send(alert *Alert) {
+
+	for _, s := range p.sinks {
+		if alert.Priority > s.minPriority {
+			continue
+		}
+
+		err := s.sink.Send(alert)
+		if err != nil {
+			fmt.Printf("Error sending alert to sink (%s, profile %s): %v\n", s.sink.Name(), p.Name, err)
+		}
+	}
+}
+
+// hasAs returns true if the AS, in the alert metadata format, is in the set
+func hasAs(set map[uint32]struct{}, data string) bool {
+
+	as, err := strconv.ParseUint(data, 10, 32)
+	if err != nil {
+		return false
+	}
+
+	_, ok := set[uint32(as)]
+	return ok
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ##### Structs ##############################################################
+
+// ReplayFile is an update file to be replayed, and the data set (collector) it belongs to
+type ReplayFile struct {
+	Name      string
+	Path      string
+	Timestamp time.Time
+}
+
+// ##### Methods ##############################################################
+
+// findReplayFiles expands the file paths/globs. Files within the cache use the
+// data set name from their path, any others use the supplied name
+func findReplayFiles(patterns []string, name string) ([]*ReplayFile, error) {
+
+	files := make([]*ReplayFile, 0)
+	seen := make(map[string]struct{})
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return files, fmt.Errorf("invalid file pattern (%s): %v", pattern, err)
+		}
+
+		if len(matches) == 0 {
+			return files, fmt.Errorf("no files match: %s", pattern)
+		}
+
+		for _, m := range matches {
+			if _, ok := seen[m]; ok == true {
+				continue
+			}
+			seen[m] = struct{}{}
+
+			rf := &ReplayFile{Name: name, Path: m}
+			rf.Timestamp, _ = updateFileTime(filepath.Base(m))
+
+			// e.g. ./cache/LONDON-UK/2018/11/updates.20181112.0000.gz
+			parts := strings.Split(filepath.ToSlash(filepath.Clean(m)), "/")
+			for i := 0; i < len(parts)-4; i++ {
+				if parts[i] == "cache" {
+					rf.Name = parts[i+1]
+				}
+			}
+
+			files = append(files, rf)
+		}
+	}
+
+	return files, nil
+}
+
+// findCachedFiles returns the cached update files of the data sets whose
+// file name time is within the time range
+func findCachedFiles(dataSets []string, from time.Time, to time.Time) ([]*ReplayFile, error) {
+
+	files := make([]*ReplayFile, 0)
+
+	for _, name := range dataSets {
+		if _, ok := config.DataSets[name]; ok == false {
+			return files, fmt.Errorf("unknown data set: %s", name)
+		}
+
+		// Walk the year/month directories that cover the range
+		month := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+		for month.After(to) == false {
+			dir := fmt.Sprintf("./cache/%s/%d/%d", name, month.Year(), int(month.Month()))
+			month = month.AddDate(0, 1, 0)
+
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				if os.IsNotExist(err) == true {
+					continue
+				}
+				return files, err
+			}
+
+			for _, e := range entries {
+				ts, ok := updateFileTime(e.Name())
+				if ok == false || ts.Before(from) == true || ts.After(to) == true {
+					continue
+				}
+
+				files = append(files, &ReplayFile{Name: name, Path: filepath.Join(dir, e.Name()), Timestamp: ts})
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// sortReplayFiles orders the files by the time in their file name, so that
+// the data sets are interleaved as they would have been when monitoring
+func sortReplayFiles(files []*ReplayFile) {
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Timestamp.Equal(files[j].Timestamp) == false {
+			return files[i].Timestamp.Before(files[j].Timestamp)
+		}
+		if files[i].Name != files[j].Name {
+			return files[i].Name < files[j].Name
+		}
+		return files[i].Path < files[j].Path
+	})
+}
+
+// updateFileTime returns the time from an update file name e.g. updates.20181112.0805.gz
+func updateFileTime(fileName string) (time.Time, bool) {
+
+	parts := strings.Split(fileName, ".")
+	if len(parts) < 3 || parts[0] != "updates" {
+		return time.Time{}, false
+	}
+
+	ts, err := time.Parse("20060102.1504", parts[1]+"."+parts[2])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return ts, true
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Constants ############################################################
+
+// Reconnection backoff bounds, how often the feed is pinged and how long to
+// wait for any message (including the pong) before reconnecting
+const RIS_LIVE_MIN_BACKOFF time.Duration = 1 * time.Second
+const RIS_LIVE_MAX_BACKOFF time.Duration = 5 * time.Minute
+const RIS_LIVE_PING_INTERVAL time.Duration = 30 * time.Second
+const RIS_LIVE_READ_TIMEOUT time.Duration = 2 * time.Minute
+
+// ##### Structs ##############################################################
+
+// RisLiveClient consumes a RIS Live compatible WebSocket feed, passing the
+// updates to the detector in the same way as the MRT update files
+type RisLiveClient struct {
+	Url           string
+	detector      *Detector
+	subscriptions []RisLiveSubscription
+	mux           sync.Mutex
+	connected     bool
+	messages      uint64
+	lastMessage   time.Time
+}
+
+// risLiveEnvelope is the outer structure of all RIS Live messages
+type risLiveEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// risLiveSubscribe is the data of a "ris_subscribe" message
+type risLiveSubscribe struct {
+	Host         string `json:"host,omitempty"`
+	Type         string `json:"type"`
+	Peer         string `json:"peer,omitempty"`
+	Path         string `json:"path,omitempty"`
+	Prefix       string `json:"prefix,omitempty"`
+	MoreSpecific bool   `json:"moreSpecific"`
+	LessSpecific bool   `json:"lessSpecific"`
+}
+
+// RisLiveMessage is the data of a "ris_message" message. The peer ASN is a
+// string, and AS_SET's are nested arrays within the path
+type RisLiveMessage struct {
+	Timestamp     float64           `json:"timestamp"`
+	Peer          string            `json:"peer"`
+	PeerAsn       json.RawMessage   `json:"peer_asn"`
+	Host          string            `json:"host"`
+	Type          string            `json:"type"`
+	Path          []json.RawMessage `json:"path"`
+	Announcements []struct {
+		NextHop  string   `json:"next_hop"`
+		Prefixes []string `json:"prefixes"`
+	} `json:"announcements"`
+	Withdrawals []string `json:"withdrawals"`
+}
+
+// ##### Methods ##############################################################
+
+// NewRisLiveClient returns a new RisLiveClient. If there are no subscriptions
+// then the feed is subscribed to our prefixes (and more/less specifics) and to
+// paths originated by our AS's
+func NewRisLiveClient(url string, subscriptions []RisLiveSubscription, detector *Detector, config *Config) *RisLiveClient {
+
+	if len(subscriptions) == 0 {
+		for _, p := range config.Prefixes {
+			subscriptions = append(subscriptions, RisLiveSubscription{Prefix: p.String(), MoreSpecific: true, LessSpecific: true})
+		}
+		for as := range config.TargetAs {
+			subscriptions = append(subscriptions, RisLiveSubscription{Path: fmt.Sprintf("%d$", as)})
+		}
+	}
+
+	return &RisLiveClient{
+		Url:           url,
+		detector:      detector,
+		subscriptions: subscriptions,
+	}
+}
+
+// Start connects to the feed in the background, reconnecting with an
+// exponential backoff. The backoff is reset once a session has received data, or has been up for a while
+func (c *RisLiveClient) Start() {
+
+	go func() {
+		backoff := RIS_LIVE_MIN_BACKOFF
+
+		for {
+			ws, err := DialWebSocket(c.Url, 30*time.Second)
+			if err != nil {
+				fmt.Printf("Error connecting to RIS Live (%s): %v\n", c.Url, err)
+			} else {
+				received := c.Messages()
+				started := time.Now()
+
+				err = c.Run(ws)
+				if err != nil {
+					fmt.Printf("RIS Live session error (%s): %v\n", c.Url, err)
+				}
+
+				if c.Messages() > received || time.Since(started) > RIS_LIVE_MAX_BACKOFF {
+					backoff = RIS_LIVE_MIN_BACKOFF
+				}
+			}
+
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > RIS_LIVE_MAX_BACKOFF {
+				backoff = RIS_LIVE_MAX_BACKOFF
+			}
+		}
+	}()
+}
+
+// Run subscribes and processes the feed messages until the connection fails
+func (c *RisLiveClient) Run(ws *WebSocketConn) error {
+
+	defer ws.Close()
+
+	for _, s := range c.subscriptions {
+		err := c.send(ws, "ris_subscribe", risLiveSubscribe{Host: s.Host, Type: "UPDATE", Peer: s.Peer,
+			Path: s.Path, Prefix: s.Prefix, MoreSpecific: s.MoreSpecific, LessSpecific: s.LessSpecific})
+		if err != nil {
+			return err
+		}
+	}
+
+	c.setConnected(true)
+	defer c.setConnected(false)
+
+	// Keep the connection alive when our prefixes are quiet
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(RIS_LIVE_PING_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if c.send(ws, "ping", nil) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(RIS_LIVE_READ_TIMEOUT))
+
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		err = c.handleMessage(data)
+		if err != nil {
+			fmt.Printf("Error processing RIS Live message: %v\n", err)
+		}
+	}
+}
+
+// Status returns whether the feed is connected, the number of messages
+// received and the time of the last message
+func (c *RisLiveClient) Status() (bool, uint64, time.Time) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.connected, c.messages, c.lastMessage
+}
+
+// Messages returns the number of update messages received
+func (c *RisLiveClient) Messages() uint64 {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.messages
+}
+
+// setConnected records whether a session is established
+func (c *RisLiveClient) setConnected(connected bool) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.connected = connected
+}
+
+// send writes a message of the type, with the (optional) data
+func (c *RisLiveClient) send(ws *WebSocketConn, msgType string, data interface{}) error {
+
+	msg := risLiveEnvelope{Type: msgType}
+
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		msg.Data = raw
+	}
+
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return ws.WriteMessage(raw)
+}
+
+// handleMessage decodes a single feed message, passing any update to the detector
+func (c *RisLiveClient) handleMessage(data []byte) error {
+
+	var env risLiveEnvelope
+	err := json.Unmarshal(data, &env)
+	if err != nil {
+		return err
+	}
+
+	switch env.Type {
+	case "ris_message":
+		var msg RisLiveMessage
+		err = json.Unmarshal(env.Data, &msg)
+		if err != nil {
+			return err
+		}
+
+		// Peer state changes, keepalives etc are not used
+		if msg.Type != "UPDATE" {
+			return nil
+		}
+
+		c.mux.Lock()
+		c.messages++
+		c.lastMessage = time.Now()
+		c.mux.Unlock()
+
+		return msg.Detect(c.detector)
+
+	case "ris_error":
+		return fmt.Errorf("feed error: %s", string(env.Data))
+	}
+
+	// e.g. pong, ris_subscribe_ok
+	return nil
+}
+
+// Detect converts the message to an update and passes it to the detector.
+// The collector host (e.g. "rrc21") is used as the data set name
+func (m *RisLiveMessage) Detect(detector *Detector) error {
+
+	peerAs, err := strconv.ParseUint(strings.Trim(string(m.PeerAsn), `"`), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid peer ASN: %s", string(m.PeerAsn))
+	}
+
+	peerIP := net.ParseIP(m.Peer)
+	if peerIP == nil {
+		return fmt.Errorf("invalid peer IP: %s", m.Peer)
+	}
+
+	asPath, err := m.AsPath()
+	if err != nil {
+		return err
+	}
+
+	announced, withdrawn := m.Prefixes()
+
+	detectUpdate(detector, m.Host, m.Time(), uint32(peerAs), peerIP, asPath, announced, withdrawn)
+	return nil
+}
+
+// Time returns the message timestamp, which is in fractional seconds
+func (m *RisLiveMessage) Time() time.Time {
+
+	sec, frac := math.Modf(m.Timestamp)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+// AsPath builds the AS path, consecutive AS's form AS_SEQUENCE segments and
+// nested arrays are AS_SET segments. Withdrawal only messages have no path
+func (m *RisLiveMessage) AsPath() (*AsPath, error) {
+
+	if len(m.Path) == 0 {
+		return nil, nil
+	}
+
+	segments := make([]AsPathSegment, 0)
+	sequence := make([]uint32, 0)
+
+	for _, p := range m.Path {
+		if len(p) > 0 && p[0] == '[' {
+			var set []uint32
+			err := json.Unmarshal(p, &set)
+			if err != nil {
+				return nil, fmt.Errorf("invalid AS_SET in path: %s", string(p))
+			}
+
+			if len(sequence) > 0 {
+				segments = append(segments, AsPathSegment{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: sequence})
+				sequence = make([]uint32, 0)
+			}
+			segments = append(segments, AsPathSegment{Type: bgp.BGP_ASPATH_ATTR_TYPE_SET, AS: set})
+			continue
+		}
+
+		var as uint32
+		err := json.Unmarshal(p, &as)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AS in path: %s", string(p))
+		}
+		sequence = append(sequence, as)
+	}
+
+	if len(sequence) > 0 {
+		segments = append(segments, AsPathSegment{Type: bgp.BGP_ASPATH_ATTR_TYPE_SEQ, AS: sequence})
+	}
+
+	return newAsPathFromSegments(segments), nil
+}
+
+// Prefixes returns the announced and withdrawn prefixes, ignoring any that cannot be parsed
+func (m *RisLiveMessage) Prefixes() ([]bgp.AddrPrefixInterface, []bgp.AddrPrefixInterface) {
+
+	announced := make([]bgp.AddrPrefixInterface, 0)
+	withdrawn := make([]bgp.AddrPrefixInterface, 0, len(m.Withdrawals))
+
+	for _, a := range m.Announcements {
+		for _, p := range a.Prefixes {
+			prefix, err := parsePrefix(p)
+			if err != nil {
+				continue
+			}
+			announced = append(announced, prefix)
+		}
+	}
+
+	for _, p := range m.Withdrawals {
+		prefix, err := parsePrefix(p)
+		if err != nil {
+			continue
+		}
+		withdrawn = append(withdrawn, prefix)
+	}
+
+	return announced, withdrawn
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRisLiveClient checks that the client subscribes to our prefixes and AS's
+// on a RIS Live stand in, and that the updates of the feed are detected, with
+// messages that cannot be processed skipped
+func TestRisLiveClient(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+
+	timestamp := testTime(0).Unix()
+	subscriptions := make(chan []string, 1)
+
+	// The feed stand in, which answers the subscriptions then sends the updates and closes
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := AcceptWebSocket(w, r)
+		if err != nil {
+			t.Errorf("error accepting websocket: %v", err)
+			return
+		}
+		defer ws.Close()
+
+		ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+		received := make([]string, 0)
+		for i := 0; i < 3; i++ {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				t.Errorf("error reading subscription: %v", err)
+				return
+			}
+
+			var env risLiveEnvelope
+			json.Unmarshal(data, &env)
+			received = append(received, env.Type+" "+string(env.Data))
+		}
+		subscriptions <- received
+
+		for _, msg := range []string{
+			`{"type": "ris_subscribe_ok", "data": {}}`,
+			fmt.Sprintf(`{"type": "ris_message", "data": {"timestamp": %d.25, "peer": "192.0.2.1", "peer_asn": "3356", "host": "rrc21", "type": "UPDATE",`+
+				` "path": [3356, 64666], "announcements": [{"next_hop": "192.0.2.1", "prefixes": ["192.104.160.0/23"]}]}}`, timestamp),
+			`{"type": "ris_message", "data": {"peer": "192.0.2.1", "peer_asn": "3356", "host": "rrc21", "type": "RIS_PEER_STATE"}}`,
+			`{"type": "ris_message", "data": {"peer": "invalid", "peer_asn": "3356", "host": "rrc21", "type": "UPDATE"}}`,
+			`{"type": "ris_error", "data": {"message": "stand in error"}}`,
+			fmt.Sprintf(`{"type": "ris_message", "data": {"timestamp": %d, "peer": "192.0.2.1", "peer_asn": "3356", "host": "rrc21", "type": "UPDATE",`+
+				` "withdrawals": ["192.104.160.0/23"]}}`, timestamp+60),
+		} {
+			err = ws.WriteMessage([]byte(msg))
+			if err != nil {
+				t.Errorf("error writing message: %v", err)
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	sink := new(testSink)
+	detector := NewDetector(config)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.StartInOrder()
+
+	ws, err := DialWebSocket("ws"+strings.TrimPrefix(server.URL, "http")+"/v1/ws/", 10*time.Second)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+
+	// The session ends when the feed closes the connection
+	client := NewRisLiveClient(server.URL, nil, detector, config)
+	err = client.Run(ws)
+	if err != io.EOF {
+		t.Errorf("expected the feed to close the session: %v", err)
+	}
+
+	detector.Wait()
+	detector.Close()
+
+	received := <-subscriptions
+	expected := []string{
+		`ris_subscribe {"type":"UPDATE","prefix":"192.104.160.0/23","moreSpecific":true,"lessSpecific":true}`,
+		`ris_subscribe {"type":"UPDATE","prefix":"2001:4860::/32","moreSpecific":true,"lessSpecific":true}`,
+		`ris_subscribe {"type":"UPDATE","path":"15169$","moreSpecific":false,"lessSpecific":false}`,
+	}
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected subscriptions:\n  %s", strings.Join(received, "\n  "))
+	}
+
+	assertAlerts(t, sink.Alerts(),
+		"High first_appearance AS3356 [192.104.160.0/23] path [3356 64666]",
+		"High invalid_prefix_peer AS3356 [192.104.160.0/23] path [3356 64666]")
+
+	connected, messages, _ := client.Status()
+	if connected == true || messages != 3 {
+		t.Errorf("unexpected status: connected %v, %d messages", connected, messages)
+	}
+
+	routes := routeState.Routes(TEST_PREFIX_V4)
+	if len(routes) != 1 || routes[0].Collector != "rrc21" || routes[0].Active == true ||
+		routes[0].Announced.Equal(time.Unix(timestamp, 250000000)) == false {
+		t.Errorf("expected the announced route to be withdrawn: %+v", routes)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	util "github.com/woanware/goutil"
+)
+
+// ##### Structs ##############################################################
+
+// Route is the current state of a single prefix as seen by a single collector peer
+type Route struct {
+	Collector string
+	PeerIP    net.IP
+	PeerAs    uint32
+	Prefix    string
+	Path      string
+	Origin    uint32
+	Active    bool
+	Announced time.Time
+	Withdrawn time.Time
+	Updated   time.Time
+}
+
+// RouteState holds what each collector peer currently sees for our prefixes,
+// keyed by prefix and then by collector/peer
+type RouteState struct {
+	mux    sync.Mutex
+	routes map[string]map[string]*Route
+	alerts map[string]struct{}
+}
+
+// ##### Methods ##############################################################
+
+// NewRouteState returns a new, empty, RouteState
+func NewRouteState() *RouteState {
+
+	return &RouteState{
+		routes: make(map[string]map[string]*Route),
+		alerts: make(map[string]struct{}),
+	}
+}
+
+// Announce records an announcement of the prefix by the collector peer. Out
+// of order announcements (older than the current state) are ignored
+func (rs *RouteState) Announce(collector string, peerIP net.IP, peerAs uint32, prefix string,
+	path string, origin uint32, timestamp time.Time) {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	r := rs.get(collector, peerIP, peerAs, prefix)
+	if r.Updated.After(timestamp) == true {
+		return
+	}
+
+	r.Path = path
+	r.Origin = origin
+	r.Active = true
+	r.Announced = timestamp
+	r.Updated = timestamp
+}
+
+// Withdraw records a withdrawal of the prefix by the collector peer. Returns
+// true if the peer previously had an active route for the prefix. Withdrawals
+// by peers that never announced the prefix are ignored
+func (rs *RouteState) Withdraw(collector string, peerIP net.IP, peerAs uint32, prefix string, timestamp time.Time) bool {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	r := rs.routes[prefix][collector+"|"+peerIP.String()]
+	if r == nil || r.Updated.After(timestamp) == true {
+		return false
+	}
+
+	active := r.Active
+	r.Active = false
+	r.Withdrawn = timestamp
+	r.Updated = timestamp
+
+	return active
+}
+
+// WithdrawPeer withdraws all of the active routes of the collector peer e.g.
+// when the peer session goes down. Returns the prefixes that were withdrawn
+func (rs *RouteState) WithdrawPeer(collector string, peerIP net.IP, timestamp time.Time) []string {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	key := collector + "|" + peerIP.String()
+	withdrawn := make([]string, 0)
+
+	for prefix, peers := range rs.routes {
+		r, ok := peers[key]
+		if ok == false || r.Active == false || r.Updated.After(timestamp) == true {
+			continue
+		}
+
+		r.Active = false
+		r.Withdrawn = timestamp
+		r.Updated = timestamp
+		withdrawn = append(withdrawn, prefix)
+	}
+
+	sort.Strings(withdrawn)
+	return withdrawn
+}
+
+// Withdrawals returns the number of peers that have withdrawn the prefix since
+// the supplied time, and the number of peers that have announced the prefix at all
+func (rs *RouteState) Withdrawals(prefix string, since time.Time) (int, int) {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	withdrawn := 0
+	total := 0
+	for _, r := range rs.routes[prefix] {
+		if r.Announced.IsZero() == true {
+			continue
+		}
+		total++
+
+		if r.Active == false && r.Withdrawn.Before(since) == false {
+			withdrawn++
+		}
+	}
+
+	return withdrawn, total
+}
+
+// SetWithdrawalAlert flags the prefix as being in a mass withdrawal. Returns
+// true if the prefix was not already flagged, so that only one alert is raised
+func (rs *RouteState) SetWithdrawalAlert(prefix string) bool {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	if _, ok := rs.alerts[prefix]; ok {
+		return false
+	}
+
+	rs.alerts[prefix] = struct{}{}
+	return true
+}
+
+// ClearWithdrawalAlert removes the mass withdrawal flag from the prefix
+func (rs *RouteState) ClearWithdrawalAlert(prefix string) {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	delete(rs.alerts, prefix)
+}
+
+// Routes returns a copy of the current state for the prefix, ordered by collector and peer
+func (rs *RouteState) Routes(prefix string) []Route {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	routes := make([]Route, 0, len(rs.routes[prefix]))
+	for _, r := range rs.routes[prefix] {
+		routes = append(routes, *r)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Collector != routes[j].Collector {
+			return routes[i].Collector < routes[j].Collector
+		}
+		return routes[i].PeerIP.String() < routes[j].PeerIP.String()
+	})
+
+	return routes
+}
+
+// Prefixes returns the prefixes held in the route state, in order
+func (rs *RouteState) Prefixes() []string {
+
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+
+	prefixes := make([]string, 0, len(rs.routes))
+	for prefix := range rs.routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	return prefixes
+}
+
+// Summary writes the current route state to "./summary/routes.csv"
+func (rs *RouteState) Summary() {
+
+	if util.DoesDirExist("./summary") == false {
+		err := os.MkdirAll("./summary", 0770)
+		if err != nil {
+			fmt.Printf("Error creating summary directory: %v\n", err)
+			return
+		}
+	}
+
+	var b bytes.Buffer
+
+	b.WriteString("PREFIX, COLLECTOR, PEER_IP, PEER_AS, STATE, ORIGIN, ANNOUNCED, WITHDRAWN, PATH\n")
+
+	for _, prefix := range rs.Prefixes() {
+		for _, r := range rs.Routes(prefix) {
+			b.WriteString(fmt.Sprintf("%s, %s, %s, %d, %s, %d, %s, %s, %s\n",
+				r.Prefix, r.Collector, r.PeerIP, r.PeerAs, r.State(), r.Origin,
+				formatRouteTime(r.Announced), formatRouteTime(r.Withdrawn), r.Path))
+		}
+	}
+
+	err := ioutil.WriteFile("./summary/routes.csv", b.Bytes(), 0770)
+	if err != nil {
+		fmt.Printf("Error writing route state summary data: %v\n", err)
+	}
+}
+
+// get returns the route for the collector peer and prefix, creating it if required. Must be called with the lock held
+func (rs *RouteState) get(collector string, peerIP net.IP, peerAs uint32, prefix string) *Route {
+
+	if rs.routes[prefix] == nil {
+		rs.routes[prefix] = make(map[string]*Route)
+	}
+
+	key := collector + "|" + peerIP.String()
+	if rs.routes[prefix][key] == nil {
+		rs.routes[prefix][key] = &Route{Collector: collector, PeerIP: peerIP, PeerAs: peerAs, Prefix: prefix}
+	}
+
+	return rs.routes[prefix][key]
+}
+
+// State returns a readable state for the route
+func (r Route) State() string {
+
+	if r.Active == true {
+		return "Announced"
+	}
+
+	return "Withdrawn"
+}
+
+// formatRouteTime returns the time in the same format as the processing messages, or blank if not set
+func formatRouteTime(t time.Time) string {
+
+	if t.IsZero() == true {
+		return ""
+	}
+
+	return t.UTC().Format("2006-01-02T15:04:05")
+}
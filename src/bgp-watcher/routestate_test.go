@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRouteStateStrayWithdrawals checks that withdrawals by peers that never
+// announced the prefix are ignored, so are not counted as withdrawn
+func TestRouteStateStrayWithdrawals(t *testing.T) {
+
+	rs := NewRouteState()
+	ts := time.Date(2018, 11, 12, 8, 5, 0, 0, time.UTC)
+
+	for i := 1; i <= 3; i++ {
+		if rs.Withdraw("TEST", net.IPv4(192, 0, 2, byte(i)), 3356, "192.104.160.0/23", ts) == true {
+			t.Errorf("expected the stray withdrawal to be ignored")
+		}
+	}
+
+	if withdrawn, total := rs.Withdrawals("192.104.160.0/23", ts); withdrawn != 0 || total != 0 {
+		t.Errorf("expected no route state for the stray withdrawals, %d/%d withdrawn", withdrawn, total)
+	}
+
+	rs.Announce("TEST", net.IPv4(192, 0, 2, 1), 3356, "192.104.160.0/23", "3356 15169", 15169, ts)
+	if rs.Withdraw("TEST", net.IPv4(192, 0, 2, 1), 3356, "192.104.160.0/23", ts.Add(time.Minute)) == false {
+		t.Errorf("expected the announced route to be withdrawn")
+	}
+
+	if withdrawn, total := rs.Withdrawals("192.104.160.0/23", ts); withdrawn != 1 || total != 1 {
+		t.Errorf("expected the announced route to be withdrawn, %d/%d withdrawn", withdrawn, total)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+	util "github.com/woanware/goutil"
+)
+
+// ##### Constants ############################################################
+
+// The sources of the ROA's held in a RoaTable
+const ROA_SOURCE_FILE string = "file"
+const ROA_SOURCE_RTR string = "rtr"
+
+// ##### Structs ##############################################################
+
+// RpkiState is the RFC 6811 validation state of an announcement
+type RpkiState int
+
+// The validation states, NotFound is used when no ROA covers the announcement
+const (
+	RpkiNotFound RpkiState = 0
+	RpkiValid    RpkiState = 1
+	RpkiInvalid  RpkiState = 2
+)
+
+// Roa is a single Validated ROA Payload (VRP)
+type Roa struct {
+	Prefix      bgp.AddrPrefixInterface
+	MaxLength   uint8
+	Asn         uint32
+	TrustAnchor string
+}
+
+// RoaTable holds the VRP's indexed by prefix, so that announcements can be
+// validated against all of the ROA's that cover them. The ROA's of each source
+// (the VRP file and RTR) are merged, so one source never discards the other's
+type RoaTable struct {
+	mux     sync.RWMutex
+	smux    sync.Mutex
+	sources map[string][]*Roa
+	tree    *PrefixTree
+	roas    map[string][]*Roa
+	count   int
+}
+
+// vrpFile is the JSON export format used by rpki-client and Routinator. The
+// ASN is either a number (rpki-client) or a string e.g. "AS13335" (Routinator)
+type vrpFile struct {
+	Roas []struct {
+		Asn       json.RawMessage `json:"asn"`
+		Prefix    string          `json:"prefix"`
+		MaxLength uint8           `json:"maxLength"`
+		Ta        string          `json:"ta"`
+	} `json:"roas"`
+}
+
+// ##### Methods ##############################################################
+
+// String returns a readable name for the validation state
+func (rs RpkiState) String() string {
+
+	switch rs {
+	case RpkiValid:
+		return "Valid"
+	case RpkiInvalid:
+		return "Invalid"
+	default:
+		return "NotFound"
+	}
+}
+
+// String returns the ROA in the conventional format e.g. "1.0.0.0/24-24 AS13335"
+func (r *Roa) String() string {
+
+	return fmt.Sprintf("%s-%d AS%d", r.Prefix, r.MaxLength, r.Asn)
+}
+
+// NewRoaTable returns a new, empty, RoaTable
+func NewRoaTable() *RoaTable {
+
+	return &RoaTable{
+		sources: make(map[string][]*Roa),
+		tree:    NewPrefixTree(),
+		roas:    make(map[string][]*Roa),
+	}
+}
+
+// Len returns the number of ROA's held in the table
+func (rt *RoaTable) Len() int {
+
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+
+	return rt.count
+}
+
+// Replace swaps the ROA's of the source (ROA_SOURCE_FILE or ROA_SOURCE_RTR) for
+// the supplied ROA's, the table holding the ROA's of all of the sources once each
+func (rt *RoaTable) Replace(source string, roas []*Roa) {
+
+	rt.smux.Lock()
+	defer rt.smux.Unlock()
+
+	rt.sources[source] = roas
+
+	tree := NewPrefixTree()
+	index := make(map[string][]*Roa)
+	seen := make(map[string]struct{})
+
+	for _, s := range rt.sources {
+		for _, r := range s {
+			if _, ok := seen[r.String()]; ok == true {
+				continue
+			}
+			seen[r.String()] = struct{}{}
+
+			key := r.Prefix.String()
+			if index[key] == nil {
+				tree.Add(r.Prefix)
+			}
+			index[key] = append(index[key], r)
+		}
+	}
+
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	rt.tree = tree
+	rt.roas = index
+	rt.count = len(seen)
+}
+
+// Validate performs RFC 6811 origin validation of the prefix and origin
+// AS, returning the state and the ROA's that cover the prefix. An origin of
+// zero (e.g. an AS_SET origin) can never be valid
+func (rt *RoaTable) Validate(prefix bgp.AddrPrefixInterface, origin uint32) (RpkiState, []*Roa) {
+
+	length, ok := prefixLength(prefix)
+	if ok == false {
+		return RpkiNotFound, []*Roa{}
+	}
+
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+
+	covering := make([]*Roa, 0)
+	for _, m := range rt.tree.Match(prefix) {
+		// Only ROA's for the same or a less specific prefix cover the announcement
+		if m.Type == PrefixMatchLessSpecific {
+			continue
+		}
+		covering = append(covering, rt.roas[m.Monitored.String()]...)
+	}
+
+	if len(covering) == 0 {
+		return RpkiNotFound, covering
+	}
+
+	for _, r := range covering {
+		if r.Asn != 0 && r.Asn == origin && length <= r.MaxLength {
+			return RpkiValid, covering
+		}
+	}
+
+	return RpkiInvalid, covering
+}
+
+// Load reads the VRP's from a JSON or CSV export (based on the file extension) and replaces the ROA's of the file
+func (rt *RoaTable) Load(filePath string) error {
+
+	var roas []*Roa
+	var err error
+
+	if strings.ToLower(filepath.Ext(filePath)) == ".csv" {
+		roas, err = loadVrpCsv(filePath)
+	} else {
+		roas, err = loadVrpJson(filePath)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	rt.Replace(ROA_SOURCE_FILE, roas)
+	return nil
+}
+
+// loadVrpJson parses a rpki-client/Routinator JSON VRP export
+func loadVrpJson(filePath string) ([]*Roa, error) {
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var vrps vrpFile
+	err = json.Unmarshal(data, &vrps)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding VRP file: %v", err)
+	}
+
+	roas := make([]*Roa, 0, len(vrps.Roas))
+	for _, v := range vrps.Roas {
+		roa, err := newRoa(strings.Trim(string(v.Asn), `"`), v.Prefix, v.MaxLength, v.Ta)
+		if err != nil {
+			fmt.Printf("Error parsing VRP (%s): %v\n", v.Prefix, err)
+			continue
+		}
+		roas = append(roas, roa)
+	}
+
+	return roas, nil
+}
+
+// loadVrpCsv parses a rpki-client/Routinator CSV VRP export e.g. "ASN,IP Prefix,Max Length,Trust Anchor"
+func loadVrpCsv(filePath string) ([]*Roa, error) {
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	roas := make([]*Roa, 0)
+	var record []string
+	var maxLength uint8
+	var ta string
+
+	for {
+		record, err = reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading VRP file: %v", err)
+		}
+
+		// Ignore the header and any short records
+		if len(record) < 3 || strings.EqualFold(record[0], "ASN") == true {
+			continue
+		}
+
+		maxLength, err = util.ConvertStringToUint8(record[2])
+		if err != nil {
+			fmt.Printf("Error parsing VRP max length (%s): %v\n", record[2], err)
+			continue
+		}
+
+		ta = ""
+		if len(record) > 3 {
+			ta = record[3]
+		}
+
+		roa, err := newRoa(record[0], record[1], maxLength, ta)
+		if err != nil {
+			fmt.Printf("Error parsing VRP (%s): %v\n", record[1], err)
+			continue
+		}
+		roas = append(roas, roa)
+	}
+
+	return roas, nil
+}
+
+// newRoa builds a ROA from the exported values, the ASN may be prefixed with "AS"
+func newRoa(asn string, prefix string, maxLength uint8, ta string) (*Roa, error) {
+
+	as, err := parseAs(asn)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := parsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	length, _ := prefixLength(p)
+	if maxLength < length {
+		maxLength = length
+	}
+
+	return &Roa{Prefix: p, MaxLength: maxLength, Asn: as, TrustAnchor: ta}, nil
+}
+
+// prefixLength returns the length of an IPv4/IPv6 unicast prefix
+func prefixLength(prefix bgp.AddrPrefixInterface) (uint8, bool) {
+
+	switch p := prefix.(type) {
+	case *bgp.IPAddrPrefix:
+		return p.Length, true
+	case *bgp.IPv6AddrPrefix:
+		return p.Length, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// rpkiCase is an announcement and the validation state it should have
+type rpkiCase struct {
+	Prefix string
+	Origin uint32
+	State  RpkiState
+}
+
+// TestRoaTableLoad checks that rpki-client JSON and Routinator CSV exports are
+// loaded, a max length below the prefix length being raised to the prefix length
+func TestRoaTableLoad(t *testing.T) {
+
+	files := map[string]string{
+		"rpki-client.json": `{"metadata": {"buildtime": "2018-11-12T08:00:00Z"}, "roas": [
+			{"asn": 15169, "prefix": "192.104.160.0/23", "maxLength": 24, "ta": "arin"},
+			{"asn": 4200000001, "prefix": "198.51.100.0/24", "maxLength": 16, "ta": "ripe"},
+			{"asn": 15169, "prefix": "2001:db8::/32", "maxLength": 32, "ta": "apnic"},
+			{"asn": 15169, "prefix": "not a prefix", "maxLength": 24, "ta": "arin"}]}`,
+		"routinator.csv": "ASN,IP Prefix,Max Length,Trust Anchor\n" +
+			"AS15169,192.104.160.0/23,24,arin\n" +
+			"AS4200000001,198.51.100.0/24,16,ripe\n" +
+			"as15169,2001:db8::/32,32,apnic\n" +
+			"AS15169,192.0.2.0/24,x,arin\n",
+	}
+
+	cases := []rpkiCase{
+		{Prefix: "192.104.160.0/23", Origin: 15169, State: RpkiValid},
+		{Prefix: "192.104.160.0/24", Origin: 15169, State: RpkiValid},
+		{Prefix: "192.104.160.0/25", Origin: 15169, State: RpkiInvalid},
+		{Prefix: "192.104.160.0/24", Origin: 64666, State: RpkiInvalid},
+		{Prefix: "198.51.100.0/24", Origin: 4200000001, State: RpkiValid},
+		{Prefix: "198.51.100.0/25", Origin: 4200000001, State: RpkiInvalid},
+		{Prefix: "198.51.0.0/16", Origin: 4200000001, State: RpkiNotFound},
+		{Prefix: "2001:db8::/32", Origin: 15169, State: RpkiValid},
+		{Prefix: "2001:db8::/48", Origin: 15169, State: RpkiInvalid},
+		{Prefix: "192.0.2.0/24", Origin: 15169, State: RpkiNotFound},
+	}
+
+	for name, contents := range files {
+		t.Run(name, func(t *testing.T) {
+
+			filePath := filepath.Join(t.TempDir(), name)
+			err := ioutil.WriteFile(filePath, []byte(contents), 0660)
+			if err != nil {
+				t.Fatalf("error writing VRP file: %v", err)
+			}
+
+			table := NewRoaTable()
+			err = table.Load(filePath)
+			if err != nil {
+				t.Fatalf("error loading VRP file: %v", err)
+			}
+			if table.Len() != 3 {
+				t.Errorf("expected 3 ROAs, %d", table.Len())
+			}
+
+			for _, c := range cases {
+				state, _ := table.Validate(mustParsePrefix(t, c.Prefix), c.Origin)
+				if state != c.State {
+					t.Errorf("%s AS%d: expected %s, got %s", c.Prefix, c.Origin, c.State, state)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Constants ############################################################
+
+// RTR (RFC 8210/6810) PDU types
+const (
+	RTR_SERIAL_NOTIFY  uint8 = 0
+	RTR_SERIAL_QUERY   uint8 = 1
+	RTR_RESET_QUERY    uint8 = 2
+	RTR_CACHE_RESPONSE uint8 = 3
+	RTR_IPV4_PREFIX    uint8 = 4
+	RTR_IPV6_PREFIX    uint8 = 6
+	RTR_END_OF_DATA    uint8 = 7
+	RTR_CACHE_RESET    uint8 = 8
+	RTR_ROUTER_KEY     uint8 = 9
+	RTR_ERROR_REPORT   uint8 = 10
+)
+
+// RTR error codes that the client handles
+const (
+	RTR_ERROR_NO_DATA             uint16 = 2
+	RTR_ERROR_UNSUPPORTED_VERSION uint16 = 4
+)
+
+const RTR_HEADER_LEN int = 8
+const RTR_MAX_PDU_LEN uint32 = 65536
+
+// Default timers (RFC 8210 section 6), used until the cache supplies its own
+const RTR_DEFAULT_REFRESH time.Duration = 3600 * time.Second
+const RTR_DEFAULT_RETRY time.Duration = 600 * time.Second
+const RTR_DEFAULT_EXPIRE time.Duration = 7200 * time.Second
+
+// ##### Structs ##############################################################
+
+// RtrPdu is a single decoded RTR PDU. Only the fields relevant to the PDU type are set
+type RtrPdu struct {
+	Version   uint8
+	Type      uint8
+	SessionId uint16
+	Serial    uint32
+	Announce  bool
+	Roa       *Roa
+	Refresh   uint32
+	Retry     uint32
+	Expire    uint32
+	ErrorCode uint16
+	ErrorText string
+}
+
+// RtrClient is a RPKI-to-Router client that keeps the RTR ROA's of a RoaTable in sync
+// with a validating cache, they are merged with the ROA's of any VRP file
+type RtrClient struct {
+	Address   string
+	mux       sync.Mutex
+	table     *RoaTable
+	roas      map[string]*Roa
+	version   uint8
+	sessionId uint16
+	serial    uint32
+	synced    bool
+	updated   time.Time
+	refresh   time.Duration
+	retry     time.Duration
+	expire    time.Duration
+}
+
+// ##### Methods ##############################################################
+
+// NewRtrClient returns a new RtrClient that will populate the table from the cache at the address (host:port)
+func NewRtrClient(address string, table *RoaTable) *RtrClient {
+
+	return &RtrClient{
+		Address: address,
+		table:   table,
+		roas:    make(map[string]*Roa),
+		version: 1,
+		refresh: RTR_DEFAULT_REFRESH,
+		retry:   RTR_DEFAULT_RETRY,
+		expire:  RTR_DEFAULT_EXPIRE,
+	}
+}
+
+// Start connects to the cache in the background, reconnecting after the retry interval on failure
+func (c *RtrClient) Start() {
+
+	go func() {
+		for {
+			conn, err := net.DialTimeout("tcp", c.Address, 30*time.Second)
+			if err != nil {
+				fmt.Printf("Error connecting to RTR server (%s): %v\n", c.Address, err)
+			} else {
+				err = c.Run(conn)
+				if err != nil {
+					fmt.Printf("RTR session error (%s): %v\n", c.Address, err)
+				}
+			}
+
+			c.checkExpiry()
+			time.Sleep(c.retryInterval())
+		}
+	}()
+}
+
+// Run performs a RTR session over the connection until it fails. Serial
+// queries are sent when the refresh interval expires or the cache sends a
+// serial notify, and a reset query is sent initially or on a cache reset
+func (c *RtrClient) Run(conn net.Conn) error {
+
+	defer conn.Close()
+
+	err := c.query(conn)
+	if err != nil {
+		return err
+	}
+
+	var pdu *RtrPdu
+	var pending map[string]*Roa
+	inResponse := false
+
+	for {
+		if inResponse == true {
+			conn.SetReadDeadline(time.Now().Add(c.retryInterval()))
+		} else {
+			conn.SetReadDeadline(time.Now().Add(c.refreshInterval()))
+		}
+
+		pdu, err = ReadRtrPdu(conn)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() == true && inResponse == false {
+				// Refresh interval has expired so poll the cache
+				err = c.query(conn)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			return err
+		}
+
+		switch pdu.Type {
+		case RTR_SERIAL_NOTIFY:
+			if inResponse == false {
+				err = c.query(conn)
+			}
+
+		case RTR_CACHE_RESPONSE:
+			inResponse = true
+			pending = c.begin(pdu)
+
+		case RTR_IPV4_PREFIX, RTR_IPV6_PREFIX:
+			if inResponse == false {
+				return fmt.Errorf("prefix PDU received outside of a cache response")
+			}
+			if pdu.Announce == true {
+				pending[pdu.Roa.String()] = pdu.Roa
+			} else {
+				delete(pending, pdu.Roa.String())
+			}
+
+		case RTR_END_OF_DATA:
+			if inResponse == false {
+				return fmt.Errorf("end of data PDU received outside of a cache response")
+			}
+			inResponse = false
+			c.commit(pdu, pending)
+			pending = nil
+
+		case RTR_CACHE_RESET:
+			c.mux.Lock()
+			c.synced = false
+			c.mux.Unlock()
+			err = c.query(conn)
+
+		case RTR_ERROR_REPORT:
+			return c.handleError(pdu)
+
+		case RTR_ROUTER_KEY:
+			// IGNORED
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Status returns the current serial, the time since the last successful sync and the number of ROA's
+func (c *RtrClient) Status() (uint32, time.Duration, int, bool) {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.updated.IsZero() == true {
+		return 0, 0, 0, false
+	}
+
+	return c.serial, time.Since(c.updated), len(c.roas), true
+}
+
+// query sends a serial query if the client has synced, else a reset query
+func (c *RtrClient) query(w io.Writer) error {
+
+	c.mux.Lock()
+	version := c.version
+	synced := c.synced
+	sessionId := c.sessionId
+	serial := c.serial
+	c.mux.Unlock()
+
+	if synced == true {
+		return WriteRtrPdu(w, &RtrPdu{Version: version, Type: RTR_SERIAL_QUERY, SessionId: sessionId, Serial: serial})
+	}
+
+	return WriteRtrPdu(w, &RtrPdu{Version: version, Type: RTR_RESET_QUERY})
+}
+
+// begin returns the working set of ROA's for a cache response, which is a
+// copy of the current set for incremental updates, or empty for a reset
+func (c *RtrClient) begin(pdu *RtrPdu) map[string]*Roa {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	pending := make(map[string]*Roa)
+	if c.synced == true && c.sessionId == pdu.SessionId {
+		for k, v := range c.roas {
+			pending[k] = v
+		}
+	}
+
+	return pending
+}
+
+// commit makes the working set current, and pushes it into the table
+func (c *RtrClient) commit(pdu *RtrPdu, pending map[string]*Roa) {
+
+	roas := make([]*Roa, 0, len(pending))
+	for _, r := range pending {
+		roas = append(roas, r)
+	}
+
+	c.mux.Lock()
+	c.roas = pending
+	c.sessionId = pdu.SessionId
+	c.serial = pdu.Serial
+	c.synced = true
+	c.updated = time.Now()
+	if pdu.Refresh > 0 {
+		c.refresh = time.Duration(pdu.Refresh) * time.Second
+	}
+	if pdu.Retry > 0 {
+		c.retry = time.Duration(pdu.Retry) * time.Second
+	}
+	if pdu.Expire > 0 {
+		c.expire = time.Duration(pdu.Expire) * time.Second
+	}
+	c.mux.Unlock()
+
+	c.table.Replace(ROA_SOURCE_RTR, roas)
+}
+
+// handleError processes an error report, downgrading to version 0 if the cache does not support version 1
+func (c *RtrClient) handleError(pdu *RtrPdu) error {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	switch pdu.ErrorCode {
+	case RTR_ERROR_UNSUPPORTED_VERSION:
+		if c.version > 0 {
+			c.version = 0
+			c.synced = false
+		}
+
+	case RTR_ERROR_NO_DATA:
+		return fmt.Errorf("cache has no data available")
+	}
+
+	return fmt.Errorf("error report (%d): %s", pdu.ErrorCode, pdu.ErrorText)
+}
+
+// checkExpiry clears the ROA's if the cache has not been reachable for the expire interval,
+// leaving those of any VRP file
+func (c *RtrClient) checkExpiry() {
+
+	c.mux.Lock()
+	expired := c.synced == true && time.Since(c.updated) > c.expire
+	if expired == true {
+		c.synced = false
+		c.roas = make(map[string]*Roa)
+	}
+	c.mux.Unlock()
+
+	if expired == true {
+		fmt.Printf("RTR data from %s has expired\n", c.Address)
+		c.table.Replace(ROA_SOURCE_RTR, []*Roa{})
+	}
+}
+
+// refreshInterval returns the interval between serial queries
+func (c *RtrClient) refreshInterval() time.Duration {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.refresh
+}
+
+// retryInterval returns the interval between connection attempts
+func (c *RtrClient) retryInterval() time.Duration {
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.retry
+}
+
+// ReadRtrPdu reads and decodes a single RTR PDU
+func ReadRtrPdu(r io.Reader) (*RtrPdu, error) {
+
+	hdr := make([]byte, RTR_HEADER_LEN)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(hdr[4:8])
+	if length < uint32(RTR_HEADER_LEN) || length > RTR_MAX_PDU_LEN {
+		return nil, fmt.Errorf("invalid PDU length: %d", length)
+	}
+
+	body := make([]byte, length-uint32(RTR_HEADER_LEN))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	pdu := &RtrPdu{
+		Version:   hdr[0],
+		Type:      hdr[1],
+		SessionId: binary.BigEndian.Uint16(hdr[2:4]),
+	}
+
+	switch pdu.Type {
+	case RTR_SERIAL_NOTIFY, RTR_SERIAL_QUERY:
+		if len(body) < 4 {
+			return nil, fmt.Errorf("short PDU (%d)", pdu.Type)
+		}
+		pdu.Serial = binary.BigEndian.Uint32(body[0:4])
+
+	case RTR_IPV4_PREFIX, RTR_IPV6_PREFIX:
+		addrLen := 4
+		if pdu.Type == RTR_IPV6_PREFIX {
+			addrLen = 16
+		}
+		if len(body) < 4+addrLen+4 {
+			return nil, fmt.Errorf("short PDU (%d)", pdu.Type)
+		}
+
+		pdu.Announce = body[0]&1 == 1
+		ip := net.IP(body[4 : 4+addrLen]).String()
+
+		var prefix bgp.AddrPrefixInterface
+		if addrLen == 4 {
+			prefix = bgp.NewIPAddrPrefix(body[1], ip)
+		} else {
+			prefix = bgp.NewIPv6AddrPrefix(body[1], ip)
+		}
+
+		pdu.Roa = &Roa{
+			Prefix:    prefix,
+			MaxLength: body[2],
+			Asn:       binary.BigEndian.Uint32(body[4+addrLen : 8+addrLen]),
+		}
+
+	case RTR_END_OF_DATA:
+		if len(body) < 4 {
+			return nil, fmt.Errorf("short PDU (%d)", pdu.Type)
+		}
+		pdu.Serial = binary.BigEndian.Uint32(body[0:4])
+
+		// Version 1 adds the timers
+		if len(body) >= 16 {
+			pdu.Refresh = binary.BigEndian.Uint32(body[4:8])
+			pdu.Retry = binary.BigEndian.Uint32(body[8:12])
+			pdu.Expire = binary.BigEndian.Uint32(body[12:16])
+		}
+
+	case RTR_ERROR_REPORT:
+		pdu.ErrorCode = pdu.SessionId
+		if len(body) >= 4 {
+			pduLen := binary.BigEndian.Uint32(body[0:4])
+			offset := 4 + uint64(pduLen)
+			if uint64(len(body)) >= offset+4 {
+				textLen := uint64(binary.BigEndian.Uint32(body[offset : offset+4]))
+				if uint64(len(body)) >= offset+4+textLen {
+					pdu.ErrorText = string(body[offset+4 : offset+4+textLen])
+				}
+			}
+		}
+	}
+
+	return pdu, nil
+}
+
+// WriteRtrPdu encodes and writes a single RTR PDU. Used for the client
+// queries, and the cache PDU's so that a cache can be stood up for testing
+func WriteRtrPdu(w io.Writer, pdu *RtrPdu) error {
+
+	var body []byte
+
+	switch pdu.Type {
+	case RTR_SERIAL_NOTIFY, RTR_SERIAL_QUERY:
+		body = make([]byte, 4)
+		binary.BigEndian.PutUint32(body, pdu.Serial)
+
+	case RTR_IPV4_PREFIX, RTR_IPV6_PREFIX:
+		ip, length, ok := prefixKey(pdu.Roa.Prefix)
+		if ok == false {
+			return fmt.Errorf("unsupported prefix: %s", pdu.Roa.Prefix)
+		}
+
+		body = make([]byte, 4+len(ip)+4)
+		if pdu.Announce == true {
+			body[0] = 1
+		}
+		body[1] = length
+		body[2] = pdu.Roa.MaxLength
+		copy(body[4:], ip)
+		binary.BigEndian.PutUint32(body[4+len(ip):], pdu.Roa.Asn)
+
+	case RTR_END_OF_DATA:
+		if pdu.Version == 0 {
+			body = make([]byte, 4)
+		} else {
+			body = make([]byte, 16)
+			binary.BigEndian.PutUint32(body[4:8], pdu.Refresh)
+			binary.BigEndian.PutUint32(body[8:12], pdu.Retry)
+			binary.BigEndian.PutUint32(body[12:16], pdu.Expire)
+		}
+		binary.BigEndian.PutUint32(body[0:4], pdu.Serial)
+
+	case RTR_ERROR_REPORT:
+		body = make([]byte, 8+len(pdu.ErrorText))
+		binary.BigEndian.PutUint32(body[4:8], uint32(len(pdu.ErrorText)))
+		copy(body[8:], pdu.ErrorText)
+	}
+
+	sessionId := pdu.SessionId
+	if pdu.Type == RTR_ERROR_REPORT {
+		sessionId = pdu.ErrorCode
+	}
+
+	// Prefix PDU's and Reset Query/Cache Reset have a zero session field
+	if pdu.Type == RTR_IPV4_PREFIX || pdu.Type == RTR_IPV6_PREFIX ||
+		pdu.Type == RTR_RESET_QUERY || pdu.Type == RTR_CACHE_RESET {
+		sessionId = 0
+	}
+
+	data := make([]byte, RTR_HEADER_LEN, RTR_HEADER_LEN+len(body))
+	data[0] = pdu.Version
+	data[1] = pdu.Type
+	binary.BigEndian.PutUint16(data[2:4], sessionId)
+	binary.BigEndian.PutUint32(data[4:8], uint32(RTR_HEADER_LEN+len(body)))
+	data = append(data, body...)
+
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestRtrClient checks that the client syncs the ROA's from an RTR cache, with a
+// reset query and then a serial query on a serial notify, and that they are
+// merged with the ROA's of the VRP file
+func TestRtrClient(t *testing.T) {
+
+	table := NewRoaTable()
+	table.Replace(ROA_SOURCE_FILE, []*Roa{{Prefix: mustParsePrefix(t, "8.8.8.0/24"), MaxLength: 24, Asn: 15169}})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+
+	hijacked := &Roa{Prefix: mustParsePrefix(t, TEST_PREFIX_V4), MaxLength: 24, Asn: 15169}
+	v6 := &Roa{Prefix: mustParsePrefix(t, TEST_PREFIX_V6), MaxLength: 48, Asn: 15169}
+
+	// The cache stand in, which answers the reset query, notifies a new serial and answers the serial query
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		pdu, err := ReadRtrPdu(conn)
+		if err != nil || pdu.Type != RTR_RESET_QUERY {
+			t.Errorf("expected a reset query: %+v %v", pdu, err)
+			return
+		}
+
+		for _, p := range []*RtrPdu{
+			{Version: 1, Type: RTR_CACHE_RESPONSE, SessionId: 7},
+			{Version: 1, Type: RTR_IPV4_PREFIX, Announce: true, Roa: hijacked},
+			{Version: 1, Type: RTR_END_OF_DATA, SessionId: 7, Serial: 1, Refresh: 3600, Retry: 600, Expire: 7200},
+			{Version: 1, Type: RTR_SERIAL_NOTIFY, SessionId: 7, Serial: 2},
+		} {
+			WriteRtrPdu(conn, p)
+		}
+
+		pdu, err = ReadRtrPdu(conn)
+		if err != nil || pdu.Type != RTR_SERIAL_QUERY || pdu.SessionId != 7 || pdu.Serial != 1 {
+			t.Errorf("expected a serial query for serial 1: %+v %v", pdu, err)
+			return
+		}
+
+		for _, p := range []*RtrPdu{
+			{Version: 1, Type: RTR_CACHE_RESPONSE, SessionId: 7},
+			{Version: 1, Type: RTR_IPV4_PREFIX, Announce: false, Roa: hijacked},
+			{Version: 1, Type: RTR_IPV6_PREFIX, Announce: true, Roa: v6},
+			{Version: 1, Type: RTR_END_OF_DATA, SessionId: 7, Serial: 2, Refresh: 3600, Retry: 600, Expire: 7200},
+		} {
+			WriteRtrPdu(conn, p)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+
+	// The session ends when the cache closes the connection
+	client := NewRtrClient(ln.Addr().String(), table)
+	client.Run(conn)
+
+	serial, _, count, ok := client.Status()
+	if ok == false || serial != 2 || count != 1 {
+		t.Errorf("unexpected status: serial %d, %d ROAs, synchronised %v", serial, count, ok)
+	}
+
+	if table.Len() != 2 {
+		t.Errorf("expected the file and RTR ROAs, %d ROAs", table.Len())
+	}
+
+	if state, _ := table.Validate(mustParsePrefix(t, "8.8.8.0/24"), 15169); state != RpkiValid {
+		t.Errorf("expected the file ROA to be kept, state %s", state)
+	}
+	if state, _ := table.Validate(mustParsePrefix(t, "2001:4860::/48"), 15169); state != RpkiValid {
+		t.Errorf("expected the announced RTR ROA to be held, state %s", state)
+	}
+	if state, _ := table.Validate(mustParsePrefix(t, TEST_PREFIX_V4), 15169); state != RpkiNotFound {
+		t.Errorf("expected the withdrawn RTR ROA to be removed, state %s", state)
+	}
+
+	// Expiry of the RTR data leaves the file ROAs
+	table.Replace(ROA_SOURCE_RTR, []*Roa{})
+	if table.Len() != 1 {
+		t.Errorf("expected only the file ROA, %d ROAs", table.Len())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Structs ##############################################################
+
+// ruleCheck returns the findings of a rule for an update (or withdrawal)
+type ruleCheck func(d *Detector, r *Rule, dd *DetectData) []*Alert
+
+// Rule is a named detection check, with the priority of its alerts (0 uses the
+// priorities of the check), its thresholds and the AS's and prefixes it applies
+// to (all updates if none). Rules are evaluated independently of each other
+type Rule struct {
+	Name        string
+	Enabled     bool
+	Priority    AlertPriority
+	Thresholds  map[string]int
+	As          map[uint32]struct{}
+	Prefixes    []bgp.AddrPrefixInterface
+	prefixTree  *PrefixTree
+	withdrawals bool
+	check       ruleCheck
+}
+
+// RuleConfig changes a rule from its defaults, only the thresholds that are set
+// are changed. Rules are enabled unless enabled is set to false
+type RuleConfig struct {
+	Name       string         `mapstructure:"name"`
+	Enabled    *bool          `mapstructure:"enabled"`
+	Priority   string         `mapstructure:"priority"`
+	Thresholds map[string]int `mapstructure:"thresholds"`
+	As         []uint32       `mapstructure:"as"`
+	Prefixes   []string       `mapstructure:"prefixes"`
+}
+
+type RuleConfigs struct {
+	Rules []RuleConfig `mapstructure:"rules"`
+}
+
+// ##### Methods ##############################################################
+
+// defaultRules returns every rule, enabled and with its default thresholds, in
+// the order that they are evaluated. The withdrawal thresholds default to the
+// withdrawal_threshold, withdrawal_window (minutes) and withdrawal_min_peers values
+func defaultRules(config *Config) []*Rule {
+
+	return []*Rule{
+		newRule("mass_withdrawal", (*Detector).isMassWithdrawal, map[string]int{
+			"threshold": config.WithdrawalThreshold,
+			"window":    config.WithdrawalWindow,
+			"min_peers": config.WithdrawalMinPeers,
+		}, true),
+		newRule("rpki_invalid", (*Detector).isRpkiInvalid, nil, false),
+		newRule("as_set_origin", (*Detector).isAsSetOrigin, nil, false),
+		newRule("route_leak", (*Detector).isRouteLeak, nil, false),
+		newRule("monitored_country", (*Detector).isAnomlousCountry, nil, false),
+		newRule("prefix_hijack", (*Detector).isAnomlousPrefix, nil, false),
+		newRule("new_adjacency", (*Detector).isNewAdjacency, nil, false),
+		newRule("path_frequency", (*Detector).isLowFrequency, map[string]int{
+			"low_frequency":      5,
+			"moderate_frequency": 10,
+		}, false),
+		newRule("rogue_first_peer", (*Detector).isAnomlousPeer, nil, false),
+	}
+}
+
+// newRule returns an enabled rule, that applies to all updates. Withdrawal rules
+// only check withdrawals, the others only check announcements
+func newRule(name string, check ruleCheck, thresholds map[string]int, withdrawals bool) *Rule {
+
+	if thresholds == nil {
+		thresholds = make(map[string]int)
+	}
+
+	return &Rule{
+		Name:        name,
+		Enabled:     true,
+		Thresholds:  thresholds,
+		As:          make(map[uint32]struct{}),
+		Prefixes:    make([]bgp.AddrPrefixInterface, 0),
+		prefixTree:  NewPrefixTree(),
+		withdrawals: withdrawals,
+		check:       check,
+	}
+}
+
+// NewRules returns the default rules, changed by the rules of the configuration.
+// Returns an error for unknown rules or thresholds, or invalid priorities or prefixes
+func NewRules(config *Config) ([]*Rule, error) {
+
+	rules := defaultRules(config)
+
+	names := make(map[string]*Rule, len(rules))
+	for _, r := range rules {
+		names[r.Name] = r
+	}
+
+	var err error
+	for _, rc := range config.Rules {
+		r := names[strings.ToLower(rc.Name)]
+		if r == nil {
+			return rules, fmt.Errorf("unknown rule: %s", rc.Name)
+		}
+
+		r.Enabled = rc.Enabled == nil || *rc.Enabled == true
+
+		if len(rc.Priority) > 0 {
+			r.Priority, err = parseAlertPriority(rc.Priority)
+			if err != nil {
+				return rules, fmt.Errorf("rule %s: %v", r.Name, err)
+			}
+		}
+
+		for name, value := range rc.Thresholds {
+			if _, ok := r.Thresholds[name]; ok == false {
+				return rules, fmt.Errorf("rule %s: unknown threshold: %s", r.Name, name)
+			}
+			r.Thresholds[name] = value
+		}
+
+		for _, as := range rc.As {
+			r.As[as] = struct{}{}
+		}
+
+		for _, p := range rc.Prefixes {
+			prefix, err := parsePrefix(p)
+			if err != nil {
+				return rules, fmt.Errorf("rule %s: invalid prefix: %s", r.Name, p)
+			}
+			r.Prefixes = append(r.Prefixes, prefix)
+			r.prefixTree.Add(prefix)
+		}
+	}
+
+	return rules, nil
+}
+
+// Threshold returns the value of the named threshold
+func (r *Rule) Threshold(name string) int {
+
+	return r.Thresholds[name]
+}
+
+// Applies returns true if the rule is enabled and the update is within its scope
+// i.e. the origin is one of its AS's, or a prefix is, covers or is covered by
+// one of its prefixes. Rules without AS's or prefixes apply to all updates
+func (r *Rule) Applies(dd *DetectData) bool {
+
+	if r.Enabled == false || r.withdrawals != (len(dd.Withdrawn) > 0) {
+		return false
+	}
+
+	if len(r.As) == 0 && len(r.Prefixes) == 0 {
+		return true
+	}
+
+	if dd.AsPath != nil {
+		for _, as := range dd.AsPath.Origins() {
+			if _, ok := r.As[as]; ok == true {
+				return true
+			}
+		}
+	}
+
+	for _, prefixes := range [][]bgp.AddrPrefixInterface{dd.NLRI, dd.Withdrawn} {
+		for _, n := range prefixes {
+			if len(r.prefixTree.Match(n)) > 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Run returns the findings of the rule for the update, with the priority of the rule
+func (r *Rule) Run(d *Detector, dd *DetectData) []*Alert {
+
+	alerts := r.check(d, r, dd)
+
+	if r.Priority != 0 {
+		for _, a := range alerts {
+			a.Priority = r.Priority
+		}
+	}
+
+	return alerts
+}
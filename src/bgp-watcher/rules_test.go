@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	viper "github.com/spf13/viper"
+)
+
+// The values of the optional enabled flag of the rules
+var enabled = true
+var disabled = false
+
+// TestNewRules checks that the configured rules change the defaults, and that
+// invalid rules are rejected rather than ignored
+func TestNewRules(t *testing.T) {
+
+	config := &Config{WithdrawalThreshold: 50, WithdrawalWindow: 5, WithdrawalMinPeers: 3,
+		Rules: []RuleConfig{
+			{Name: "Mass_Withdrawal", Priority: "medium", Thresholds: map[string]int{"window": 10}},
+			{Name: "rpki_invalid", Enabled: &disabled},
+			{Name: "as_set_origin", Enabled: &enabled},
+		}}
+
+	rules, err := NewRules(config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rules) != len(defaultRules(config)) {
+		t.Fatalf("expected all of the rules, %d returned", len(rules))
+	}
+
+	r := rules[0]
+	if r.Name != "mass_withdrawal" || r.Enabled == false || r.Priority != PriorityMedium ||
+		r.Threshold("window") != 10 || r.Threshold("threshold") != 50 || r.Threshold("min_peers") != 3 {
+		t.Errorf("unexpected rule: %+v", r)
+	}
+
+	// Only the rule that is explicitly disabled is disabled
+	if rules[1].Enabled == true || rules[2].Enabled == false {
+		t.Errorf("unexpected enabled rules: %s %v, %s %v", rules[1].Name, rules[1].Enabled, rules[2].Name, rules[2].Enabled)
+	}
+
+	invalid := []RuleConfig{
+		{Name: "unknown"},
+		{Name: "path_frequency", Thresholds: map[string]int{"unknown": 1}},
+		{Name: "path_frequency", Priority: "urgent"},
+		{Name: "path_frequency", Prefixes: []string{"192.104.160.0/33"}},
+	}
+
+	for _, rc := range invalid {
+		config.Rules = []RuleConfig{rc}
+		_, err = NewRules(config)
+		if err == nil {
+			t.Errorf("expected an error for the rule: %+v", rc)
+		}
+	}
+}
+
+// TestReloadConfig checks that concurrent reloads replace the detector's rules
+// with those of the config file, without changing the configuration
+func TestReloadConfig(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+
+	detector = NewDetector(config)
+	defer func() { detector = nil }()
+
+	configReader = viper.New()
+	configReader.SetConfigType("json")
+	err := configReader.ReadConfig(strings.NewReader(`{"rules": [{"name": "path_frequency", "enabled": false}, {"name": "route_leak", "priority": "low"}]}`))
+	if err != nil {
+		t.Fatalf("error reading config: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reloadConfig(false)
+		}()
+	}
+	wg.Wait()
+
+	for _, r := range detector.Rules() {
+		switch r.Name {
+		case "path_frequency":
+			if r.Enabled == true {
+				t.Errorf("expected the path_frequency rule to be disabled")
+			}
+		case "route_leak":
+			if r.Enabled == false || r.Priority != PriorityLow {
+				t.Errorf("expected the route_leak rule to be enabled with a low priority: %+v", r)
+			}
+		}
+	}
+
+	if len(config.Rules) != 0 {
+		t.Errorf("expected the configuration to be unchanged, %d rules", len(config.Rules))
+	}
+}
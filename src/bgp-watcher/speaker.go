@@ -0,0 +1,595 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// ##### Constants ############################################################
+
+// BGP_PORT is the default neighbour port, BGP_AS_TRANS is sent as our AS in the OPEN
+// when it does not fit in two bytes (RFC 6793), BGP_CONNECT_RETRY is how long to wait
+// between connection attempts and BGP_OPEN_HOLD_TIME limits the time waiting for the OPEN
+const BGP_PORT string = "179"
+const BGP_AS_TRANS uint16 = 23456
+const BGP_CONNECT_RETRY time.Duration = 30 * time.Second
+const BGP_OPEN_HOLD_TIME time.Duration = 4 * time.Minute
+
+// ##### Structs ##############################################################
+
+// BgpSessionState is the (RFC 4271) FSM state of a session
+type BgpSessionState int
+
+// The session states
+const (
+	BgpStateIdle        BgpSessionState = 0
+	BgpStateConnect     BgpSessionState = 1
+	BgpStateActive      BgpSessionState = 2
+	BgpStateOpenSent    BgpSessionState = 3
+	BgpStateOpenConfirm BgpSessionState = 4
+	BgpStateEstablished BgpSessionState = 5
+)
+
+// BgpSpeaker is a read-only BGP speaker that peers with our routers. Updates
+// received from the neighbours are passed to the detector, nothing is ever
+// announced. The paths from iBGP neighbours (our own AS) have our AS prepended
+type BgpSpeaker struct {
+	LocalAs  uint32
+	RouterId net.IP
+	HoldTime time.Duration
+	Listen   string
+	detector *Detector
+	mux      sync.Mutex
+	sessions map[string]*BgpSession
+}
+
+// BgpSession is the session with a single neighbour
+type BgpSession struct {
+	Neighbour BgpNeighbourConfig
+	speaker   *BgpSpeaker
+	mux       sync.Mutex
+	wmux      sync.Mutex
+	state     BgpSessionState
+	changed   time.Time
+	updates   uint64
+	peerAs    uint32
+	holdTime  time.Duration
+	conn      net.Conn
+}
+
+// ##### Methods ##############################################################
+
+// String returns the RFC 4271 name of the state
+func (s BgpSessionState) String() string {
+
+	switch s {
+	case BgpStateConnect:
+		return "Connect"
+	case BgpStateActive:
+		return "Active"
+	case BgpStateOpenSent:
+		return "OpenSent"
+	case BgpStateOpenConfirm:
+		return "OpenConfirm"
+	case BgpStateEstablished:
+		return "Established"
+	default:
+		return "Idle"
+	}
+}
+
+// NewBgpSpeaker returns a new BgpSpeaker with a session for each of the neighbours
+func NewBgpSpeaker(localAs uint32, routerId net.IP, holdTime time.Duration, listen string,
+	neighbours []BgpNeighbourConfig, detector *Detector) *BgpSpeaker {
+
+	s := &BgpSpeaker{
+		LocalAs:  localAs,
+		RouterId: routerId,
+		HoldTime: holdTime,
+		Listen:   listen,
+		detector: detector,
+		sessions: make(map[string]*BgpSession),
+	}
+
+	for _, n := range neighbours {
+		if len(n.Name) == 0 {
+			n.Name = n.Address
+		}
+		s.sessions[n.Address] = &BgpSession{Neighbour: n, speaker: s, changed: time.Now().UTC(), peerAs: n.PeerAs}
+	}
+
+	return s
+}
+
+// Start listens for the neighbours (if a listen address is set) and connects
+// to each of the neighbours that are not passive, in the background
+func (s *BgpSpeaker) Start() error {
+
+	if len(s.Listen) > 0 {
+		ln, err := net.Listen("tcp", s.Listen)
+		if err != nil {
+			return err
+		}
+
+		go s.accept(ln)
+	}
+
+	for _, session := range s.sessions {
+		if session.Neighbour.Passive == true {
+			continue
+		}
+
+		go func(session *BgpSession) {
+			address := session.Neighbour.Address
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				address = net.JoinHostPort(address, BGP_PORT)
+			}
+
+			for {
+				if session.State() == BgpStateIdle {
+					session.setState(BgpStateConnect, "")
+
+					conn, err := net.DialTimeout("tcp", address, BGP_CONNECT_RETRY)
+					if err != nil {
+						session.setState(BgpStateIdle, err.Error())
+					} else {
+						s.run(session, conn)
+					}
+				}
+
+				time.Sleep(BGP_CONNECT_RETRY)
+			}
+		}(session)
+	}
+
+	return nil
+}
+
+// Sessions returns the sessions in neighbour name order
+func (s *BgpSpeaker) Sessions() []*BgpSession {
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	sessions := make([]*BgpSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Neighbour.Name < sessions[j].Neighbour.Name
+	})
+
+	return sessions
+}
+
+// accept handles incoming connections, which must be from a configured
+// neighbour that does not already have a session in progress
+func (s *BgpSpeaker) accept(ln net.Listener) {
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			fmt.Printf("Error accepting BGP connection: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		session := s.session(conn.RemoteAddr())
+		if session == nil {
+			fmt.Printf("Rejected BGP connection from unknown neighbour: %s\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		// Only one connection per neighbour, the existing one wins any collision
+		if session.State() != BgpStateIdle && session.State() != BgpStateActive {
+			conn.Close()
+			continue
+		}
+		session.setState(BgpStateActive, "")
+
+		go s.run(session, conn)
+	}
+}
+
+// session returns the session for the remote address, or nil if it is not a neighbour
+func (s *BgpSpeaker) session(addr net.Addr) *BgpSession {
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for address, session := range s.sessions {
+		if h, _, err := net.SplitHostPort(address); err == nil {
+			address = h
+		}
+		if ip.Equal(net.ParseIP(address)) == true {
+			return session
+		}
+	}
+
+	return nil
+}
+
+// run performs the session over the connection, logging why it ended
+func (s *BgpSpeaker) run(session *BgpSession, conn net.Conn) {
+
+	err := session.Run(conn)
+	if err != nil && err != io.EOF {
+		fmt.Printf("BGP session error (%s): %v\n", session.Neighbour.Name, err)
+	}
+}
+
+// State returns the current state of the session
+func (bs *BgpSession) State() BgpSessionState {
+
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+
+	return bs.state
+}
+
+// Status returns the state, when it last changed, the number of updates received and
+// the neighbour's AS (from its OPEN if it was not configured)
+func (bs *BgpSession) Status() (BgpSessionState, time.Time, uint64, uint32) {
+
+	bs.mux.Lock()
+	defer bs.mux.Unlock()
+
+	return bs.state, bs.changed, bs.updates, bs.peerAs
+}
+
+// Run performs the OPEN exchange and then processes updates until the session fails
+func (bs *BgpSession) Run(conn net.Conn) error {
+
+	bs.mux.Lock()
+	bs.conn = conn
+	bs.mux.Unlock()
+
+	defer conn.Close()
+
+	err := bs.open(conn)
+	if err != nil {
+		bs.setState(BgpStateIdle, err.Error())
+		return err
+	}
+
+	err = bs.established(conn)
+	bs.setState(BgpStateIdle, err.Error())
+
+	return err
+}
+
+// Send writes a single message to the neighbour
+func (bs *BgpSession) Send(msg *bgp.BGPMessage) error {
+
+	data, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+
+	bs.wmux.Lock()
+	defer bs.wmux.Unlock()
+
+	bs.mux.Lock()
+	conn := bs.conn
+	bs.mux.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	_, err = conn.Write(data)
+	return err
+}
+
+// open sends our OPEN, validates the neighbour's OPEN and waits for the KEEPALIVE that confirms it
+func (bs *BgpSession) open(conn net.Conn) error {
+
+	s := bs.speaker
+
+	myAs := BGP_AS_TRANS
+	if s.LocalAs <= 0xFFFF {
+		myAs = uint16(s.LocalAs)
+	}
+
+	caps := []bgp.ParameterCapabilityInterface{
+		bgp.NewCapMultiProtocol(bgp.RF_IPv4_UC),
+		bgp.NewCapMultiProtocol(bgp.RF_IPv6_UC),
+		bgp.NewCapRouteRefresh(),
+		bgp.NewCapFourOctetASNumber(s.LocalAs),
+	}
+
+	err := bs.Send(bgp.NewBGPOpenMessage(myAs, uint16(s.HoldTime/time.Second), s.RouterId.String(),
+		[]bgp.OptionParameterInterface{bgp.NewOptionParameterCapability(caps)}))
+	if err != nil {
+		return err
+	}
+	bs.setState(BgpStateOpenSent, "")
+
+	conn.SetReadDeadline(time.Now().Add(BGP_OPEN_HOLD_TIME))
+	msg, err := ReadBgpMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	if n, ok := msg.Body.(*bgp.BGPNotification); ok {
+		return fmt.Errorf("received notification: %s", bgp.NewNotificationErrorCode(n.ErrorCode, n.ErrorSubcode))
+	}
+
+	open, ok := msg.Body.(*bgp.BGPOpen)
+	if ok == false {
+		return bs.notify(bgp.BGP_ERROR_FSM_ERROR, 0, "expected OPEN")
+	}
+
+	// The neighbour's 4-byte AS is in its capability, with AS_TRANS in the OPEN
+	peerAs := uint32(open.MyAS)
+	for _, p := range open.OptParams {
+		if c, ok := p.(*bgp.OptionParameterCapability); ok {
+			for _, pc := range c.Capability {
+				if fo, ok := pc.(*bgp.CapFourOctetASNumber); ok {
+					peerAs = fo.CapValue
+				}
+			}
+		}
+	}
+
+	if open.Version != 4 {
+		return bs.notify(bgp.BGP_ERROR_OPEN_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_UNSUPPORTED_VERSION_NUMBER,
+			fmt.Sprintf("unsupported version: %d", open.Version))
+	}
+
+	if bs.Neighbour.PeerAs != 0 && peerAs != bs.Neighbour.PeerAs {
+		return bs.notify(bgp.BGP_ERROR_OPEN_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_BAD_PEER_AS,
+			fmt.Sprintf("unexpected peer AS: %d", peerAs))
+	}
+
+	if open.HoldTime == 1 || open.HoldTime == 2 {
+		return bs.notify(bgp.BGP_ERROR_OPEN_MESSAGE_ERROR, bgp.BGP_ERROR_SUB_UNACCEPTABLE_HOLD_TIME,
+			fmt.Sprintf("unacceptable hold time: %d", open.HoldTime))
+	}
+
+	// The smaller of the hold times is used, zero disables the hold timer and keepalives
+	holdTime := s.HoldTime
+	if time.Duration(open.HoldTime)*time.Second < holdTime {
+		holdTime = time.Duration(open.HoldTime) * time.Second
+	}
+
+	bs.mux.Lock()
+	bs.holdTime = holdTime
+	bs.peerAs = peerAs
+	bs.mux.Unlock()
+
+	err = bs.Send(bgp.NewBGPKeepAliveMessage())
+	if err != nil {
+		return err
+	}
+	bs.setState(BgpStateOpenConfirm, "")
+
+	bs.setReadDeadline(conn)
+	msg, err = ReadBgpMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	switch body := msg.Body.(type) {
+	case *bgp.BGPKeepAlive:
+		bs.setState(BgpStateEstablished, "")
+		return nil
+
+	case *bgp.BGPNotification:
+		return fmt.Errorf("received notification: %s", bgp.NewNotificationErrorCode(body.ErrorCode, body.ErrorSubcode))
+	}
+
+	return bs.notify(bgp.BGP_ERROR_FSM_ERROR, 0, "expected KEEPALIVE")
+}
+
+// processUpdate detects against the update, or withdraws all of its routes when
+// the update is treated as withdraw
+func (bs *BgpSession) processUpdate(conn net.Conn, update *bgp.BGPUpdate, treatAsWithdraw bool) {
+
+	bs.mux.Lock()
+	bs.updates++
+	name := bs.Neighbour.Name
+	peerAs := bs.peerAs
+	bs.mux.Unlock()
+
+	nlri, withdrawn := extractPrefixes(update)
+	if treatAsWithdraw == true {
+		detectUpdate(bs.speaker.detector, name, time.Now().UTC(), peerAs, bs.peerIP(conn), nil, nil, append(withdrawn, nlri...))
+		return
+	}
+
+	// iBGP neighbours do not add our AS to the path, so it is added for the
+	// checks that expect the path to start with the peer e.g. rogue first peer
+	asPath := NewAsPath(update.PathAttributes)
+	if asPath != nil && peerAs == bs.speaker.LocalAs {
+		asPath = asPath.Prepend(peerAs)
+	}
+
+	detectUpdate(bs.speaker.detector, name, time.Now().UTC(), peerAs, bs.peerIP(conn), asPath, nlri, withdrawn)
+}
+
+// established sends keepalives and processes the neighbour's messages until the session fails
+func (bs *BgpSession) established(conn net.Conn) error {
+
+	bs.mux.Lock()
+	holdTime := bs.holdTime
+	bs.mux.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if holdTime > 0 {
+		go func() {
+			ticker := time.NewTicker(holdTime / 3)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if bs.Send(bgp.NewBGPKeepAliveMessage()) != nil {
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for {
+		bs.setReadDeadline(conn)
+
+		msg, err := ReadBgpMessage(conn)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() == true {
+				return bs.notify(bgp.BGP_ERROR_HOLD_TIMER_EXPIRED, 0, "hold timer expired")
+			}
+			if me, ok := err.(*bgp.MessageError); ok {
+				// Malformed attributes that only affect the update (RFC 7606) do not reset
+				// the session. A discarded attribute leaves the update out, otherwise the
+				// routes of the update are withdrawn
+				switch me.ErrorHandling {
+				case bgp.ERROR_HANDLING_ATTRIBUTE_DISCARD:
+					fmt.Printf("Ignoring malformed update from BGP neighbour (%s): %s\n", bs.Neighbour.Name, me.Message)
+					continue
+				case bgp.ERROR_HANDLING_TREAT_AS_WITHDRAW, bgp.ERROR_HANDLING_AFISAFI_DISABLE:
+					fmt.Printf("Treating malformed update from BGP neighbour (%s) as withdraw: %s\n", bs.Neighbour.Name, me.Message)
+					if msg != nil {
+						if update, ok := msg.Body.(*bgp.BGPUpdate); ok == true {
+							bs.processUpdate(conn, update, true)
+						}
+					}
+					continue
+				}
+				return bs.notify(me.TypeCode, me.SubTypeCode, me.Message)
+			}
+			return err
+		}
+
+		switch body := msg.Body.(type) {
+		case *bgp.BGPUpdate:
+			bs.processUpdate(conn, body, false)
+
+		case *bgp.BGPNotification:
+			return fmt.Errorf("received notification: %s", bgp.NewNotificationErrorCode(body.ErrorCode, body.ErrorSubcode))
+
+		case *bgp.BGPOpen:
+			return bs.notify(bgp.BGP_ERROR_FSM_ERROR, 0, "unexpected OPEN")
+		}
+	}
+}
+
+// notify sends a NOTIFICATION to the neighbour and returns the reason as an error
+func (bs *BgpSession) notify(code uint8, subcode uint8, reason string) error {
+
+	bs.Send(bgp.NewBGPNotificationMessage(code, subcode, nil))
+	return fmt.Errorf("sent notification (%s): %s", bgp.NewNotificationErrorCode(code, subcode), reason)
+}
+
+// setReadDeadline applies the hold timer to the next read
+func (bs *BgpSession) setReadDeadline(conn net.Conn) {
+
+	bs.mux.Lock()
+	holdTime := bs.holdTime
+	bs.mux.Unlock()
+
+	if holdTime > 0 {
+		conn.SetReadDeadline(time.Now().Add(holdTime))
+	} else {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// peerIP returns the neighbour's address from the connection
+func (bs *BgpSession) peerIP(conn net.Conn) net.IP {
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+
+	return net.ParseIP(bs.Neighbour.Address)
+}
+
+// setState moves the session to a new state, alerting when the session is
+// established or when an established session goes down. Leaving the
+// established state withdraws the routes that were learnt from the neighbour
+func (bs *BgpSession) setState(state BgpSessionState, reason string) {
+
+	now := time.Now().UTC()
+
+	bs.mux.Lock()
+	previous := bs.state
+	if previous == state {
+		bs.mux.Unlock()
+		return
+	}
+
+	bs.state = state
+	bs.changed = now
+	if state == BgpStateIdle {
+		bs.conn = nil
+	}
+
+	name := bs.Neighbour.Name
+	peerAs := bs.peerAs
+	peerIP := net.ParseIP(bs.Neighbour.Address)
+	if h, _, err := net.SplitHostPort(bs.Neighbour.Address); err == nil {
+		peerIP = net.ParseIP(h)
+	}
+	bs.mux.Unlock()
+
+	detector := bs.speaker.detector
+
+	switch {
+	case state == BgpStateEstablished:
+		detector.dispatch(NewAlert(&DetectData{Name: name, Timestamp: now, PeerAs: peerAs, PeerIP: peerIP},
+			PriorityLow, ReasonSessionUp, nil, map[string]string{"from_state": previous.String()}))
+
+	case previous == BgpStateEstablished:
+		detector.dispatch(NewAlert(&DetectData{Name: name, Timestamp: now, PeerAs: peerAs, PeerIP: peerIP},
+			PriorityHigh, ReasonSessionDown, nil, map[string]string{"to_state": state.String(), "error": reason}))
+
+		withdrawPeer(detector, name, peerIP, peerAs, now)
+	}
+}
+
+// ReadBgpMessage reads and decodes a single BGP message
+func ReadBgpMessage(r io.Reader) (*bgp.BGPMessage, error) {
+
+	header := make([]byte, bgp.BGP_HEADER_LENGTH)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[16:18]))
+	if length < bgp.BGP_HEADER_LENGTH || length > bgp.BGP_MAX_MESSAGE_LENGTH {
+		return nil, bgp.NewMessageError(bgp.BGP_ERROR_MESSAGE_HEADER_ERROR, bgp.BGP_ERROR_SUB_BAD_MESSAGE_LENGTH,
+			nil, fmt.Sprintf("invalid message length: %d", length))
+	}
+
+	data := make([]byte, length)
+	copy(data, header)
+
+	_, err = io.ReadFull(r, data[bgp.BGP_HEADER_LENGTH:])
+	if err != nil {
+		return nil, err
+	}
+
+	return bgp.ParseBGPMessage(data)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	bgp "github.com/osrg/gobgp/pkg/packet/bgp"
+)
+
+// TestBgpSpeakerIbgp checks that two speakers establish a session over loopback
+// and that an update from an iBGP neighbour is detected with our AS prepended,
+// rather than as a rogue first peer
+func TestBgpSpeakerIbgp(t *testing.T) {
+
+	newTestEnvironment(t, testCountries)
+	setTestRoute(t, 64512, "64512 174 15169", 20)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer ln.Close()
+
+	// The router, which announces our prefix to the watcher
+	router := NewBgpSpeaker(64512, net.ParseIP("192.0.2.1"), 90*time.Second, "",
+		[]BgpNeighbourConfig{{Name: "watcher", Address: "127.0.0.1", PeerAs: 64512, Passive: true}}, NewDetector(config))
+	routerSession := router.Sessions()[0]
+
+	routerDone := make(chan struct{})
+	var routerConn net.Conn
+	accepted := make(chan struct{})
+	go func() {
+		defer close(routerDone)
+
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		routerConn = conn
+		close(accepted)
+
+		routerSession.Run(conn)
+	}()
+
+	sink := new(testSink)
+	detector := NewDetector(config)
+	detector.AddAlertSink(sink, PriorityLow)
+	detector.StartInOrder()
+
+	watcher := NewBgpSpeaker(64512, net.ParseIP("192.0.2.254"), 90*time.Second, "",
+		[]BgpNeighbourConfig{{Name: "router", Address: ln.Addr().String(), PeerAs: 64512}}, detector)
+	watcherSession := watcher.Sessions()[0]
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		watcherSession.Run(conn)
+	}()
+
+	<-accepted
+	waitForSession(t, routerSession, BgpStateEstablished)
+	waitForSession(t, watcherSession, BgpStateEstablished)
+
+	err = routerSession.Send(bgp.NewBGPUpdateMessage(nil, []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeOrigin(0),
+		bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, []uint32{174, 15169})}),
+		bgp.NewPathAttributeNextHop("192.0.2.1"),
+	}, []*bgp.IPAddrPrefix{bgp.NewIPAddrPrefix(23, "192.104.160.0")}))
+	if err != nil {
+		t.Fatalf("error sending update: %v", err)
+	}
+
+	route := waitForRoute(t, "192.104.160.0/23", true)
+	if route.Path != "64512 174 15169" || route.PeerAs != 64512 {
+		t.Errorf("expected the iBGP route with our AS prepended, got %+v", route)
+	}
+
+	// An ORIGIN of the wrong length is malformed, so the update is treated as
+	// withdraw (RFC 7606) rather than resetting the session
+	err = routerSession.Send(bgp.NewBGPUpdateMessage(nil, []bgp.PathAttributeInterface{
+		bgp.NewPathAttributeUnknown(bgp.BGP_ATTR_FLAG_TRANSITIVE, bgp.BGP_ATTR_TYPE_ORIGIN, []byte{0, 0}),
+		bgp.NewPathAttributeAsPath([]bgp.AsPathParamInterface{bgp.NewAs4PathParam(bgp.BGP_ASPATH_ATTR_TYPE_SEQ, []uint32{174, 15169})}),
+		bgp.NewPathAttributeNextHop("192.0.2.1"),
+	}, []*bgp.IPAddrPrefix{bgp.NewIPAddrPrefix(23, "192.104.160.0")}))
+	if err != nil {
+		t.Fatalf("error sending update: %v", err)
+	}
+	waitForRoute(t, "192.104.160.0/23", false)
+
+	if watcherSession.State() != BgpStateEstablished {
+		t.Errorf("expected the session to stay established, state %s", watcherSession.State())
+	}
+
+	// Closing the router's end ends both sessions, once the watcher has read the update
+	routerConn.Close()
+	<-routerDone
+	<-watcherDone
+
+	detector.Wait()
+	detector.Close()
+
+	assertAlerts(t, sink.Alerts(),
+		"Low session_established AS64512 [] path [] from_state=OpenConfirm",
+		"High session_down AS64512 [] path [] error=EOF to_state=Idle")
+}
+
+// waitForSession waits for the session to reach the state
+func waitForSession(t *testing.T, session *BgpSession, state BgpSessionState) {
+
+	t.Helper()
+
+	for i := 0; i < 500; i++ {
+		if session.State() == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("session (%s) did not reach %s, state %s", session.Neighbour.Name, state, session.State())
+}
+
+// waitForRoute waits for the route state to hold a single route of the prefix, that is active or withdrawn
+func waitForRoute(t *testing.T, prefix string, active bool) Route {
+
+	t.Helper()
+
+	var routes []Route
+	for i := 0; i < 500; i++ {
+		routes = routeState.Routes(prefix)
+		if len(routes) == 1 && routes[0].Active == active {
+			return routes[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected a single route of %s (active %v), got %+v", prefix, active, routes)
+	return Route{}
+}
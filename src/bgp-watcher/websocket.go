@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ##### Constants ############################################################
+
+// WebSocket (RFC 6455) frame opcodes
+const (
+	WS_OPCODE_CONTINUATION byte = 0x0
+	WS_OPCODE_TEXT         byte = 0x1
+	WS_OPCODE_BINARY       byte = 0x2
+	WS_OPCODE_CLOSE        byte = 0x8
+	WS_OPCODE_PING         byte = 0x9
+	WS_OPCODE_PONG         byte = 0xA
+)
+
+// The GUID used to derive the accept key, and the largest message that will be read
+const WS_GUID string = "258EAFA5-E914-47DA-95CA-C5AB0DC11B85"
+const WS_MAX_MESSAGE_SIZE int = 16 * 1024 * 1024
+
+// ##### Structs ##############################################################
+
+// WebSocketConn is a minimal RFC 6455 connection, clients mask the frames
+// that they send and servers do not
+type WebSocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	wmux   sync.Mutex
+	client bool
+}
+
+// ##### Methods ##############################################################
+
+// DialWebSocket connects to a ws:// or wss:// URL and performs the opening handshake
+func DialWebSocket(rawUrl string, timeout time.Duration) (*WebSocketConn, error) {
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		conn, err = dialer.Dial("tcp", host)
+
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme: %s", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nUser-Agent: bgpm/%s\r\n\r\n",
+		u.RequestURI(), u.Host, key, APP_VERSION)
+
+	_, err = conn.Write([]byte(request))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %s", resp.Status)
+	}
+
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: invalid accept key")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &WebSocketConn{conn: conn, reader: reader, client: true}, nil
+}
+
+// AcceptWebSocket upgrades a HTTP request to a websocket connection, the
+// server side of the handshake (e.g. for a stand-in feed)
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") == false || len(key) == 0 {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, fmt.Errorf("not a websocket upgrade request")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if ok == false {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("response does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &WebSocketConn{conn: conn, reader: rw.Reader}, nil
+}
+
+// ReadMessage returns the next text or binary message, reassembling fragments,
+// answering pings and returning io.EOF when the peer closes the connection
+func (ws *WebSocketConn) ReadMessage() (byte, []byte, error) {
+
+	var opcode byte
+	message := make([]byte, 0)
+
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case WS_OPCODE_PING:
+			err = ws.writeFrame(WS_OPCODE_PONG, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case WS_OPCODE_PONG:
+			continue
+
+		case WS_OPCODE_CLOSE:
+			// Echo the status code back, as required by the closing handshake
+			ws.writeFrame(WS_OPCODE_CLOSE, payload)
+			return 0, nil, io.EOF
+
+		case WS_OPCODE_CONTINUATION:
+			if opcode == 0 {
+				return 0, nil, fmt.Errorf("unexpected websocket continuation frame")
+			}
+
+		case WS_OPCODE_TEXT, WS_OPCODE_BINARY:
+			if opcode != 0 {
+				return 0, nil, fmt.Errorf("unexpected websocket data frame during fragmented message")
+			}
+			opcode = op
+
+		default:
+			return 0, nil, fmt.Errorf("unknown websocket opcode: %d", op)
+		}
+
+		if len(message)+len(payload) > WS_MAX_MESSAGE_SIZE {
+			return 0, nil, fmt.Errorf("websocket message exceeds %d bytes", WS_MAX_MESSAGE_SIZE)
+		}
+		message = append(message, payload...)
+
+		if fin == true {
+			return opcode, message, nil
+		}
+	}
+}
+
+// WriteMessage sends a single (unfragmented) text message
+func (ws *WebSocketConn) WriteMessage(data []byte) error {
+
+	return ws.writeFrame(WS_OPCODE_TEXT, data)
+}
+
+// SetReadDeadline sets the deadline for the next ReadMessage
+func (ws *WebSocketConn) SetReadDeadline(t time.Time) error {
+
+	return ws.conn.SetReadDeadline(t)
+}
+
+// Close sends a normal closure frame and closes the connection
+func (ws *WebSocketConn) Close() error {
+
+	ws.writeFrame(WS_OPCODE_CLOSE, []byte{0x03, 0xE8})
+	return ws.conn.Close()
+}
+
+// readFrame reads a single frame, unmasking the payload if required
+func (ws *WebSocketConn) readFrame() (bool, byte, []byte, error) {
+
+	header := make([]byte, 2)
+	_, err := io.ReadFull(ws.reader, header)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		_, err = io.ReadFull(ws.reader, ext)
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		_, err = io.ReadFull(ws.reader, ext)
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if length > uint64(WS_MAX_MESSAGE_SIZE) {
+		return false, 0, nil, fmt.Errorf("websocket frame exceeds %d bytes", WS_MAX_MESSAGE_SIZE)
+	}
+
+	var mask []byte
+	if masked == true {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(ws.reader, mask)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(ws.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked == true {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a single final frame, clients must mask the payload
+func (ws *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	var maskBit byte
+	if ws.client == true {
+		maskBit = 0x80
+	}
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126, byte(length>>8), byte(length))
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(length))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, ext...)
+	}
+
+	if ws.client == true {
+		mask := make([]byte, 4)
+		_, err := rand.Read(mask)
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask...)
+
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	ws.wmux.Lock()
+	defer ws.wmux.Unlock()
+
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept value for the key
+func webSocketAccept(key string) string {
+
+	hash := sha1.Sum([]byte(key + WS_GUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}